@@ -0,0 +1,203 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// runAggregate implements the "aggregate" command, which serves the
+// metrics of several exporters on the same host, such as one per Varnish
+// instance, as one, so that Prometheus only needs to scrape one target.
+func runAggregate(args []string) int {
+	fs := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	targets := fs.String("targets", "", "Comma-separated metrics URLs of the exporters to aggregate, e.g. http://127.0.0.1:9152/metrics")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for each exporter's metrics")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] aggregate [aggregate flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *targets == "" {
+		fmt.Fprintf(os.Stderr, "-targets is required\n")
+		return 2
+	}
+
+	registry := prometheus.NewRegistry()
+	a, err := newAggregator(strings.Split(*targets, ","), *timeout, registry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	// The targets are scraped first, so that their metrics are current
+	http.Handle(*metricsPath, metricsHandler(prometheus.Gatherers{a, registry}))
+	log.Infof("Starting Server: %s, aggregating %s", *listenAddress, *targets)
+	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	return 0
+}
+
+// aggregator is a prometheus.Gatherer that scrapes several exporters and
+// merges their metrics. Series that more than one exporter has, with the
+// same labels, are added up; summaries lose their quantiles in doing so.
+type aggregator struct {
+	targets []string
+	client  *http.Client
+
+	up       *prometheus.GaugeVec
+	duration *prometheus.GaugeVec
+}
+
+// newAggregator creates an aggregator, registering the metrics about the
+// targets with registerer.
+func newAggregator(targets []string, timeout time.Duration, registerer prometheus.Registerer) (*aggregator, error) {
+	a := &aggregator{
+		targets: targets,
+		client:  &http.Client{Timeout: timeout},
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_aggregate_target_up",
+			Help:      "Whether the last scrape of an aggregated exporter succeeded.",
+		}, []string{"target"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_aggregate_target_scrape_seconds",
+			Help:      "Time the last scrape of an aggregated exporter took, in seconds.",
+		}, []string{"target"}),
+	}
+	for _, c := range []prometheus.Collector{a.up, a.duration} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Gather implements prometheus.Gatherer. Exporters that can't be scraped
+// are left out, rather than failing the whole scrape.
+func (a *aggregator) Gather() ([]*dto.MetricFamily, error) {
+	scraped := make([]map[string]*dto.MetricFamily, len(a.targets))
+	var wg sync.WaitGroup
+	for i, target := range a.targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			start := time.Now()
+			mfs, err := scrapeFamilies(a.client, target)
+			a.duration.WithLabelValues(target).Set(time.Since(start).Seconds())
+			if err != nil {
+				log.Warnf("could not scrape %s: %v", target, err)
+				a.up.WithLabelValues(target).Set(0)
+				return
+			}
+			a.up.WithLabelValues(target).Set(1)
+			scraped[i] = mfs
+		}(i, target)
+	}
+	wg.Wait()
+
+	merged := make(map[string]*dto.MetricFamily)
+	series := make(map[string]*dto.Metric)
+	for i, mfs := range scraped {
+		for name, mf := range mfs {
+			into, ok := merged[name]
+			if !ok {
+				into = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				merged[name] = into
+			} else if into.GetType() != mf.GetType() {
+				log.Warnf("%s is a %s in %s but a %s elsewhere, leaving it out", name, mf.GetType(), a.targets[i], into.GetType())
+				continue
+			}
+			for _, m := range mf.Metric {
+				sort.Sort(labelPairs(m.Label))
+				key := seriesKey(name, m.Label)
+				if existing, ok := series[key]; !ok {
+					series[key] = m
+					into.Metric = append(into.Metric, m)
+				} else if !addMetric(existing, m) {
+					log.Warnf("%s in %s has other buckets than elsewhere, leaving the series out", name, a.targets[i])
+				}
+			}
+		}
+	}
+	mfs := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		mfs = append(mfs, mf)
+	}
+	return mfs, nil
+}
+
+// addMetric adds the values of m to those of into, which must be of the
+// same type. It returns false for histograms with other buckets, leaving
+// into as it was.
+func addMetric(into, m *dto.Metric) bool {
+	switch {
+	case into.Counter != nil:
+		into.Counter.Value = proto.Float64(into.Counter.GetValue() + m.Counter.GetValue())
+	case into.Gauge != nil:
+		into.Gauge.Value = proto.Float64(into.Gauge.GetValue() + m.Gauge.GetValue())
+	case into.Untyped != nil:
+		into.Untyped.Value = proto.Float64(into.Untyped.GetValue() + m.Untyped.GetValue())
+	case into.Summary != nil:
+		// Quantiles can't be added up
+		into.Summary.Quantile = nil
+		into.Summary.SampleCount = proto.Uint64(into.Summary.GetSampleCount() + m.Summary.GetSampleCount())
+		into.Summary.SampleSum = proto.Float64(into.Summary.GetSampleSum() + m.Summary.GetSampleSum())
+	case into.Histogram != nil:
+		a, b := into.Histogram.Bucket, m.Histogram.GetBucket()
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i].GetUpperBound() != b[i].GetUpperBound() {
+				return false
+			}
+		}
+		for i := range a {
+			a[i].CumulativeCount = proto.Uint64(a[i].GetCumulativeCount() + b[i].GetCumulativeCount())
+		}
+		into.Histogram.SampleCount = proto.Uint64(into.Histogram.GetSampleCount() + m.Histogram.GetSampleCount())
+		into.Histogram.SampleSum = proto.Float64(into.Histogram.GetSampleSum() + m.Histogram.GetSampleSum())
+	}
+	return true
+}
+
+// seriesKey identifies a series by its metric name and sorted labels.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteString("\xff" + l.GetName() + "\xfe" + l.GetValue())
+	}
+	return b.String()
+}
+
+// labelPairs sorts label pairs by name.
+type labelPairs []*dto.LabelPair
+
+func (p labelPairs) Len() int           { return len(p) }
+func (p labelPairs) Less(i, j int) bool { return p[i].GetName() < p[j].GetName() }
+func (p labelPairs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,229 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// pathStats holds what the analyze command has seen for one normalized path.
+type pathStats struct {
+	times    []float64
+	hits     int
+	misses   int
+	sizes    int64
+	sizeObsv int
+}
+
+type pathReport struct {
+	Path      string  `json:"path"`
+	Requests  int     `json:"requests"`
+	P50       float64 `json:"p50_seconds"`
+	P95       float64 `json:"p95_seconds"`
+	P99       float64 `json:"p99_seconds"`
+	HitRatio  float64 `json:"hit_ratio"`
+	AvgSize   float64 `json:"avg_size_bytes"`
+	TotalSize int64   `json:"total_size_bytes"`
+}
+
+type analyzeReport struct {
+	Lines         int          `json:"lines"`
+	ParseFailures int          `json:"parse_failures"`
+	Dropped       int          `json:"dropped"`
+	Paths         []pathReport `json:"paths"`
+}
+
+// runAnalyze implements the "analyze" command, which reads varnishncsa
+// output in the exporter's format, or binary VSL files, and prints
+// per-path statistics.
+func runAnalyze(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format (text or json)")
+	top := fs.Int("top", 0, "Only report the N paths with the most requests (0 for all)")
+	vsl := fs.Bool("vsl", false, "The files are binary VSL files written by varnishlog -w, to be read with varnishncsa -r")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] analyze [analyze flags] [file...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	mapper, err := loadPathMappings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	hosts, err := mappings.LoadHosts(*hostMapFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stats := make(map[string]*pathStats)
+	report := &analyzeReport{}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		var in io.Reader = os.Stdin
+		if *vsl {
+			format, err := varnishNCSAFormat(false)
+			if err == nil {
+				in, err = openVSLFile(name, format)
+			}
+			if err != nil {
+				log.Error(err)
+				return 1
+			}
+		} else if name != "-" {
+			inFile, err := os.Open(name)
+			if err != nil {
+				log.Error(err)
+				return 1
+			}
+			defer func() { _ = inFile.Close() }()
+			in = inFile
+		}
+		if err := analyzeLines(in, mapper, hosts, stats, report); err != nil {
+			log.Errorf("%s: %v", name, err)
+			return 1
+		}
+	}
+
+	report.Paths = make([]pathReport, 0, len(stats))
+	for path, st := range stats {
+		report.Paths = append(report.Paths, st.report(path))
+	}
+	sort.Slice(report.Paths, func(i, j int) bool {
+		if report.Paths[i].Requests != report.Paths[j].Requests {
+			return report.Paths[i].Requests > report.Paths[j].Requests
+		}
+		return report.Paths[i].Path < report.Paths[j].Path
+	})
+	if *top > 0 && len(report.Paths) > *top {
+		report.Paths = report.Paths[:*top]
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Error(err)
+			return 1
+		}
+		return 0
+	}
+	writeAnalyzeText(os.Stdout, report)
+	return 0
+}
+
+func analyzeLines(r io.Reader, mapper *mappings.PathMapper, hosts *mappings.HostMapper, stats map[string]*pathStats, report *analyzeReport) error {
+	lineParser := &parser.Parser{Paths: mapper, Hosts: hosts, TimeUnits: durationName.Field().PerSecond}
+	scanner := newLineScanner(r, *maxLineSize, func() {
+		report.Lines++
+		report.ParseFailures++
+	})
+	for scanner.Scan() {
+		report.Lines++
+		metrics, labels, err := lineParser.Parse(scanner.Text())
+		if err == parser.ErrDropped {
+			report.Dropped++
+			continue
+		} else if err != nil {
+			report.ParseFailures++
+			log.Debug(err)
+			continue
+		}
+		path := labels.Value("path")
+		st, ok := stats[path]
+		if !ok {
+			st = &pathStats{}
+			stats[path] = st
+		}
+		switch labels.Value("cache") {
+		case "hit":
+			st.hits++
+		case "miss":
+			st.misses++
+		}
+		for _, m := range metrics {
+			switch m.Name {
+			case "time":
+				st.times = append(st.times, m.Value)
+			case "respsize":
+				st.sizes += int64(m.Value)
+				st.sizeObsv++
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (st *pathStats) report(path string) pathReport {
+	sort.Float64s(st.times)
+	r := pathReport{
+		Path:      path,
+		Requests:  len(st.times),
+		P50:       quantile(st.times, 0.50),
+		P95:       quantile(st.times, 0.95),
+		P99:       quantile(st.times, 0.99),
+		TotalSize: st.sizes,
+	}
+	if st.hits+st.misses > 0 {
+		r.HitRatio = float64(st.hits) / float64(st.hits+st.misses)
+	}
+	if st.sizeObsv > 0 {
+		r.AvgSize = float64(st.sizes) / float64(st.sizeObsv)
+	}
+	return r
+}
+
+// quantile returns the q-quantile of the sorted values using the
+// nearest-rank method.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func writeAnalyzeText(w io.Writer, report *analyzeReport) {
+	fmt.Fprintf(w, "%d lines, %d parse failures, %d dropped\n\n", report.Lines, report.ParseFailures, report.Dropped)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "REQUESTS\tP50\tP95\tP99\tHIT%\tAVG SIZE\t\tPATH")
+	for _, p := range report.Paths {
+		fmt.Fprintf(tw, "%d\t%.3f\t%.3f\t%.3f\t%.1f\t%.0f\t\t%s\n",
+			p.Requests, p.P50, p.P95, p.P99, 100*p.HitRatio, p.AvgSize, p.Path)
+	}
+	_ = tw.Flush()
+}
@@ -0,0 +1,202 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+const (
+	// anomalyAlpha is the EWMA smoothing factor applied per interval.
+	anomalyAlpha = 0.3
+	// anomalyReservoir is the number of request times kept per host and
+	// interval to estimate p99 from.
+	anomalyReservoir = 1000
+)
+
+type anomalyAlert struct {
+	Status    string  `json:"status"`
+	Host      string  `json:"host"`
+	Reason    string  `json:"reason"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Time      string  `json:"time"`
+	// Note explains an alert resolved for another reason than the value
+	// going back under the threshold.
+	Note string `json:"note,omitempty"`
+}
+
+// hostWindow collects one interval's worth of requests for a host, along
+// with the smoothed values carried over from earlier intervals.
+type hostWindow struct {
+	requests int
+	errors   int
+	times    []float64
+
+	errorRate float64
+	p99       float64
+	seeded    bool
+	firing    map[string]bool
+}
+
+// anomalyDetector keeps an EWMA of the 5xx rate and p99 request time per
+// host and posts an alert to a webhook when one of them crosses its
+// threshold, and again when it recovers.
+type anomalyDetector struct {
+	webhookURL string
+	errorRate  float64
+	p99        float64
+	client     *http.Client
+
+	mu    sync.Mutex
+	hosts map[string]*hostWindow
+}
+
+func newAnomalyDetector(webhookURL string, errorRate float64, p99 time.Duration, interval time.Duration) *anomalyDetector {
+	d := &anomalyDetector{
+		webhookURL: webhookURL,
+		errorRate:  errorRate,
+		p99:        p99.Seconds(),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		hosts:      make(map[string]*hostWindow),
+	}
+	go func() {
+		for range time.Tick(interval) {
+			d.evaluate()
+		}
+	}()
+	return d
+}
+
+func (d *anomalyDetector) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	status, _ := strconv.Atoi(labels.Value("status"))
+	host := labels.Value("host")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w, ok := d.hosts[host]
+	if !ok {
+		w = &hostWindow{firing: make(map[string]bool)}
+		d.hosts[host] = w
+	}
+	w.requests++
+	if status >= 500 {
+		w.errors++
+	}
+	for _, m := range metrics {
+		if m.Name != "time" {
+			continue
+		}
+		// Reservoir sampling keeps the p99 estimate cheap on busy hosts
+		if len(w.times) < anomalyReservoir {
+			w.times = append(w.times, m.Value)
+		} else if i := rand.Intn(w.requests); i < anomalyReservoir {
+			w.times[i] = m.Value
+		}
+	}
+}
+
+func (d *anomalyDetector) evaluate() {
+	var alerts []anomalyAlert
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	d.mu.Lock()
+	for host, w := range d.hosts {
+		if w.requests == 0 {
+			// A host without traffic would never be checked again, so its
+			// alerts are resolved and its history forgotten
+			for _, reason := range []string{"error_rate", "p99"} {
+				if w.firing[reason] {
+					alerts = append(alerts, anomalyAlert{"resolved", host, reason, 0, d.threshold(reason), now, "no requests in the interval"})
+				}
+			}
+			delete(d.hosts, host)
+			continue
+		}
+		errorRate := float64(w.errors) / float64(w.requests)
+		sort.Float64s(w.times)
+		p99 := quantile(w.times, 0.99)
+		if w.seeded {
+			w.errorRate = anomalyAlpha*errorRate + (1-anomalyAlpha)*w.errorRate
+			w.p99 = anomalyAlpha*p99 + (1-anomalyAlpha)*w.p99
+		} else {
+			w.errorRate, w.p99, w.seeded = errorRate, p99, true
+		}
+		w.requests, w.errors, w.times = 0, 0, w.times[:0]
+
+		check := func(reason string, value, threshold float64) {
+			breached := threshold > 0 && value > threshold
+			if breached == w.firing[reason] {
+				return
+			}
+			w.firing[reason] = breached
+			status := "resolved"
+			if breached {
+				status = "firing"
+			}
+			alerts = append(alerts, anomalyAlert{status, host, reason, value, threshold, now, ""})
+		}
+		check("error_rate", w.errorRate, d.threshold("error_rate"))
+		check("p99", w.p99, d.threshold("p99"))
+	}
+	d.mu.Unlock()
+
+	for _, alert := range alerts {
+		if alert.Note != "" {
+			log.Warnf("anomaly %s for host %q: %s, %s", alert.Status, alert.Host, alert.Reason, alert.Note)
+		} else {
+			log.Warnf("anomaly %s for host %q: %s is %g (threshold %g)", alert.Status, alert.Host, alert.Reason, alert.Value, alert.Threshold)
+		}
+		if err := d.post(alert); err != nil {
+			log.Errorf("could not post alert to %s: %v", d.webhookURL, err)
+		}
+	}
+}
+
+// threshold returns the threshold of the named check.
+func (d *anomalyDetector) threshold(reason string) float64 {
+	if reason == "p99" {
+		return d.p99
+	}
+	return d.errorRate
+}
+
+func (d *anomalyDetector) post(alert anomalyAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
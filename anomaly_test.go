@@ -0,0 +1,89 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+func request(host, path, status, cache string) *parser.Labelset {
+	return &parser.Labelset{
+		Names:  []string{"host", "path", "status", "cache"},
+		Values: []string{host, path, status, cache},
+	}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	var alerts []anomalyAlert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert anomalyAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		alerts = append(alerts, alert)
+	}))
+	defer server.Close()
+
+	// Not made with newAnomalyDetector, so that evaluate runs only when
+	// the test calls it
+	d := &anomalyDetector{
+		webhookURL: server.URL,
+		errorRate:  0.5,
+		client:     server.Client(),
+		hosts:      make(map[string]*hostWindow),
+	}
+	record := func(host, status string, n int) {
+		for i := 0; i < n; i++ {
+			d.Record([]parser.Metric{{Name: "time", Value: 0.1}}, request(host, "/", status, "miss"))
+		}
+	}
+	steps := []struct {
+		record func()
+		want   []string
+	}{
+		{func() { record("x", "503", 10); record("y", "200", 10) }, []string{"firing x error_rate"}},
+		// The EWMA takes a few good intervals to go back under the threshold
+		{func() { record("x", "200", 10); record("y", "200", 10) }, nil},
+		{func() { record("x", "200", 10); record("y", "200", 10) }, []string{"resolved x error_rate"}},
+		{func() { record("x", "503", 10) }, []string{"firing x error_rate"}},
+		// A host that goes quiet has its alerts resolved
+		{func() {}, []string{"resolved x error_rate no requests in the interval"}},
+		{func() {}, nil},
+	}
+	for i, step := range steps {
+		alerts = nil
+		step.record()
+		d.evaluate()
+		var got []string
+		for _, alert := range alerts {
+			s := alert.Status + " " + alert.Host + " " + alert.Reason
+			if alert.Note != "" {
+				s += " " + alert.Note
+			}
+			got = append(got, s)
+		}
+		if len(got) != len(step.want) || (len(got) > 0 && got[0] != step.want[0]) {
+			t.Errorf("interval %d: alerts %q, want %q", i, got, step.want)
+		}
+	}
+	if len(d.hosts) != 0 {
+		t.Errorf("%d idle hosts are still tracked", len(d.hosts))
+	}
+}
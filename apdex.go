@@ -0,0 +1,90 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// apdexGroup is a group of requests with an Apdex threshold from the
+// config file.
+type apdexGroup struct {
+	requestMatcher
+	name      string
+	threshold float64
+}
+
+// apdexSink counts requests by Apdex zone. The score is
+// (satisfied + tolerating/2) / total, which is easy to compute from the
+// counter rates.
+type apdexSink struct {
+	groups []*apdexGroup
+	zones  *prometheus.CounterVec
+}
+
+func newApdexSink(configs []apdexConfig) (*apdexSink, error) {
+	s := &apdexSink{
+		zones: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "apdex_requests_total",
+			Help:      "Number of requests by Apdex group and zone: satisfied, tolerating or frustrated.",
+		}, []string{"apdex", "host", "zone"}),
+	}
+	if err := prometheus.Register(s.zones); err != nil {
+		return nil, err
+	}
+	for _, c := range configs {
+		s.groups = append(s.groups, &apdexGroup{
+			requestMatcher: newRequestMatcher(c.Hosts, c.Path),
+			name:           c.Name,
+			threshold:      c.Threshold.Seconds(),
+		})
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *apdexSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	for _, m := range metrics {
+		if m.Name != "time" {
+			continue
+		}
+		host, path := labels.Value("host"), labels.Value("path")
+		status, _ := strconv.Atoi(labels.Value("status"))
+		for _, g := range s.groups {
+			if g.Matches(host, path) {
+				s.zones.WithLabelValues(g.name, host, apdexZone(m.Value, g.threshold, status)).Inc()
+			}
+		}
+	}
+}
+
+// apdexZone classifies a request that took seconds. Server errors are
+// frustrating however fast they were.
+func apdexZone(seconds, threshold float64, status int) string {
+	switch {
+	case status >= 500:
+		return "frustrated"
+	case seconds <= threshold:
+		return "satisfied"
+	case seconds <= 4*threshold:
+		return "tolerating"
+	}
+	return "frustrated"
+}
@@ -0,0 +1,618 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: exporter.proto
+
+package api
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type GetTopPathsRequest struct {
+	// Maximum number of paths to return, defaults to 10.
+	Limit int32 `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	// Only return paths for this host, if set.
+	Host                 string   `protobuf:"bytes,2,opt,name=host,proto3" json:"host,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetTopPathsRequest) Reset()         { *m = GetTopPathsRequest{} }
+func (m *GetTopPathsRequest) String() string { return proto.CompactTextString(m) }
+func (*GetTopPathsRequest) ProtoMessage()    {}
+func (*GetTopPathsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{0}
+}
+
+func (m *GetTopPathsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetTopPathsRequest.Unmarshal(m, b)
+}
+func (m *GetTopPathsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetTopPathsRequest.Marshal(b, m, deterministic)
+}
+func (m *GetTopPathsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetTopPathsRequest.Merge(m, src)
+}
+func (m *GetTopPathsRequest) XXX_Size() int {
+	return xxx_messageInfo_GetTopPathsRequest.Size(m)
+}
+func (m *GetTopPathsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetTopPathsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetTopPathsRequest proto.InternalMessageInfo
+
+func (m *GetTopPathsRequest) GetLimit() int32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *GetTopPathsRequest) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+type PathStats struct {
+	Host     string `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Path     string `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+	Requests uint64 `protobuf:"varint,3,opt,name=requests,proto3" json:"requests,omitempty"`
+	// Requests with a 5xx status.
+	Errors               uint64   `protobuf:"varint,4,opt,name=errors,proto3" json:"errors,omitempty"`
+	AvgTimeSeconds       float64  `protobuf:"fixed64,5,opt,name=avg_time_seconds,json=avgTimeSeconds,proto3" json:"avg_time_seconds,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PathStats) Reset()         { *m = PathStats{} }
+func (m *PathStats) String() string { return proto.CompactTextString(m) }
+func (*PathStats) ProtoMessage()    {}
+func (*PathStats) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{1}
+}
+
+func (m *PathStats) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PathStats.Unmarshal(m, b)
+}
+func (m *PathStats) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PathStats.Marshal(b, m, deterministic)
+}
+func (m *PathStats) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PathStats.Merge(m, src)
+}
+func (m *PathStats) XXX_Size() int {
+	return xxx_messageInfo_PathStats.Size(m)
+}
+func (m *PathStats) XXX_DiscardUnknown() {
+	xxx_messageInfo_PathStats.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PathStats proto.InternalMessageInfo
+
+func (m *PathStats) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *PathStats) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *PathStats) GetRequests() uint64 {
+	if m != nil {
+		return m.Requests
+	}
+	return 0
+}
+
+func (m *PathStats) GetErrors() uint64 {
+	if m != nil {
+		return m.Errors
+	}
+	return 0
+}
+
+func (m *PathStats) GetAvgTimeSeconds() float64 {
+	if m != nil {
+		return m.AvgTimeSeconds
+	}
+	return 0
+}
+
+type GetTopPathsResponse struct {
+	Paths                []*PathStats `protobuf:"bytes,1,rep,name=paths,proto3" json:"paths,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *GetTopPathsResponse) Reset()         { *m = GetTopPathsResponse{} }
+func (m *GetTopPathsResponse) String() string { return proto.CompactTextString(m) }
+func (*GetTopPathsResponse) ProtoMessage()    {}
+func (*GetTopPathsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{2}
+}
+
+func (m *GetTopPathsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetTopPathsResponse.Unmarshal(m, b)
+}
+func (m *GetTopPathsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetTopPathsResponse.Marshal(b, m, deterministic)
+}
+func (m *GetTopPathsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetTopPathsResponse.Merge(m, src)
+}
+func (m *GetTopPathsResponse) XXX_Size() int {
+	return xxx_messageInfo_GetTopPathsResponse.Size(m)
+}
+func (m *GetTopPathsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetTopPathsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetTopPathsResponse proto.InternalMessageInfo
+
+func (m *GetTopPathsResponse) GetPaths() []*PathStats {
+	if m != nil {
+		return m.Paths
+	}
+	return nil
+}
+
+type GetRatesRequest struct {
+	// Window to compute rates over, defaults to 60 and is capped at 900 seconds.
+	WindowSeconds        int32    `protobuf:"varint,1,opt,name=window_seconds,json=windowSeconds,proto3" json:"window_seconds,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetRatesRequest) Reset()         { *m = GetRatesRequest{} }
+func (m *GetRatesRequest) String() string { return proto.CompactTextString(m) }
+func (*GetRatesRequest) ProtoMessage()    {}
+func (*GetRatesRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{3}
+}
+
+func (m *GetRatesRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetRatesRequest.Unmarshal(m, b)
+}
+func (m *GetRatesRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetRatesRequest.Marshal(b, m, deterministic)
+}
+func (m *GetRatesRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetRatesRequest.Merge(m, src)
+}
+func (m *GetRatesRequest) XXX_Size() int {
+	return xxx_messageInfo_GetRatesRequest.Size(m)
+}
+func (m *GetRatesRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetRatesRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetRatesRequest proto.InternalMessageInfo
+
+func (m *GetRatesRequest) GetWindowSeconds() int32 {
+	if m != nil {
+		return m.WindowSeconds
+	}
+	return 0
+}
+
+type GetRatesResponse struct {
+	WindowSeconds     int32   `protobuf:"varint,1,opt,name=window_seconds,json=windowSeconds,proto3" json:"window_seconds,omitempty"`
+	RequestsPerSecond float64 `protobuf:"fixed64,2,opt,name=requests_per_second,json=requestsPerSecond,proto3" json:"requests_per_second,omitempty"`
+	ErrorsPerSecond   float64 `protobuf:"fixed64,3,opt,name=errors_per_second,json=errorsPerSecond,proto3" json:"errors_per_second,omitempty"`
+	// Fraction of requests in the window that were cache hits.
+	HitRatio float64 `protobuf:"fixed64,4,opt,name=hit_ratio,json=hitRatio,proto3" json:"hit_ratio,omitempty"`
+	// Requests seen since the exporter started.
+	TotalRequests        uint64   `protobuf:"varint,5,opt,name=total_requests,json=totalRequests,proto3" json:"total_requests,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetRatesResponse) Reset()         { *m = GetRatesResponse{} }
+func (m *GetRatesResponse) String() string { return proto.CompactTextString(m) }
+func (*GetRatesResponse) ProtoMessage()    {}
+func (*GetRatesResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{4}
+}
+
+func (m *GetRatesResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetRatesResponse.Unmarshal(m, b)
+}
+func (m *GetRatesResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetRatesResponse.Marshal(b, m, deterministic)
+}
+func (m *GetRatesResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetRatesResponse.Merge(m, src)
+}
+func (m *GetRatesResponse) XXX_Size() int {
+	return xxx_messageInfo_GetRatesResponse.Size(m)
+}
+func (m *GetRatesResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetRatesResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetRatesResponse proto.InternalMessageInfo
+
+func (m *GetRatesResponse) GetWindowSeconds() int32 {
+	if m != nil {
+		return m.WindowSeconds
+	}
+	return 0
+}
+
+func (m *GetRatesResponse) GetRequestsPerSecond() float64 {
+	if m != nil {
+		return m.RequestsPerSecond
+	}
+	return 0
+}
+
+func (m *GetRatesResponse) GetErrorsPerSecond() float64 {
+	if m != nil {
+		return m.ErrorsPerSecond
+	}
+	return 0
+}
+
+func (m *GetRatesResponse) GetHitRatio() float64 {
+	if m != nil {
+		return m.HitRatio
+	}
+	return 0
+}
+
+func (m *GetRatesResponse) GetTotalRequests() uint64 {
+	if m != nil {
+		return m.TotalRequests
+	}
+	return 0
+}
+
+type GetConfigRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetConfigRequest) Reset()         { *m = GetConfigRequest{} }
+func (m *GetConfigRequest) String() string { return proto.CompactTextString(m) }
+func (*GetConfigRequest) ProtoMessage()    {}
+func (*GetConfigRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{5}
+}
+
+func (m *GetConfigRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetConfigRequest.Unmarshal(m, b)
+}
+func (m *GetConfigRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetConfigRequest.Marshal(b, m, deterministic)
+}
+func (m *GetConfigRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetConfigRequest.Merge(m, src)
+}
+func (m *GetConfigRequest) XXX_Size() int {
+	return xxx_messageInfo_GetConfigRequest.Size(m)
+}
+func (m *GetConfigRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetConfigRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetConfigRequest proto.InternalMessageInfo
+
+type GetConfigResponse struct {
+	VarnishncsaArgs      []string `protobuf:"bytes,1,rep,name=varnishncsa_args,json=varnishncsaArgs,proto3" json:"varnishncsa_args,omitempty"`
+	VslQuery             string   `protobuf:"bytes,2,opt,name=vsl_query,json=vslQuery,proto3" json:"vsl_query,omitempty"`
+	Instance             string   `protobuf:"bytes,3,opt,name=instance,proto3" json:"instance,omitempty"`
+	PathMappingsFile     string   `protobuf:"bytes,4,opt,name=path_mappings_file,json=pathMappingsFile,proto3" json:"path_mappings_file,omitempty"`
+	PathMappings         int32    `protobuf:"varint,5,opt,name=path_mappings,json=pathMappings,proto3" json:"path_mappings,omitempty"`
+	InputFile            string   `protobuf:"bytes,6,opt,name=input_file,json=inputFile,proto3" json:"input_file,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetConfigResponse) Reset()         { *m = GetConfigResponse{} }
+func (m *GetConfigResponse) String() string { return proto.CompactTextString(m) }
+func (*GetConfigResponse) ProtoMessage()    {}
+func (*GetConfigResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a8826adc5babc285, []int{6}
+}
+
+func (m *GetConfigResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetConfigResponse.Unmarshal(m, b)
+}
+func (m *GetConfigResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetConfigResponse.Marshal(b, m, deterministic)
+}
+func (m *GetConfigResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetConfigResponse.Merge(m, src)
+}
+func (m *GetConfigResponse) XXX_Size() int {
+	return xxx_messageInfo_GetConfigResponse.Size(m)
+}
+func (m *GetConfigResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetConfigResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetConfigResponse proto.InternalMessageInfo
+
+func (m *GetConfigResponse) GetVarnishncsaArgs() []string {
+	if m != nil {
+		return m.VarnishncsaArgs
+	}
+	return nil
+}
+
+func (m *GetConfigResponse) GetVslQuery() string {
+	if m != nil {
+		return m.VslQuery
+	}
+	return ""
+}
+
+func (m *GetConfigResponse) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *GetConfigResponse) GetPathMappingsFile() string {
+	if m != nil {
+		return m.PathMappingsFile
+	}
+	return ""
+}
+
+func (m *GetConfigResponse) GetPathMappings() int32 {
+	if m != nil {
+		return m.PathMappings
+	}
+	return 0
+}
+
+func (m *GetConfigResponse) GetInputFile() string {
+	if m != nil {
+		return m.InputFile
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*GetTopPathsRequest)(nil), "varnish_request_exporter.GetTopPathsRequest")
+	proto.RegisterType((*PathStats)(nil), "varnish_request_exporter.PathStats")
+	proto.RegisterType((*GetTopPathsResponse)(nil), "varnish_request_exporter.GetTopPathsResponse")
+	proto.RegisterType((*GetRatesRequest)(nil), "varnish_request_exporter.GetRatesRequest")
+	proto.RegisterType((*GetRatesResponse)(nil), "varnish_request_exporter.GetRatesResponse")
+	proto.RegisterType((*GetConfigRequest)(nil), "varnish_request_exporter.GetConfigRequest")
+	proto.RegisterType((*GetConfigResponse)(nil), "varnish_request_exporter.GetConfigResponse")
+}
+
+func init() { proto.RegisterFile("exporter.proto", fileDescriptor_a8826adc5babc285) }
+
+var fileDescriptor_a8826adc5babc285 = []byte{
+	// 569 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0xdf, 0x6e, 0xd3, 0x3e,
+	0x14, 0x96, 0xb7, 0x65, 0x6a, 0xce, 0x7e, 0xdb, 0x3a, 0xef, 0x27, 0x14, 0x15, 0x21, 0x55, 0x99,
+	0x90, 0xb2, 0x31, 0x52, 0x34, 0x6e, 0x40, 0x48, 0x48, 0x80, 0x60, 0x57, 0x48, 0xc5, 0xdb, 0x15,
+	0x37, 0x91, 0xdb, 0x7a, 0x89, 0x51, 0x1a, 0x67, 0xb6, 0xdb, 0xc1, 0x63, 0xf0, 0x44, 0x3c, 0x07,
+	0x8f, 0xc0, 0x5b, 0x20, 0xff, 0x49, 0x9a, 0x0a, 0x6d, 0xea, 0x9d, 0xcf, 0x39, 0xdf, 0x67, 0x9f,
+	0xf3, 0x9d, 0x2f, 0x81, 0x03, 0xf6, 0xbd, 0x16, 0x52, 0x33, 0x99, 0xd6, 0x52, 0x68, 0x81, 0xa3,
+	0x25, 0x95, 0x15, 0x57, 0x45, 0x26, 0xd9, 0xed, 0x82, 0x29, 0x9d, 0x35, 0xf5, 0xf8, 0x2d, 0xe0,
+	0x4b, 0xa6, 0xaf, 0x45, 0x3d, 0xa6, 0xba, 0x50, 0xc4, 0x95, 0xf1, 0xff, 0x10, 0x94, 0x7c, 0xce,
+	0x75, 0x84, 0x86, 0x28, 0x09, 0x88, 0x0b, 0x30, 0x86, 0x9d, 0x42, 0x28, 0x1d, 0x6d, 0x0d, 0x51,
+	0x12, 0x12, 0x7b, 0x8e, 0x7f, 0x22, 0x08, 0x0d, 0xf5, 0x4a, 0x53, 0xad, 0x5a, 0x04, 0x5a, 0x21,
+	0x4c, 0xae, 0xa6, 0xba, 0x68, 0x58, 0xe6, 0x8c, 0x07, 0xd0, 0xf3, 0x9d, 0xa8, 0x68, 0x7b, 0x88,
+	0x92, 0x1d, 0xd2, 0xc6, 0xf8, 0x11, 0xec, 0x32, 0x29, 0x85, 0x54, 0xd1, 0x8e, 0xad, 0xf8, 0x08,
+	0x27, 0xd0, 0xa7, 0xcb, 0x3c, 0xd3, 0x7c, 0xce, 0x32, 0xc5, 0xa6, 0xa2, 0x9a, 0xa9, 0x28, 0x18,
+	0xa2, 0x04, 0x91, 0x03, 0xba, 0xcc, 0xaf, 0xf9, 0x9c, 0x5d, 0xb9, 0x6c, 0x3c, 0x86, 0xe3, 0xb5,
+	0x99, 0x54, 0x2d, 0x2a, 0xc5, 0xf0, 0x6b, 0x08, 0xcc, 0xe3, 0x2a, 0x42, 0xc3, 0xed, 0x64, 0xef,
+	0xe2, 0x24, 0xbd, 0x4f, 0x94, 0xb4, 0x1d, 0x88, 0x38, 0x46, 0xfc, 0x0a, 0x0e, 0x2f, 0x99, 0x26,
+	0x54, 0xb3, 0x56, 0xa2, 0xa7, 0x70, 0x70, 0xc7, 0xab, 0x99, 0xb8, 0x6b, 0x9b, 0x71, 0x5a, 0xed,
+	0xbb, 0x6c, 0xd3, 0xcb, 0x6f, 0x04, 0xfd, 0x15, 0xd5, 0x77, 0xb2, 0x19, 0x17, 0xa7, 0x70, 0xdc,
+	0xa8, 0x92, 0xd5, 0x4c, 0x7a, 0xb0, 0x15, 0x12, 0x91, 0xa3, 0xa6, 0x34, 0x66, 0xd2, 0x11, 0xf0,
+	0x19, 0x1c, 0x39, 0xad, 0xba, 0xe8, 0x6d, 0x8b, 0x3e, 0x74, 0x85, 0x15, 0xf6, 0x31, 0x84, 0x05,
+	0xd7, 0x99, 0xa4, 0x9a, 0x0b, 0x2b, 0x34, 0x22, 0xbd, 0x82, 0x9b, 0x3e, 0xb9, 0x30, 0xfd, 0x69,
+	0xa1, 0x69, 0x99, 0xb5, 0x4b, 0x0a, 0xec, 0x2a, 0xf6, 0x6d, 0xd6, 0x2b, 0xa0, 0x62, 0x6c, 0x47,
+	0xfb, 0x20, 0xaa, 0x1b, 0x9e, 0xfb, 0x64, 0xfc, 0x07, 0xc1, 0x51, 0x27, 0xe9, 0x07, 0x3e, 0x85,
+	0xbe, 0x17, 0xbb, 0x9a, 0x2a, 0x9a, 0x51, 0x99, 0xbb, 0x2d, 0x84, 0xe4, 0xb0, 0x93, 0x7f, 0x27,
+	0x73, 0x65, 0x1a, 0x5b, 0xaa, 0x32, 0xbb, 0x5d, 0x30, 0xf9, 0xc3, 0x7b, 0xa6, 0xb7, 0x54, 0xe5,
+	0x17, 0x13, 0x1b, 0xdf, 0xf0, 0x4a, 0x69, 0x5a, 0x4d, 0x99, 0x1d, 0x2c, 0x24, 0x6d, 0x8c, 0xcf,
+	0x01, 0x9b, 0x65, 0x65, 0x73, 0x5a, 0xd7, 0xbc, 0xca, 0x55, 0x76, 0xc3, 0x4b, 0x66, 0x47, 0x0b,
+	0x49, 0xdf, 0x54, 0x3e, 0xfb, 0xc2, 0x27, 0x5e, 0x32, 0x7c, 0x02, 0xfb, 0x6b, 0x68, 0x3b, 0x61,
+	0x40, 0xfe, 0xeb, 0x02, 0xf1, 0x13, 0x00, 0x5e, 0xd5, 0x0b, 0xed, 0xae, 0xda, 0xb5, 0x57, 0x85,
+	0x36, 0x63, 0xee, 0xb8, 0xf8, 0xb5, 0x05, 0xbd, 0x8f, 0xde, 0x33, 0xf8, 0x1b, 0xec, 0x75, 0x4c,
+	0x87, 0xcf, 0xef, 0x77, 0xd7, 0xbf, 0xdf, 0xdb, 0xe0, 0xf9, 0x86, 0x68, 0x2f, 0x27, 0x85, 0x5e,
+	0xe3, 0x29, 0x7c, 0xfa, 0x20, 0xb5, 0x6b, 0xd9, 0xc1, 0xd9, 0x26, 0x50, 0xff, 0xc4, 0x0c, 0xc2,
+	0x76, 0x8d, 0xf8, 0x61, 0xe2, 0x9a, 0x01, 0x06, 0xcf, 0x36, 0xc2, 0xba, 0x57, 0xde, 0xbf, 0xf8,
+	0x9a, 0xe6, 0x5c, 0x17, 0x8b, 0x49, 0x3a, 0x15, 0xf3, 0x91, 0xd2, 0x3c, 0x57, 0x93, 0x51, 0xd7,
+	0x29, 0x0d, 0x77, 0x44, 0x6b, 0xfe, 0x86, 0xd6, 0x7c, 0xb2, 0x6b, 0x7f, 0x68, 0x2f, 0xff, 0x0e,
+	0x00, 0xed, 0x9f, 0xeb, 0x79, 0xe2, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// ExporterClient is the client API for Exporter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ExporterClient interface {
+	// GetTopPaths returns the normalized paths with the most requests.
+	GetTopPaths(ctx context.Context, in *GetTopPathsRequest, opts ...grpc.CallOption) (*GetTopPathsResponse, error)
+	// GetRates returns request rates over a recent time window.
+	GetRates(ctx context.Context, in *GetRatesRequest, opts ...grpc.CallOption) (*GetRatesResponse, error)
+	// GetConfig returns the exporter's effective configuration.
+	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error)
+}
+
+type exporterClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewExporterClient(cc *grpc.ClientConn) ExporterClient {
+	return &exporterClient{cc}
+}
+
+func (c *exporterClient) GetTopPaths(ctx context.Context, in *GetTopPathsRequest, opts ...grpc.CallOption) (*GetTopPathsResponse, error) {
+	out := new(GetTopPathsResponse)
+	err := c.cc.Invoke(ctx, "/varnish_request_exporter.Exporter/GetTopPaths", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exporterClient) GetRates(ctx context.Context, in *GetRatesRequest, opts ...grpc.CallOption) (*GetRatesResponse, error) {
+	out := new(GetRatesResponse)
+	err := c.cc.Invoke(ctx, "/varnish_request_exporter.Exporter/GetRates", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *exporterClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error) {
+	out := new(GetConfigResponse)
+	err := c.cc.Invoke(ctx, "/varnish_request_exporter.Exporter/GetConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExporterServer is the server API for Exporter service.
+type ExporterServer interface {
+	// GetTopPaths returns the normalized paths with the most requests.
+	GetTopPaths(context.Context, *GetTopPathsRequest) (*GetTopPathsResponse, error)
+	// GetRates returns request rates over a recent time window.
+	GetRates(context.Context, *GetRatesRequest) (*GetRatesResponse, error)
+	// GetConfig returns the exporter's effective configuration.
+	GetConfig(context.Context, *GetConfigRequest) (*GetConfigResponse, error)
+}
+
+// UnimplementedExporterServer can be embedded to have forward compatible implementations.
+type UnimplementedExporterServer struct {
+}
+
+func (*UnimplementedExporterServer) GetTopPaths(ctx context.Context, req *GetTopPathsRequest) (*GetTopPathsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTopPaths not implemented")
+}
+func (*UnimplementedExporterServer) GetRates(ctx context.Context, req *GetRatesRequest) (*GetRatesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRates not implemented")
+}
+func (*UnimplementedExporterServer) GetConfig(ctx context.Context, req *GetConfigRequest) (*GetConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+
+func RegisterExporterServer(s *grpc.Server, srv ExporterServer) {
+	s.RegisterService(&_Exporter_serviceDesc, srv)
+}
+
+func _Exporter_GetTopPaths_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTopPathsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExporterServer).GetTopPaths(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/varnish_request_exporter.Exporter/GetTopPaths",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExporterServer).GetTopPaths(ctx, req.(*GetTopPathsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exporter_GetRates_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRatesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExporterServer).GetRates(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/varnish_request_exporter.Exporter/GetRates",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExporterServer).GetRates(ctx, req.(*GetRatesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Exporter_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExporterServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/varnish_request_exporter.Exporter/GetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExporterServer).GetConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Exporter_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "varnish_request_exporter.Exporter",
+	HandlerType: (*ExporterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetTopPaths",
+			Handler:    _Exporter_GetTopPaths_Handler,
+		},
+		{
+			MethodName: "GetRates",
+			Handler:    _Exporter_GetRates_Handler,
+		},
+		{
+			MethodName: "GetConfig",
+			Handler:    _Exporter_GetConfig_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "exporter.proto",
+}
@@ -0,0 +1,145 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+const (
+	// burstWindow is the window request rates are compared over.
+	burstWindow = 10 * time.Second
+	// burstMinRequests is the number of requests a path needs in a window
+	// to count as bursting, so that a few requests to a quiet path don't.
+	burstMinRequests = 10
+	// burstMaxPaths is the number of paths to keep averages for. Paths
+	// beyond it are not tracked until quiet ones are forgotten.
+	burstMaxPaths = 10000
+	// burstForgetRate is the average rate, in requests per second, below
+	// which a path without requests is forgotten.
+	burstForgetRate = 0.001
+)
+
+var burstFactorDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "burst_factor"),
+	"Request rate of a path over the last 10 seconds as a multiple of its trailing average, for paths that are bursting.",
+	[]string{"host", "path"}, nil,
+)
+
+type burstKey struct {
+	host, path string
+}
+
+type burstPath struct {
+	count   int
+	average float64
+}
+
+// burstDetector finds paths whose request rate suddenly jumps to many
+// times their trailing average, as in cache stampedes and hot keys. Only
+// bursting paths are exported, which keeps the cardinality low.
+type burstDetector struct {
+	factor float64
+	alpha  float64
+
+	mu     sync.Mutex
+	paths  map[burstKey]*burstPath
+	bursts map[burstKey]float64
+}
+
+// newBurstDetector creates a burstDetector that exports paths whose rate
+// is at least factor times their average over about trailing.
+func newBurstDetector(factor float64, trailing time.Duration) (*burstDetector, error) {
+	d := &burstDetector{
+		factor: factor,
+		// The smoothing factor that gives an EWMA with a time constant of
+		// trailing, when updated once a window
+		alpha:  burstWindow.Seconds() / trailing.Seconds(),
+		paths:  make(map[burstKey]*burstPath),
+		bursts: make(map[burstKey]float64),
+	}
+	if d.alpha > 1 {
+		d.alpha = 1
+	}
+	if err := prometheus.Register(d); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(burstWindow) {
+			d.evaluate()
+		}
+	}()
+	return d, nil
+}
+
+// Record implements sink.
+func (d *burstDetector) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	key := burstKey{labels.Value("host"), labels.Value("path")}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.paths[key]
+	if !ok {
+		if len(d.paths) >= burstMaxPaths {
+			return
+		}
+		p = &burstPath{average: -1}
+		d.paths[key] = p
+	}
+	p.count++
+}
+
+// evaluate compares the rate of each path over the last window with its
+// average over the earlier ones, then folds the window into the average.
+func (d *burstDetector) evaluate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bursts = make(map[burstKey]float64)
+	for key, p := range d.paths {
+		rate := float64(p.count) / burstWindow.Seconds()
+		if p.average < 0 {
+			// A new path has no history to burst from
+			p.average = rate
+		} else {
+			if p.count >= burstMinRequests && p.average > 0 && rate >= d.factor*p.average {
+				d.bursts[key] = rate / p.average
+			}
+			p.average = d.alpha*rate + (1-d.alpha)*p.average
+		}
+		if p.count == 0 && p.average < burstForgetRate {
+			delete(d.paths, key)
+			continue
+		}
+		p.count = 0
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (d *burstDetector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- burstFactorDesc
+}
+
+// Collect implements prometheus.Collector.
+func (d *burstDetector) Collect(ch chan<- prometheus.Metric) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, factor := range d.bursts {
+		ch <- prometheus.MustNewConstMetric(burstFactorDesc, prometheus.GaugeValue, factor, key.host, key.path)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Nagios plugin exit codes.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+var nagiosStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// runCheck implements the "check" command, a Nagios/Icinga plugin that
+// scrapes a running exporter twice and checks the error rate and the 99th
+// percentile request time in between, and how long ago the last log line
+// was read.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	url := fs.String("url", defaultCheckURL(), "URL of the exporter's metrics")
+	interval := fs.Duration("interval", 10*time.Second, "Time between the two scrapes that rates are computed from")
+	warnErrors := fs.Float64("warning-error-rate", 0.05, "Fraction of 5xx responses to warn at (0 to disable)")
+	critErrors := fs.Float64("critical-error-rate", 0.1, "Fraction of 5xx responses to be critical at (0 to disable)")
+	warnP99 := fs.Duration("warning-p99", time.Second, "99th percentile request time to warn at (0 to disable)")
+	critP99 := fs.Duration("critical-p99", 2*time.Second, "99th percentile request time to be critical at (0 to disable)")
+	warnLag := fs.Duration("warning-lag", time.Minute, "Time since the last log line to warn at (0 to disable)")
+	critLag := fs.Duration("critical-lag", 5*time.Minute, "Time since the last log line to be critical at (0 to disable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] check [check flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	before, err := scrapeFamilies(client, *url)
+	if err != nil {
+		return nagiosResult(nagiosUnknown, err.Error(), nil)
+	}
+	time.Sleep(*interval)
+	after, err := scrapeFamilies(client, *url)
+	if err != nil {
+		return nagiosResult(nagiosUnknown, err.Error(), nil)
+	}
+
+	state := nagiosOK
+	var messages, perfdata []string
+	check := func(name string, value, warn, crit float64, format string) {
+		s := nagiosOK
+		switch {
+		case crit > 0 && value >= crit:
+			s = nagiosCritical
+		case warn > 0 && value >= warn:
+			s = nagiosWarning
+		}
+		if s > state {
+			state = s
+		}
+		messages = append(messages, fmt.Sprintf("%s "+format, name, value))
+		perfdata = append(perfdata, fmt.Sprintf("%s=%g;%s;%s", name, value, nagiosThreshold(warn), nagiosThreshold(crit)))
+	}
+
+	h0, h1 := requestHistogram(before), requestHistogram(after)
+	if h0 == nil || h1 == nil {
+		return nagiosResult(nagiosUnknown, "no request time histogram in "+*url, nil)
+	}
+	requests := h1.count - h0.count
+	if requests == 0 {
+		messages = append(messages, "no requests")
+	} else {
+		check("error_rate", float64(h1.errors-h0.errors)/float64(requests), *warnErrors, *critErrors, "%.4f")
+		check("p99", h1.quantile(h0, 0.99), warnP99.Seconds(), critP99.Seconds(), "%.3fs")
+	}
+	if last := lastMessageTime(after); !last.IsZero() {
+		check("lag", time.Since(last).Seconds(), warnLag.Seconds(), critLag.Seconds(), "%.0fs")
+	}
+	return nagiosResult(state, strings.Join(messages, ", "), perfdata)
+}
+
+// defaultCheckURL is the metrics URL of an exporter running with the same
+// -http.port and -http.metricsurl flags.
+func defaultCheckURL() string {
+	host := *listenAddress
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	return "http://" + host + *metricsPath
+}
+
+func nagiosThreshold(v float64) string {
+	if v <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// nagiosResult prints the plugin output line and returns the exit code.
+func nagiosResult(state int, message string, perfdata []string) int {
+	line := fmt.Sprintf("VARNISH_REQUEST %s - %s", nagiosStates[state], message)
+	if len(perfdata) > 0 {
+		line += " | " + strings.Join(perfdata, " ")
+	}
+	fmt.Println(line)
+	return state
+}
+
+func scrapeFamilies(client *http.Client, url string) (map[string]*dto.MetricFamily, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// checkHistogram is the request time histogram summed over all series.
+type checkHistogram struct {
+	count, errors uint64
+	buckets       map[float64]uint64
+}
+
+// requestHistogram sums the request time histogram, under its old or new
+// name, over all series.
+func requestHistogram(mfs map[string]*dto.MetricFamily) *checkHistogram {
+	mf, ok := mfs[namespace+"_time"]
+	if !ok {
+		if mf, ok = mfs[namespace+"_"+newMetricNames["time"]]; !ok {
+			return nil
+		}
+	}
+	h := &checkHistogram{buckets: make(map[float64]uint64)}
+	for _, m := range mf.Metric {
+		if m.Histogram == nil {
+			continue
+		}
+		count := m.Histogram.GetSampleCount()
+		h.count += count
+		for _, l := range m.Label {
+			if status, _ := strconv.Atoi(l.GetValue()); l.GetName() == "status" && status >= 500 {
+				h.errors += count
+			}
+		}
+		for _, b := range m.Histogram.Bucket {
+			h.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+		}
+	}
+	return h
+}
+
+// quantile estimates the q-quantile of the requests observed since
+// before, as the upper bound of the bucket it falls in. It returns +Inf if
+// that is beyond the last bucket.
+func (h *checkHistogram) quantile(before *checkHistogram, q float64) float64 {
+	bounds := make([]float64, 0, len(h.buckets))
+	for bound := range h.buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	rank := q * float64(h.count-before.count)
+	for _, bound := range bounds {
+		if float64(h.buckets[bound]-before.buckets[bound]) >= rank {
+			return bound
+		}
+	}
+	return math.Inf(1)
+}
+
+// lastMessageTime returns when the exporter last read a log line, or when
+// it started if it has read none.
+func lastMessageTime(mfs map[string]*dto.MetricFamily) time.Time {
+	var last float64
+	for _, name := range []string{namespace + "_exporter_last_log_message_timestamp_seconds", "process_start_time_seconds"} {
+		if mf, ok := mfs[name]; ok && len(mf.Metric) > 0 && mf.Metric[0].Gauge != nil {
+			if v := mf.Metric[0].Gauge.GetValue(); v > last {
+				last = v
+			}
+		}
+	}
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(last*1e9))
+}
@@ -0,0 +1,171 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// varnishChild runs varnishncsa and, if restartDelay is set, starts it
+// again whenever it exits. The output of all runs goes to the same
+// reader, so the log processor and the metrics it registered carry on
+// across restarts instead of being reset.
+type varnishChild struct {
+	name         string
+	args         []string
+	cred         *syscall.Credential
+	restartDelay time.Duration
+	stdout       *io.PipeWriter
+	// OnRestart, if set, is called before each restart.
+	OnRestart func()
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	restart bool
+
+	generation prometheus.Gauge
+	startTime  prometheus.Gauge
+}
+
+// newVarnishChild returns the child and the reader its output can be read
+// from. Nothing is started until Run is called.
+func newVarnishChild(name string, args []string, cred *syscall.Credential, restartDelay time.Duration) (*varnishChild, io.Reader, error) {
+	r, w := io.Pipe()
+	c := &varnishChild{
+		name:         name,
+		args:         args,
+		cred:         cred,
+		restartDelay: restartDelay,
+		stdout:       w,
+		generation: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_child_generation",
+			Help:      "Number of times varnishncsa has been started, to correlate discontinuities in the metrics with restarts.",
+		}),
+		startTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_child_start_time_seconds",
+			Help:      "Time varnishncsa was last started, in seconds since the epoch.",
+		}),
+	}
+	for _, m := range []prometheus.Collector{c.generation, c.startTime} {
+		if err := prometheus.Register(m); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, r, nil
+}
+
+// Run runs varnishncsa until it exits without being restarted, then
+// closes the output reader.
+func (c *varnishChild) Run() error {
+	for {
+		c.generation.Inc()
+		c.startTime.SetToCurrentTime()
+		err := c.runOnce()
+		if c.restarted() {
+			log.Infof("restarted %s with new arguments", c.name)
+			if c.OnRestart != nil {
+				c.OnRestart()
+			}
+			continue
+		}
+		if c.restartDelay == 0 {
+			_ = c.stdout.Close()
+			return err
+		}
+		if err != nil {
+			log.Errorf("%s exited: %v, restarting it in %v", c.name, err, c.restartDelay)
+		} else {
+			log.Warnf("%s exited, restarting it in %v", c.name, c.restartDelay)
+		}
+		time.Sleep(c.restartDelay)
+		if c.OnRestart != nil {
+			c.OnRestart()
+		}
+	}
+}
+
+// SetArgs restarts varnishncsa with new arguments, letting it exit
+// cleanly so that no line is cut short.
+func (c *varnishChild) SetArgs(args []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.args = args
+	if c.cmd == nil {
+		return nil
+	}
+	c.restart = true
+	return c.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// PID returns the process ID of the running varnishncsa, or 0 between
+// runs.
+func (c *varnishChild) PID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cmd == nil {
+		return 0
+	}
+	return c.cmd.Process.Pid
+}
+
+// restarted tells whether the last run ended because of SetArgs.
+func (c *varnishChild) restarted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	restart := c.restart
+	c.restart = false
+	return restart
+}
+
+func (c *varnishChild) runOnce() error {
+	c.mu.Lock()
+	cmd := exec.Command(c.name, c.args...)
+	if c.cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: c.cred}
+	}
+	cmd.Stdout = c.stdout
+	stderr, err := cmd.StderrPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		c.cmd = cmd
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		forwardStderr(stderr, c.name)
+		close(done)
+	}()
+	// Wait closes stderr, so read all of it first
+	<-done
+	err = cmd.Wait()
+	c.mu.Lock()
+	c.cmd = nil
+	c.mu.Unlock()
+	return err
+}
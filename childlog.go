@@ -0,0 +1,50 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var childStderrLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "exporter_child_stderr_lines_total",
+	Help:      "Number of lines child processes wrote to stderr.",
+}, []string{"source"})
+
+func init() {
+	prometheus.MustRegister(childStderrLines)
+}
+
+// forwardStderr logs each line read from r, the stderr of a child process,
+// as a warning tagged with source, so that messages like VSL overruns from
+// varnishncsa end up in the exporter's log stream. It returns when r is
+// closed.
+func forwardStderr(r io.Reader, source string) {
+	logger := log.With("source", source)
+	lines := childStderrLines.WithLabelValues(source)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines.Inc()
+		logger.Warn(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Errorf("reading stderr: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+const clickhouseFlushInterval = 5 * time.Second
+
+// clickhouseSink batch-inserts one row per request into a ClickHouse table
+// through the ClickHouse HTTP interface. Rows are sent as JSONEachRow with
+// one key per label and metric, and unknown keys are skipped, so the table
+// only needs the columns the user cares about.
+type clickhouseSink struct {
+	insertURL string
+	batchSize int
+	client    *http.Client
+	rows      chan map[string]interface{}
+	sent      prometheus.Counter
+	dropped   prometheus.Counter
+	spool     *diskSpool
+}
+
+func newClickhouseSink(baseURL, table string, batchSize int) (*clickhouseSink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("-clickhouse.url: %v", err)
+	}
+	q := u.Query()
+	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table))
+	q.Set("input_format_skip_unknown_fields", "1")
+	u.RawQuery = q.Encode()
+
+	c := &clickhouseSink{
+		insertURL: u.String(),
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		rows:      make(chan map[string]interface{}, batchSize),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_clickhouse_rows_sent",
+			Help:      "Number of request rows inserted into ClickHouse.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_clickhouse_rows_dropped",
+			Help:      "Number of request rows dropped because ClickHouse was slow or failing.",
+		}),
+	}
+	if err := prometheus.Register(c.sent); err != nil {
+		return nil, err
+	}
+	if err := prometheus.Register(c.dropped); err != nil {
+		return nil, err
+	}
+	if c.spool, err = openSpool("clickhouse", c.insert, c.sent, c.dropped); err != nil {
+		return nil, err
+	}
+	watchQueue("clickhouse", func() (int, int) { return len(c.rows), cap(c.rows) })
+	go c.run()
+	return c, nil
+}
+
+func (c *clickhouseSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	e := labels.Event(metrics)
+	row := make(map[string]interface{}, len(e.Labels)+len(e.Values)+1)
+	row["timestamp"] = e.Time.Unix()
+	for name, value := range e.Labels {
+		row[name] = value
+	}
+	for name, value := range e.Values {
+		row[name] = value
+	}
+	select {
+	case c.rows <- row:
+	default:
+		c.dropped.Inc()
+	}
+}
+
+func (c *clickhouseSink) run() {
+	batch := make([]map[string]interface{}, 0, c.batchSize)
+	ticker := time.NewTicker(clickhouseFlushInterval)
+	for {
+		select {
+		case row := <-c.rows:
+			batch = append(batch, row)
+			if len(batch) < c.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		body, err := c.encode(batch)
+		if err == nil {
+			err = c.insert(body)
+		}
+		if err != nil {
+			log.Errorf("could not insert rows into ClickHouse: %v", err)
+			if !c.spool.Save(body, len(batch)) {
+				c.dropped.Add(float64(len(batch)))
+			}
+		} else {
+			c.sent.Add(float64(len(batch)))
+			c.spool.Resume()
+		}
+		batch = batch[:0]
+	}
+}
+
+// encode makes JSONEachRow insert data of a batch of rows.
+func (c *clickhouseSink) encode(batch []map[string]interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, row := range batch {
+		if err := enc.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+func (c *clickhouseSink) insert(body []byte) error {
+	resp, err := c.client.Post(c.insertURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newMetricNames maps the original metric names to ones that follow the
+// Prometheus naming conventions, with base units and _total suffixes.
+// Metrics not listed keep their name.
+var newMetricNames = map[string]string{
+	"time":                       "duration_seconds",
+	"time_firstbyte":             "firstbyte_seconds",
+	"respsize":                   "response_size_bytes",
+	"exporter_log_messages":      "exporter_log_messages_total",
+	"exporter_log_parse_failure": "exporter_log_parse_failures_total",
+	"exporter_log_dropped":       "exporter_log_dropped_total",
+}
+
+func init() {
+	for oldName, newName := range newMetricNames {
+		if help, ok := knownMetricHelp[oldName]; ok {
+			knownMetricHelp[newName] = help
+		}
+	}
+}
+
+// metricNamer decides which names a metric is exported under. During a
+// migration both the old and the new names can be exported, so dashboards
+// and alerts can be moved over one at a time.
+type metricNamer struct {
+	old, new bool
+}
+
+func newMetricNamer(schemes []string) (*metricNamer, error) {
+	n := &metricNamer{}
+	for _, scheme := range schemes {
+		switch scheme {
+		case "old":
+			n.old = true
+		case "new":
+			n.new = true
+		default:
+			return nil, fmt.Errorf("unknown metric naming scheme %q", scheme)
+		}
+	}
+	if !n.old && !n.new {
+		n.old = true
+	}
+	return n, nil
+}
+
+// Names returns the names to export the named metric under.
+func (n *metricNamer) Names(name string) []string {
+	newName, renamed := newMetricNames[name]
+	switch {
+	case !renamed || !n.new:
+		return []string{name}
+	case !n.old:
+		return []string{newName}
+	}
+	return []string{name, newName}
+}
+
+// counterSet is one counter exported under several names.
+type counterSet []prometheus.Counter
+
+// newCounterSet creates and registers a counter for each name namer gives
+// for opts.Name.
+func newCounterSet(namer *metricNamer, opts prometheus.CounterOpts) (counterSet, error) {
+	var set counterSet
+	for _, name := range namer.Names(opts.Name) {
+		opts.Name = name
+		c := prometheus.NewCounter(opts)
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+		set = append(set, c)
+	}
+	return set, nil
+}
+
+func (s counterSet) Inc() {
+	for _, c := range s {
+		c.Inc()
+	}
+}
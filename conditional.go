@@ -0,0 +1,78 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// The varnishncsa fields for conditional requests. Entity tags are quoted,
+// so the headers are logged in backquotes.
+const conditionalFormat = "_inm=`%{If-None-Match}i` _ims=`%{If-Modified-Since}i`"
+
+// conditionalSink counts conditional requests and how many of them could be
+// answered with 304 Not Modified, along with the response bytes sent for
+// the rest.
+type conditionalSink struct {
+	requests *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+}
+
+func newConditionalSink() (*conditionalSink, error) {
+	s := &conditionalSink{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "conditional_requests_total",
+			Help:      "Number of requests with If-None-Match or If-Modified-Since, by whether they got 304 Not Modified.",
+		}, []string{"host", "result"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "conditional_response_bytes_total",
+			Help:      "Response body bytes sent for conditional requests (requires -varnish.sizes).",
+		}, []string{"host", "result"}),
+	}
+	for _, c := range []prometheus.Collector{s.requests, s.bytes} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *conditionalSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	present := func(name string) bool {
+		v := labels.Extra[name]
+		return v != "" && v != "-"
+	}
+	if !present("_inm") && !present("_ims") {
+		return
+	}
+	result := "modified"
+	if status, _ := strconv.Atoi(labels.Value("status")); status == 304 {
+		result = "not_modified"
+	}
+	host := labels.Value("host")
+	s.requests.WithLabelValues(host, result).Inc()
+	for _, m := range metrics {
+		if m.Name == "respsize" {
+			s.bytes.WithLabelValues(host, result).Add(m.Value)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/collector"
+)
+
+// config holds the settings read from the -config.file YAML file, for
+// things that don't fit in command line flags.
+type config struct {
+	// Metrics describes the metrics taken from the log, by name.
+	Metrics map[string]metricConfig `yaml:"metrics"`
+	// Tenants assigns hosts to tenants, by tenant name.
+	Tenants map[string]tenantConfig `yaml:"tenants"`
+	// Redact lists regexps for path parts to always redact, in addition
+	// to the built-in ones.
+	Redact []string `yaml:"redact"`
+	// SLOs are latency objectives to count good and bad requests for.
+	SLOs []sloConfig `yaml:"slos"`
+	// Apdex sets the thresholds to count Apdex zones by.
+	Apdex []apdexConfig `yaml:"apdex"`
+	// Rollups are extra copies of the request metrics with fewer labels.
+	Rollups []rollupConfig `yaml:"rollups"`
+	// ContentClass overrides how -varnish.content-class tells static
+	// content from dynamic.
+	ContentClass contentClassConfig `yaml:"content_class"`
+	// Buckets gives the request metrics other buckets for some requests.
+	Buckets []bucketConfig `yaml:"buckets"`
+	// Labels are added to all served series, such as the datacenter the
+	// exporter runs in, so that series federated from several
+	// datacenters can be told apart.
+	Labels map[string]string `yaml:"labels"`
+	// Shard adds a label assigning each served series to a shard.
+	Shard shardConfig `yaml:"shard"`
+}
+
+type metricConfig struct {
+	Help string `yaml:"help"`
+}
+
+type tenantConfig struct {
+	// Hosts are host name patterns, in which * matches any part of a name.
+	Hosts []string `yaml:"hosts"`
+}
+
+type sloConfig struct {
+	Name string `yaml:"name"`
+	// Hosts are host name patterns, in which * matches any part of a name.
+	// No patterns means all hosts.
+	Hosts []string `yaml:"hosts"`
+	// Path is a regexp that the normalized path must match, if set.
+	Path string `yaml:"path"`
+	// Threshold is the response time within which a request is good.
+	Threshold time.Duration `yaml:"threshold"`
+	// Objective is the fraction of requests that should be good.
+	Objective float64 `yaml:"objective"`
+}
+
+type contentClassConfig struct {
+	// StaticExtensions are file name extensions, without the dot, of
+	// static content.
+	StaticExtensions []string `yaml:"static_extensions"`
+	// StaticTypes are media types of static content, in which a subtype
+	// of * matches all subtypes.
+	StaticTypes []string `yaml:"static_types"`
+}
+
+type rollupConfig struct {
+	// Name is appended to the metric names, e.g. by_host gives
+	// varnish_request_time_by_host.
+	Name string `yaml:"name"`
+	// Labels are the labels to keep. status_class is the status as 2xx,
+	// 3xx and so on.
+	Labels []string `yaml:"labels"`
+}
+
+type bucketConfig struct {
+	// Labels are regexps that the values of the named labels must match
+	// in full. No labels means all requests.
+	Labels map[string]string `yaml:"labels"`
+	// Metrics are the names of the metrics, as logged, to use the buckets
+	// for. No names means time.
+	Metrics []string `yaml:"metrics"`
+	// Buckets are the upper bounds of the buckets, in increasing order.
+	Buckets []float64 `yaml:"buckets"`
+}
+
+type apdexConfig struct {
+	Name string `yaml:"name"`
+	// Hosts are host name patterns, in which * matches any part of a name.
+	// No patterns means all hosts.
+	Hosts []string `yaml:"hosts"`
+	// Path is a regexp that the normalized path must match, if set.
+	Path string `yaml:"path"`
+	// Threshold is the Apdex T: requests within T are satisfied, and
+	// within 4T tolerating.
+	Threshold time.Duration `yaml:"threshold"`
+}
+
+// loadConfig reads configFile. An empty name gives an empty config.
+// Unknown keys are errors, so that a misspelled setting is not silently
+// ignored.
+func loadConfig(configFile string) (*config, error) {
+	cfg := &config{}
+	if configFile == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, configError(configFile, data, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", configFile, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the settings that yaml can't check by itself.
+func (c *config) validate() error {
+	names := make(map[string]bool)
+	for i, slo := range c.SLOs {
+		switch {
+		case slo.Name == "":
+			return fmt.Errorf("slos[%d]: name is required", i)
+		case names[slo.Name]:
+			return fmt.Errorf("slos[%d]: duplicate name %q", i, slo.Name)
+		case slo.Threshold <= 0:
+			return fmt.Errorf("slo %s: threshold must be a positive duration, e.g. 300ms", slo.Name)
+		case slo.Objective <= 0 || slo.Objective >= 1:
+			return fmt.Errorf("slo %s: objective must be between 0 and 1, e.g. 0.95", slo.Name)
+		}
+		if _, err := regexp.Compile(slo.Path); err != nil {
+			return fmt.Errorf("slo %s: path: %v", slo.Name, err)
+		}
+		names[slo.Name] = true
+	}
+	names = make(map[string]bool)
+	for i, apdex := range c.Apdex {
+		switch {
+		case apdex.Name == "":
+			return fmt.Errorf("apdex[%d]: name is required", i)
+		case names[apdex.Name]:
+			return fmt.Errorf("apdex[%d]: duplicate name %q", i, apdex.Name)
+		case apdex.Threshold <= 0:
+			return fmt.Errorf("apdex %s: threshold must be a positive duration, e.g. 500ms", apdex.Name)
+		}
+		if _, err := regexp.Compile(apdex.Path); err != nil {
+			return fmt.Errorf("apdex %s: path: %v", apdex.Name, err)
+		}
+		names[apdex.Name] = true
+	}
+	names = make(map[string]bool)
+	for i, rollup := range c.Rollups {
+		switch {
+		case rollup.Name == "":
+			return fmt.Errorf("rollups[%d]: name is required", i)
+		case !metricNameRegexp.MatchString(rollup.Name):
+			return fmt.Errorf("rollups[%d]: name %q must be letters, digits and underscores", i, rollup.Name)
+		case names[rollup.Name]:
+			return fmt.Errorf("rollups[%d]: duplicate name %q", i, rollup.Name)
+		case len(rollup.Labels) == 0:
+			return fmt.Errorf("rollup %s: labels are required", rollup.Name)
+		}
+		for _, label := range rollup.Labels {
+			if !metricNameRegexp.MatchString(label) {
+				return fmt.Errorf("rollup %s: invalid label name %q", rollup.Name, label)
+			}
+		}
+		names[rollup.Name] = true
+	}
+	for i, b := range c.Buckets {
+		if len(b.Buckets) == 0 {
+			return fmt.Errorf("buckets[%d]: buckets are required", i)
+		}
+		for j := 1; j < len(b.Buckets); j++ {
+			if b.Buckets[j] <= b.Buckets[j-1] {
+				return fmt.Errorf("buckets[%d]: buckets must be in increasing order", i)
+			}
+		}
+		for label, pattern := range b.Labels {
+			if !metricNameRegexp.MatchString(label) {
+				return fmt.Errorf("buckets[%d]: invalid label name %q", i, label)
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("buckets[%d]: label %s: %v", i, label, err)
+			}
+		}
+		for _, metric := range b.Metrics {
+			if !metricNameRegexp.MatchString(metric) {
+				return fmt.Errorf("buckets[%d]: invalid metric name %q", i, metric)
+			}
+		}
+	}
+	for label := range c.Labels {
+		if !metricNameRegexp.MatchString(label) || strings.HasPrefix(label, "__") {
+			return fmt.Errorf("labels: invalid label name %q", label)
+		}
+	}
+	return c.Shard.validate()
+}
+
+// bucketRules returns the bucket rules of the config for a
+// collector.Collector, with the metrics under the names namer gives them.
+// The config must have been validated.
+func (c *config) bucketRules(namer *metricNamer) []collector.BucketRule {
+	rules := make([]collector.BucketRule, 0, len(c.Buckets))
+	for _, b := range c.Buckets {
+		rule := collector.BucketRule{
+			Labels:  make(map[string]*regexp.Regexp, len(b.Labels)),
+			Buckets: b.Buckets,
+		}
+		for label, pattern := range b.Labels {
+			rule.Labels[label] = regexp.MustCompile("^(?:" + pattern + ")$")
+		}
+		metrics := b.Metrics
+		if len(metrics) == 0 {
+			metrics = []string{"time"}
+		}
+		for _, metric := range metrics {
+			rule.Metrics = append(rule.Metrics, namer.Names(metric)...)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// metricNameRegexp matches the names valid as label names and as parts of
+// metric names.
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// configTypes are the types the config file is decoded into, for looking
+// up the valid keys when yaml reports an unknown one.
+var configTypes = []reflect.Type{
+	reflect.TypeOf(config{}),
+	reflect.TypeOf(metricConfig{}),
+	reflect.TypeOf(tenantConfig{}),
+	reflect.TypeOf(sloConfig{}),
+	reflect.TypeOf(apdexConfig{}),
+	reflect.TypeOf(rollupConfig{}),
+	reflect.TypeOf(contentClassConfig{}),
+	reflect.TypeOf(bucketConfig{}),
+	reflect.TypeOf(shardConfig{}),
+}
+
+var (
+	yamlLineRegexp         = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlUnknownFieldRegexp = regexp.MustCompile(`^field (\S+) not found in type (\S+)$`)
+)
+
+// configError rewrites the errors from yaml as file:line:column messages,
+// with suggestions for misspelled keys.
+func configError(configFile string, data []byte, err error) error {
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, msg := range messages {
+		m := yamlLineRegexp.FindStringSubmatch(msg)
+		if m == nil {
+			messages[i] = fmt.Sprintf("%s: %s", configFile, msg)
+			continue
+		}
+		lineNo, _ := strconv.Atoi(m[1])
+		msg = m[2]
+		column := 1
+		if f := yamlUnknownFieldRegexp.FindStringSubmatch(msg); f != nil {
+			if lineNo <= len(lines) {
+				if i := strings.Index(lines[lineNo-1], f[1]); i >= 0 {
+					column = i + 1
+				}
+			}
+			msg = fmt.Sprintf("unknown key %q", f[1])
+			if suggestion := suggestConfigKey(f[1], f[2]); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+		}
+		messages[i] = fmt.Sprintf("%s:%d:%d: %s", configFile, lineNo, column, msg)
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "\n"))
+}
+
+// suggestConfigKey returns the valid key of the named type that is
+// closest to key, or "" if none is close enough to be a likely typo.
+func suggestConfigKey(key, typeName string) string {
+	best, bestDistance := "", len(key)/2+1
+	for _, t := range configTypes {
+		if t.String() != typeName {
+			continue
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if d := editDistance(key, name); d < bestDistance {
+				best, bestDistance = name, d
+			}
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// knownMetricHelp describes the metrics the exporter's own varnishncsa
+// format produces.
+var knownMetricHelp = map[string]string{
+	"time":           "Time from when the request was received until the response was delivered, in seconds.",
+	"time_firstbyte": "Time from when the request was received until the first byte of the response was sent, in seconds.",
+	"respsize":       "Size of the response body sent to the client, in bytes.",
+	"queue_seconds":  "Time from when the request started until it was received and processing began, in seconds. Rises when worker threads run out.",
+}
+
+// MetricHelp returns the help text for the named metric. Help set in the
+// config file takes precedence, so custom metrics logged with VCL can be
+// described properly.
+func (c *config) MetricHelp(name string) string {
+	if m, ok := c.Metrics[name]; ok && m.Help != "" {
+		return m.Help
+	}
+	if help, ok := knownMetricHelp[name]; ok {
+		return help
+	}
+	return "Varnish request log value for " + name
+}
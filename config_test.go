@@ -0,0 +1,92 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"help", "help", 0},
+		{"helpp", "help", 1},
+		{"hlep", "help", 2},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSuggestConfigKey(t *testing.T) {
+	tests := []struct {
+		key, typeName, want string
+	}{
+		{"helpp", "main.metricConfig", "help"},
+		{"tenant", "main.config", "tenants"},
+		{"modulos", "main.shardConfig", "modulus"},
+		{"completely_different", "main.config", ""},
+		{"help", "main.unknownConfig", ""},
+	}
+	for _, test := range tests {
+		if got := suggestConfigKey(test.key, test.typeName); got != test.want {
+			t.Errorf("suggestConfigKey(%q, %q) = %q, want %q", test.key, test.typeName, got, test.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		yaml string
+		err  string
+	}{
+		{yaml: "metrics:\n  time:\n    help: Request time.\n"},
+		{yaml: "metrics:\n  time:\n    helpp: x\n", err: `config.yml:3:5: unknown key "helpp", did you mean "help"?`},
+		{yaml: "slos:\n  - name: a\n    threshold: 0s\n    objective: 0.9\n", err: "threshold must be a positive duration"},
+		{yaml: "rollups:\n  - name: bad-name\n    labels: [host]\n", err: "must be letters, digits and underscores"},
+		{yaml: "buckets:\n  - buckets: [1, 0.5]\n", err: "increasing order"},
+		{yaml: "labels:\n  __name: x\n", err: "invalid label name"},
+		{yaml: "shard:\n  modulus: 2\n  label: host\n", err: `source label "host" is the shard label`},
+	}
+	for _, test := range tests {
+		name := filepath.Join(dir, "config.yml")
+		if err := ioutil.WriteFile(name, []byte(test.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(name)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("loading %q: %v", test.yaml, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("loading %q returned %v, want an error containing %q", test.yaml, err, test.err)
+		}
+	}
+}
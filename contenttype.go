@@ -0,0 +1,84 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+// contentTypeFormat is the varnishncsa field for the content_type label.
+const contentTypeFormat = `content_type="%{Content-Type}o"`
+
+// contentClassFormat is the varnishncsa field the content_class label is
+// derived from, along with the path.
+const contentClassFormat = `_content_type="%{Content-Type}o"`
+
+var (
+	defaultStaticExtensions = []string{
+		"css", "js", "mjs", "map",
+		"png", "jpg", "jpeg", "gif", "webp", "avif", "svg", "ico",
+		"woff", "woff2", "ttf", "otf", "eot",
+		"mp4", "webm", "m3u8", "ts", "mp3",
+		"pdf", "zip", "gz", "txt", "xml",
+	}
+	defaultStaticTypes = []string{
+		"text/css", "application/javascript", "text/javascript",
+		"image/*", "font/*", "video/*", "audio/*",
+	}
+)
+
+// contentClassifier tells static content, such as images and style sheets,
+// from dynamic content by the extension of the path or, failing that, the
+// Content-Type of the response.
+type contentClassifier struct {
+	extensions map[string]bool
+	types      map[string]bool
+}
+
+// newContentClassifier uses the extensions and types in cfg, or defaults
+// for any not set.
+func newContentClassifier(cfg contentClassConfig) *contentClassifier {
+	c := &contentClassifier{extensions: make(map[string]bool), types: make(map[string]bool)}
+	extensions, types := cfg.StaticExtensions, cfg.StaticTypes
+	if len(extensions) == 0 {
+		extensions = defaultStaticExtensions
+	}
+	if len(types) == 0 {
+		types = defaultStaticTypes
+	}
+	for _, ext := range extensions {
+		c.extensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	for _, t := range types {
+		c.types[strings.ToLower(t)] = true
+	}
+	return c
+}
+
+// Classify returns "static" or "dynamic".
+func (c *contentClassifier) Classify(path, contentType string) string {
+	name := path[strings.LastIndexByte(path, '/')+1:]
+	if i := strings.LastIndexByte(name, '.'); i >= 0 && c.extensions[strings.ToLower(name[i+1:])] {
+		return "static"
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if c.types[mediaType] {
+		return "static"
+	}
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 && c.types[mediaType[:i]+"/*"] {
+		return "static"
+	}
+	return "dynamic"
+}
@@ -0,0 +1,123 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// errCoProcessTimeout is returned by coProcess.ask when the co-process did
+// not answer in time.
+var errCoProcessTimeout = errors.New("timed out waiting for an answer")
+
+// coProcess runs a command that answers every line written to its stdin
+// with one line on its stdout. It runs on the goroutine processing log
+// lines, so each answer is waited for at most timeout; a co-process that
+// fails or hangs is killed, and started again for the next request.
+type coProcess struct {
+	name    string
+	command string
+	timeout time.Duration
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	answers chan string
+	done    chan struct{}
+}
+
+func (c *coProcess) start() error {
+	cmd := exec.Command("sh", "-c", c.command)
+	cmd.Stderr = os.Stderr
+	// In a process group of its own, so that stopping it also stops
+	// whatever the command started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Infof("Started %s: %s", c.name, c.command)
+	c.cmd, c.stdin = cmd, stdin
+	c.answers, c.done = make(chan string), make(chan struct{})
+	// Answers are read on their own goroutine so that waiting for one can
+	// time out
+	go func(r *bufio.Reader, answers chan<- string, done <-chan struct{}) {
+		defer close(answers)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			select {
+			case answers <- line:
+			case <-done:
+				return
+			}
+		}
+	}(bufio.NewReader(stdout), c.answers, c.done)
+	return nil
+}
+
+func (c *coProcess) stop() {
+	close(c.done)
+	_ = c.stdin.Close()
+	_ = syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+	_ = c.cmd.Wait()
+	c.cmd = nil
+}
+
+// ask writes request to the co-process, starting it if needed, and
+// returns its answer without the line ending.
+func (c *coProcess) ask(request string) (string, error) {
+	if c.cmd == nil {
+		if err := c.start(); err != nil {
+			return "", err
+		}
+	}
+	if _, err := fmt.Fprintln(c.stdin, request); err != nil {
+		c.stop()
+		return "", err
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case answer, ok := <-c.answers:
+		if !ok {
+			c.stop()
+			return "", io.ErrUnexpectedEOF
+		}
+		return strings.TrimRight(answer, "\r\n"), nil
+	case <-timer.C:
+		log.Warnf("%s did not answer within %s, restarting it", c.name, c.timeout)
+		c.stop()
+		return "", errCoProcessTimeout
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCoProcess(t *testing.T) {
+	c := &coProcess{
+		name:    "test",
+		command: `while read line; do case "$line" in slow) sleep 10 ;; exit) exit 1 ;; *) echo "got $line" ;; esac; done`,
+		timeout: 200 * time.Millisecond,
+	}
+	steps := []struct {
+		request, answer string
+		err             error
+	}{
+		{"a", "got a", nil},
+		{"slow", "", errCoProcessTimeout},
+		// The hung co-process was replaced
+		{"b", "got b", nil},
+		{"exit", "", io.ErrUnexpectedEOF},
+		{"c", "got c", nil},
+	}
+	for _, step := range steps {
+		answer, err := c.ask(step.request)
+		if answer != step.answer || err != step.err {
+			t.Errorf("ask(%q) = %q, %v, want %q, %v", step.request, answer, err, step.answer, step.err)
+		}
+	}
+	c.stop()
+}
+
+func TestExternalNormalizer(t *testing.T) {
+	n, err := newExternalNormalizer(`while IFS="$(printf '\t')" read host method path; do
+		case "$path" in /slow) sleep 10 ;; /api/*) echo "path=/api/ID	method=ANY" ;; *) echo ;; esac
+	done`, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.process.stop()
+	tests := []struct {
+		path, wantPath, wantMethod string
+	}{
+		{"/api/1", "/api/ID", "ANY"},
+		{"/about", "/about", "GET"},
+		{"/slow", "/slow", "GET"},
+		{"/api/2", "/api/ID", "ANY"},
+	}
+	for _, test := range tests {
+		labels := request("x", test.path, "200", "hit")
+		labels.Names = append(labels.Names, "method")
+		labels.Values = append(labels.Values, "GET")
+		n.Normalize(labels)
+		if path, method := labels.Value("path"), labels.Value("method"); path != test.wantPath || method != test.wantMethod {
+			t.Errorf("normalized %s to %s %s, want %s %s", test.path, method, path, test.wantMethod, test.wantPath)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+)
+
+// publishVars publishes the state of the exporter's internals through
+// expvar, which serves it as JSON at /debug/vars along with the command
+// line and memory statistics. It is meant for a quick look where a scrape
+// job for the exporter's own metrics would be overkill. child is nil when
+// reading from a file.
+func publishVars(processor *logProcessor, mapper *mappings.PathMapper, hosts *mappings.HostMapper, child *varnishChild) {
+	expvar.Publish("queues", expvar.Func(pipelineQueues.vars))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("sinks", expvar.Func(func() interface{} {
+		return len(processor.sinks)
+	}))
+	expvar.Publish("log_messages", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&processor.msgs)
+	}))
+	expvar.Publish("path_mapping_rules", expvar.Func(func() interface{} {
+		return len(mapper.RuleStrings())
+	}))
+	expvar.Publish("host_mapping_rules", expvar.Func(func() interface{} {
+		return len(hosts.RuleStrings())
+	}))
+	expvar.Publish("child_pid", expvar.Func(func() interface{} {
+		if child == nil {
+			return 0
+		}
+		return child.PID()
+	}))
+}
+
+// vars returns the length and capacity of each queue, by name.
+func (c *queueCollector) vars() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queues := make(map[string]map[string]int, len(c.queues))
+	for name, lengthFunc := range c.queues {
+		length, capacity := lengthFunc()
+		queues[name] = map[string]int{"length": length, "capacity": capacity}
+	}
+	return queues
+}
@@ -0,0 +1,78 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// The varnishncsa fields needed for Varnish Enterprise metrics. The Storage
+// record names the stevedore that served the object, and ykey purges are
+// expected to be logged from VCL as
+//
+//	std.log("ykey_purged: " + ykey.purge_header(req.http.Ykey-Purge));
+const enterpriseFormat = `_storage_type="%{VSL:Storage[1]}x"` +
+	` _storage="%{VSL:Storage[2]}x"` +
+	` _ykey_purged="%{VSL:VCL_Log:ykey_purged}x"`
+
+// enterpriseSink exports per-store cache hits for the Massive Storage
+// Engine (MSE) and the number of objects invalidated through ykey.
+type enterpriseSink struct {
+	storeHits  *prometheus.CounterVec
+	ykeyPurges prometheus.Counter
+	ykeyPurged prometheus.Counter
+}
+
+func newEnterpriseSink() (*enterpriseSink, error) {
+	s := &enterpriseSink{
+		storeHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "store_hits_total",
+			Help:      "Number of cache hits served from each storage, such as an MSE store.",
+		}, []string{"type", "store"}),
+		ykeyPurges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ykey_purges_total",
+			Help:      "Number of requests that purged objects by ykey.",
+		}),
+		ykeyPurged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ykey_purged_objects_total",
+			Help:      "Number of objects purged by ykey.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{s.storeHits, s.ykeyPurges, s.ykeyPurged} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *enterpriseSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	// varnishncsa prints "-" for records that are not in the transaction
+	if store := labels.Extra["_storage"]; store != "" && store != "-" && labels.Value("cache") == "hit" {
+		s.storeHits.WithLabelValues(labels.Extra["_storage_type"], store).Inc()
+	}
+	if purged, err := strconv.Atoi(labels.Extra["_ykey_purged"]); err == nil {
+		s.ykeyPurges.Inc()
+		s.ykeyPurged.Add(float64(purged))
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+)
+
+// exactPaths is the mapper used for error responses in -metrics.errors-detail
+// mode, which leaves paths as they are.
+var exactPaths = &mappings.PathMapper{}
+
+// lineStatus finds the status field of a varnishncsa log line without
+// parsing all of it, so that the sampler and the parser can treat errors
+// differently. It returns 0 if there is no status.
+func lineStatus(line string) int {
+	i := strings.Index(line, "status=")
+	if i < 0 || (i > 0 && line[i-1] != ' ') {
+		return 0
+	}
+	value := line[i+len("status="):]
+	if end := strings.IndexByte(value, ' '); end >= 0 {
+		value = value[:end]
+	}
+	status, _ := strconv.Atoi(value)
+	return status
+}
+
+// isErrorStatus tells whether a response with the given status is worth
+// recording in full detail: server errors, and rate limited requests.
+func isErrorStatus(status int) bool {
+	return status >= 500 || status == 429
+}
+
+// coarsePath cuts a path down to its first segment, so /api/users/ID
+// becomes /api/*.
+func coarsePath(path string) string {
+	rest := strings.TrimPrefix(path, "/")
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return "/" + rest[:i] + "/*"
+	}
+	return path
+}
@@ -0,0 +1,61 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestLineStatus(t *testing.T) {
+	tests := []struct {
+		line string
+		want int
+	}{
+		{`status=503 path="/"`, 503},
+		{`method="GET" status=200 path="/"`, 200},
+		{`method="GET" status=404`, 404},
+		{`method="GET" backend_status=500 path="/"`, 0},
+		{`method="GET" path="/"`, 0},
+		{`status=- path="/"`, 0},
+	}
+	for _, test := range tests {
+		if got := lineStatus(test.line); got != test.want {
+			t.Errorf("lineStatus(%q) = %d, want %d", test.line, got, test.want)
+		}
+	}
+}
+
+func TestIsErrorStatus(t *testing.T) {
+	for status, want := range map[int]bool{200: false, 404: false, 429: true, 499: false, 500: true, 503: true} {
+		if got := isErrorStatus(status); got != want {
+			t.Errorf("isErrorStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestCoarsePath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/api/users/123", "/api/*"},
+		{"/api/", "/api/*"},
+		{"/api", "/api"},
+		{"/", "/"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := coarsePath(test.path); got != test.want {
+			t.Errorf("coarsePath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package event defines the request events that the exporter produces from
+// the Varnish log, after path and host normalization and redaction, and
+// sends to Loki, ClickHouse and other sinks. Other Go programs can import
+// it to consume these events. event.proto and schema.json describe the
+// same schema for other languages.
+//
+// Changes that could break consumers, such as renaming or removing a
+// field or changing its meaning, increase SchemaVersion. Adding fields
+// does not.
+package event
+
+import (
+	"sort"
+	"time"
+)
+
+// SchemaVersion is the version of the RequestEvent schema.
+const SchemaVersion = 1
+
+// RequestEvent is one request from the Varnish log.
+type RequestEvent struct {
+	// SchemaVersion is the schema version the event was produced with.
+	SchemaVersion int `json:"schema_version"`
+	// Time is when the exporter read the request from the log.
+	Time time.Time `json:"time"`
+	// Labels are the normalized request attributes used as metric
+	// labels, such as method, status, host and path.
+	Labels map[string]string `json:"labels"`
+	// Values are the request's numeric values by metric name, such as
+	// time (in seconds) and respsize (in bytes).
+	Values map[string]float64 `json:"values"`
+	// Extra holds other fields logged for the request, which are not used
+	// as labels. Names start with an underscore, and missing values are
+	// "-".
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// New returns an event with the current schema version.
+func New(t time.Time) *RequestEvent {
+	return &RequestEvent{
+		SchemaVersion: SchemaVersion,
+		Time:          t,
+		Labels:        make(map[string]string),
+		Values:        make(map[string]float64),
+	}
+}
+
+// Label returns the named label, or "" if it is not set.
+func (e *RequestEvent) Label(name string) string {
+	return e.Labels[name]
+}
+
+// LabelNames returns the names of the labels in lexical order.
+func (e *RequestEvent) LabelNames() []string {
+	names := make([]string, 0, len(e.Labels))
+	for name := range e.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValueNames returns the names of the values in lexical order.
+func (e *RequestEvent) ValueNames() []string {
+	names := make([]string, 0, len(e.Values))
+	for name := range e.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
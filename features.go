@@ -0,0 +1,178 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// runtimeFeatures are the flags that can be turned on and off while the
+// exporter runs, by the name of the flag without "varnish.". They all
+// change the varnishncsa format.
+var runtimeFeatures = map[string]*bool{
+	"sizes":        sizes,
+	"firstbyte":    beFirstByte,
+	"queue-time":   queueTime,
+	"backend":      backendStats,
+	"content-type": contentType,
+}
+
+// allFeaturesFormat returns the varnishncsa format with all runtime
+// features turned on, for declaring the labels and metrics that turning
+// them on can add.
+func allFeaturesFormat() string {
+	saved := make(map[string]bool, len(runtimeFeatures))
+	for name, enabled := range runtimeFeatures {
+		saved[name] = *enabled
+		*enabled = true
+	}
+	format := joinFormatFields(buildVarnishNCSAFields())
+	for name, enabled := range runtimeFeatures {
+		*enabled = saved[name]
+	}
+	return format
+}
+
+// featureSwitch turns runtime features on and off, restarting varnishncsa
+// with the new format, so that operators can get more detail during an
+// incident without restarting the exporter.
+type featureSwitch struct {
+	child *varnishChild
+	token []byte
+
+	mu      sync.Mutex
+	enabled *prometheus.GaugeVec
+}
+
+// newFeatureSwitch creates a featureSwitch whose HTTP requests must have
+// the bearer token in tokenFile.
+func newFeatureSwitch(child *varnishChild, tokenFile string) (*featureSwitch, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("%s is empty", tokenFile)
+	}
+	f := &featureSwitch{
+		child: child,
+		token: token,
+		enabled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_feature_enabled",
+			Help:      "Whether a feature that can be turned on and off at runtime is on.",
+		}, []string{"feature"}),
+	}
+	if err := prometheus.Register(f.enabled); err != nil {
+		return nil, err
+	}
+	for name, enabled := range runtimeFeatures {
+		f.enabled.WithLabelValues(name).Set(boolValue(*enabled))
+	}
+	return f, nil
+}
+
+// Set turns a feature on or off. If varnishncsa rejects the new format,
+// the feature is left as it was.
+func (f *featureSwitch) Set(name string, on bool) error {
+	enabled, ok := runtimeFeatures[name]
+	if !ok {
+		return fmt.Errorf("unknown feature %q", name)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if *enabled == on {
+		return nil
+	}
+	*enabled = on
+	format, err := varnishNCSAFormat(*checkFormat)
+	if err == nil {
+		err = f.child.SetArgs(buildVarnishNCSAArgs(buildVslQuery(), format))
+	}
+	if err != nil {
+		*enabled = !on
+		return err
+	}
+	log.Infof("turned %s %s, running varnishncsa with format %s", name, onOff(on), format)
+	f.enabled.WithLabelValues(name).Set(boolValue(on))
+	return nil
+}
+
+// ServeHTTP lists the features and whether they are on, after turning
+// one on or off on POST, with the feature and enabled form values.
+func (f *featureSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), f.token) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		on, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := f.Set(req.FormValue("feature"), on); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(runtimeFeatures))
+	for name := range runtimeFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %s\n", name, onOff(*runtimeFeatures[name]))
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// shardConfig adds a label with the shard each series belongs to, for
+// Prometheus servers that each keep one shard of the series.
+type shardConfig struct {
+	// Label is the name of the label, "shard" by default.
+	Label string `yaml:"label"`
+	// Modulus is the number of shards. Zero means no shard label.
+	Modulus uint64 `yaml:"modulus"`
+	// SourceLabels are the labels whose values are hashed, host and path
+	// by default.
+	SourceLabels []string `yaml:"source_labels"`
+}
+
+// labelName returns the name of the shard label.
+func (c shardConfig) labelName() string {
+	if c.Label == "" {
+		return "shard"
+	}
+	return c.Label
+}
+
+// sourceLabels returns the labels whose values are hashed.
+func (c shardConfig) sourceLabels() []string {
+	if len(c.SourceLabels) == 0 {
+		return []string{"host", "path"}
+	}
+	return c.SourceLabels
+}
+
+// validate checks the settings of the shard label.
+func (c shardConfig) validate() error {
+	if c.Modulus == 0 {
+		if c.Label != "" || len(c.SourceLabels) > 0 {
+			return fmt.Errorf("shard: modulus is required")
+		}
+		return nil
+	}
+	if !metricNameRegexp.MatchString(c.labelName()) {
+		return fmt.Errorf("shard: invalid label name %q", c.labelName())
+	}
+	for _, label := range c.sourceLabels() {
+		switch {
+		case !metricNameRegexp.MatchString(label):
+			return fmt.Errorf("shard: invalid source label name %q", label)
+		case label == c.labelName():
+			return fmt.Errorf("shard: source label %q is the shard label", label)
+		}
+	}
+	return nil
+}
+
+// hashmod returns the shard of a series with the given values of the
+// source labels, computed like Prometheus' hashmod relabel action with
+// the default ";" separator, so that relabeling can be checked against
+// the label or moved to it.
+func hashmod(values []string, modulus uint64) uint64 {
+	sum := md5.Sum([]byte(strings.Join(values, ";")))
+	return binary.BigEndian.Uint64(sum[md5.Size-8:]) % modulus
+}
+
+// federationGatherer adds the constant labels of the config file to all
+// series, and the shard label if configured. A series that already has
+// a label keeps its own value.
+type federationGatherer struct {
+	gatherer prometheus.Gatherer
+	labels   map[string]string
+	shard    shardConfig
+}
+
+func (g *federationGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	sources := g.shard.sourceLabels()
+	values := make([]string, len(sources))
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for name, value := range g.labels {
+				addLabel(m, name, value)
+			}
+			if g.shard.Modulus == 0 {
+				continue
+			}
+			for i, source := range sources {
+				values[i] = labelValue(m, source)
+			}
+			addLabel(m, g.shard.labelName(), fmt.Sprint(hashmod(values, g.shard.Modulus)))
+		}
+	}
+	return mfs, err
+}
+
+// labelValue returns the value of the named label of m, or "" if m has
+// no such label.
+func labelValue(m *dto.Metric, name string) string {
+	for _, label := range m.Label {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHashmod(t *testing.T) {
+	// The shards Prometheus' hashmod relabel action gives the same values
+	tests := []struct {
+		values  []string
+		modulus uint64
+		want    uint64
+	}{
+		{[]string{"x", "/u/1"}, 4, 2},
+		{[]string{"x", "/u/2"}, 4, 2},
+		{[]string{"", ""}, 4, 1},
+		{[]string{"x", "/u/1"}, 1, 0},
+	}
+	for _, test := range tests {
+		if got := hashmod(test.values, test.modulus); got != test.want {
+			t.Errorf("hashmod(%q, %d) = %d, want %d", test.values, test.modulus, got, test.want)
+		}
+	}
+}
+
+func TestShardConfigValidate(t *testing.T) {
+	tests := []struct {
+		config shardConfig
+		valid  bool
+	}{
+		{shardConfig{}, true},
+		{shardConfig{Modulus: 4}, true},
+		{shardConfig{Label: "shard"}, false},
+		{shardConfig{Modulus: 4, Label: "path"}, false},
+		{shardConfig{Modulus: 4, SourceLabels: []string{"bad-name"}}, false},
+	}
+	for _, test := range tests {
+		if err := test.config.validate(); (err == nil) != test.valid {
+			t.Errorf("validate(%+v) = %v", test.config, err)
+		}
+	}
+}
+
+type staticGatherer []*dto.MetricFamily
+
+func TestFederationGatherer(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("requests"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{
+			Label:   []*dto.LabelPair{labelPair("host", "x"), labelPair("path", "/u/1")},
+			Counter: &dto.Counter{Value: proto.Float64(1)},
+		}, {
+			Label:   []*dto.LabelPair{labelPair("datacenter", "own")},
+			Counter: &dto.Counter{Value: proto.Float64(1)},
+		}},
+	}
+	var g prometheus.Gatherer = &federationGatherer{
+		gatherer: gatherFunc(func() ([]*dto.MetricFamily, error) { return []*dto.MetricFamily{mf}, nil }),
+		labels:   map[string]string{"datacenter": "ams1"},
+		shard:    shardConfig{Modulus: 4},
+	}
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"datacenter=ams1\x00host=x\x00path=/u/1\x00shard=2\x00",
+		"datacenter=own\x00shard=1\x00",
+	}
+	for i, m := range mfs[0].Metric {
+		if got := labelSignature(m); got != want[i] {
+			t.Errorf("series %d has labels %q, want %q", i, got, want[i])
+		}
+	}
+}
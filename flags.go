@@ -0,0 +1,70 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// listFlag is a flag.Value holding a list of strings. The flag may be
+// repeated, and each value may hold several comma-separated items.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// statusListFlag is a listFlag that only accepts HTTP status codes.
+type statusListFlag struct {
+	listFlag
+}
+
+func (l *statusListFlag) Set(value string) error {
+	var items listFlag
+	if err := items.Set(value); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if status, err := strconv.Atoi(item); err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("invalid status code %q", item)
+		}
+	}
+	l.listFlag = append(l.listFlag, items...)
+	return nil
+}
+
+// argsFlag is a flag.Value holding command line arguments. The flag may be
+// repeated, and each value is split into arguments at whitespace.
+type argsFlag []string
+
+func (a *argsFlag) String() string {
+	return strings.Join(*a, " ")
+}
+
+func (a *argsFlag) Set(value string) error {
+	*a = append(*a, strings.Fields(value)...)
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// freshnessFormat logs the Age and Cache-Control response headers. Cache
+// control directives can have quoted values, so it is logged in
+// backquotes.
+const freshnessFormat = "_age=\"%{Age}o\" _cache_control=`%{Cache-Control}o`"
+
+// freshnessSink tells how much of their freshness lifetime cached objects
+// had used up when they were delivered. Hits that are mostly young mean
+// the objects are evicted or purged long before they expire, so longer
+// TTLs from the backend gain nothing.
+type freshnessSink struct {
+	age         *prometheus.HistogramVec
+	utilization *prometheus.HistogramVec
+}
+
+func newFreshnessSink() (*freshnessSink, error) {
+	s := &freshnessSink{
+		age: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "hit_age_seconds",
+			Help:      "Age of cache hits, from the Age response header, in seconds.",
+			Buckets:   []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600, 7 * 24 * 3600},
+		}, []string{"host"}),
+		utilization: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "freshness_utilization",
+			Help:      "Age of cache hits as a fraction of their Cache-Control s-maxage or max-age, above 1 for stale objects.",
+			Buckets:   []float64{.1, .2, .3, .4, .5, .6, .7, .8, .9, 1, 1.5, 2},
+		}, []string{"host"}),
+	}
+	for _, c := range []prometheus.Collector{s.age, s.utilization} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *freshnessSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	if labels.Value("cache") != "hit" {
+		return
+	}
+	age, err := strconv.ParseFloat(labels.Extra["_age"], 64)
+	if err != nil {
+		return
+	}
+	host := labels.Value("host")
+	s.age.WithLabelValues(host).Observe(age)
+	if maxAge, ok := freshnessLifetime(labels.Extra["_cache_control"]); ok && maxAge > 0 {
+		s.utilization.WithLabelValues(host).Observe(age / maxAge)
+	}
+}
+
+// freshnessLifetime returns the s-maxage of a Cache-Control header, which
+// is the one for shared caches, or else its max-age, in seconds.
+func freshnessLifetime(cacheControl string) (float64, bool) {
+	var maxAge, sMaxAge string
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		switch strings.ToLower(name) {
+		case "max-age":
+			maxAge = value
+		case "s-maxage":
+			sMaxAge = value
+		}
+	}
+	if sMaxAge != "" {
+		maxAge = sMaxAge
+	}
+	seconds, err := strconv.ParseUint(maxAge, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return float64(seconds), true
+}
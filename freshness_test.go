@@ -0,0 +1,41 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestFreshnessLifetime(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         float64
+		ok           bool
+	}{
+		{"", 0, false},
+		{"-", 0, false},
+		{"no-store", 0, false},
+		{"max-age=60", 60, true},
+		{"public, Max-Age = 60", 60, true},
+		{`max-age="60"`, 60, true},
+		{"max-age=60, s-maxage=300", 300, true},
+		{"s-maxage=300, max-age=60", 300, true},
+		{"max-age=-1", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := freshnessLifetime(test.cacheControl)
+		if got != test.want || ok != test.ok {
+			t.Errorf("freshnessLifetime(%q) = %g, %v, want %g, %v", test.cacheControl, got, ok, test.want, test.ok)
+		}
+	}
+}
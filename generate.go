@@ -0,0 +1,353 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// runGenerateDashboards implements the "generate-dashboards" command. It
+// writes a Grafana dashboard and Prometheus alerting rules for the metrics
+// as the other flags and the config file make the exporter export them.
+func runGenerateDashboards(args []string) int {
+	fs := flag.NewFlagSet("generate-dashboards", flag.ExitOnError)
+	dashboardFile := fs.String("dashboard", "varnish_request_dashboard.json", "File to write the Grafana dashboard to")
+	rulesFile := fs.String("rules", "varnish_request_rules.yml", "File to write the Prometheus alerting rules to")
+	errorRate := fs.Float64("error-rate", 0.05, "Fraction of 5xx responses for a host to alert at")
+	p99 := fs.Duration("p99", time.Second, "99th percentile request time for a host to alert at")
+	lag := fs.Duration("lag", 5*time.Minute, "Time since the exporter last read a log line to alert at")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] generate-dashboards [generate-dashboards flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	namer, err := newMetricNamer(metricsCompat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-metrics.compat: %v\n", err)
+		return 1
+	}
+	g := &generator{namer: namer, cfg: cfg}
+
+	dashboard, err := json.MarshalIndent(g.dashboard(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	rules, err := yaml.Marshal(g.rules(*errorRate, p99.Seconds(), lag.Seconds()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if err := ioutil.WriteFile(*dashboardFile, append(dashboard, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("dashboard: %s\n", *dashboardFile)
+	if err := ioutil.WriteFile(*rulesFile, rules, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("alerting rules: %s\n", *rulesFile)
+	if !isBucketBound(p99.Seconds()) {
+		fmt.Fprintf(os.Stderr, "-p99 %v is not one of the histogram bucket boundaries %v (seconds), so the alert is only as exact as the buckets around it\n", *p99, prometheus.DefBuckets)
+	}
+	return 0
+}
+
+// isBucketBound tells whether v is an upper bound of the request time
+// histogram buckets.
+func isBucketBound(v float64) bool {
+	for _, b := range prometheus.DefBuckets {
+		if b == v {
+			return true
+		}
+	}
+	return false
+}
+
+// generator builds dashboards and rules for the exporter's metrics.
+type generator struct {
+	namer *metricNamer
+	cfg   *config
+}
+
+// metric returns the full name of a metric, under the new name if it is
+// exported under both.
+func (g *generator) metric(name string) string {
+	names := g.namer.Names(name)
+	return namespace + "_" + names[len(names)-1]
+}
+
+// selector joins label matchers into a selector for client requests,
+// which need a side matcher when backend requests are also exported.
+func selector(matchers ...string) string {
+	if *backendStats {
+		matchers = append([]string{`side="client"`}, matchers...)
+	}
+	return strings.Join(matchers, ",")
+}
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Datasource  string                 `json:"datasource"`
+	GridPos     grafanaGridPos         `json:"gridPos"`
+	Targets     []grafanaTarget        `json:"targets"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+}
+
+type grafanaVariable struct {
+	Name       string `json:"name"`
+	Label      string `json:"label"`
+	Type       string `json:"type"`
+	Query      string `json:"query"`
+	Datasource string `json:"datasource,omitempty"`
+	Refresh    int    `json:"refresh,omitempty"`
+	IncludeAll bool   `json:"includeAll"`
+	Multi      bool   `json:"multi"`
+	AllValue   string `json:"allValue,omitempty"`
+}
+
+type grafanaDashboard struct {
+	Title         string            `json:"title"`
+	UID           string            `json:"uid"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Time          map[string]string `json:"time"`
+	Refresh       string            `json:"refresh"`
+	Templating    struct {
+		List []grafanaVariable `json:"list"`
+	} `json:"templating"`
+	Panels []grafanaPanel `json:"panels"`
+}
+
+func (g *generator) dashboard() *grafanaDashboard {
+	d := &grafanaDashboard{
+		Title:         "Varnish Requests",
+		UID:           "varnish-request",
+		SchemaVersion: 27,
+		Time:          map[string]string{"from": "now-6h", "to": "now"},
+		Refresh:       "1m",
+	}
+	timeMetric := g.metric("time")
+	d.Templating.List = []grafanaVariable{
+		{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		{
+			Name: "host", Label: "Host", Type: "query", Datasource: "$datasource", Refresh: 2,
+			Query:      fmt.Sprintf("label_values(%s_count, host)", timeMetric),
+			IncludeAll: true, Multi: true, AllValue: ".*",
+		},
+	}
+	sel := selector(`host=~"$host"`)
+
+	add := func(title, unit string, targets ...grafanaTarget) {
+		n := len(d.Panels)
+		for i := range targets {
+			targets[i].RefID = string(rune('A' + i))
+		}
+		d.Panels = append(d.Panels, grafanaPanel{
+			ID:          n + 1,
+			Type:        "timeseries",
+			Title:       title,
+			Datasource:  "$datasource",
+			GridPos:     grafanaGridPos{H: 8, W: 12, X: 12 * (n % 2), Y: 8 * (n / 2)},
+			Targets:     targets,
+			FieldConfig: map[string]interface{}{"defaults": map[string]string{"unit": unit}},
+		})
+	}
+	add("Requests by host", "reqps", grafanaTarget{
+		Expr:         fmt.Sprintf("sum by (host) (rate(%s_count{%s}[5m]))", timeMetric, sel),
+		LegendFormat: "{{host}}",
+	})
+	add("5xx error rate by host", "percentunit", grafanaTarget{
+		Expr: fmt.Sprintf(`sum by (host) (rate(%s_count{%s,status=~"5.."}[5m])) / sum by (host) (rate(%s_count{%s}[5m]))`,
+			timeMetric, sel, timeMetric, sel),
+		LegendFormat: "{{host}}",
+	})
+	var quantiles []grafanaTarget
+	for _, q := range []struct{ value, legend string }{{"0.5", "p50"}, {"0.9", "p90"}, {"0.99", "p99"}} {
+		quantiles = append(quantiles, grafanaTarget{
+			Expr:         fmt.Sprintf("histogram_quantile(%s, sum by (le) (rate(%s_bucket{%s}[5m])))", q.value, timeMetric, sel),
+			LegendFormat: q.legend,
+		})
+	}
+	add("Request time", "s", quantiles...)
+	add("Cache outcomes", "reqps", grafanaTarget{
+		Expr:         fmt.Sprintf("sum by (cache) (rate(%s_count{%s}[5m]))", timeMetric, sel),
+		LegendFormat: "{{cache}}",
+	})
+	add("Slowest paths (p99)", "s", grafanaTarget{
+		Expr:         fmt.Sprintf("topk(10, histogram_quantile(0.99, sum by (host, path, le) (rate(%s_bucket{%s}[5m]))))", timeMetric, sel),
+		LegendFormat: "{{host}}{{path}}",
+	})
+	add("Busiest paths", "reqps", grafanaTarget{
+		Expr:         fmt.Sprintf("topk(10, sum by (host, path) (rate(%s_count{%s}[5m])))", timeMetric, sel),
+		LegendFormat: "{{host}}{{path}}",
+	})
+	if *beFirstByte {
+		add("Backend time to first byte (p99)", "s", grafanaTarget{
+			Expr:         fmt.Sprintf("histogram_quantile(0.99, sum by (host, le) (rate(%s_bucket{%s}[5m])))", g.metric("time_firstbyte"), sel),
+			LegendFormat: "{{host}}",
+		})
+	}
+	if *sizes {
+		add("Response bytes by host", "Bps", grafanaTarget{
+			Expr:         fmt.Sprintf("sum by (host) (rate(%s_sum{%s}[5m]))", g.metric("respsize"), sel),
+			LegendFormat: "{{host}}",
+		})
+	}
+	if *backendStats {
+		add("Backend requests by host", "reqps", grafanaTarget{
+			Expr:         fmt.Sprintf(`sum by (host) (rate(%s_count{side="backend",host=~"$host"}[5m]))`, timeMetric),
+			LegendFormat: "{{host}}",
+		})
+	}
+	for _, s := range g.cfg.SLOs {
+		add("SLO "+s.Name+": good requests", "percentunit", grafanaTarget{
+			Expr:         g.sloGoodRatio(s.Name, "1h"),
+			LegendFormat: "last hour",
+		}, grafanaTarget{
+			Expr:         fmt.Sprintf(`%s{slo=%q}`, namespace+"_slo_objective", s.Name),
+			LegendFormat: "objective",
+		})
+	}
+	add("Exporter log lines", "short", grafanaTarget{
+		Expr:         fmt.Sprintf("rate(%s[5m])", g.metric("exporter_log_messages")),
+		LegendFormat: "read",
+	}, grafanaTarget{
+		Expr:         fmt.Sprintf("rate(%s[5m])", g.metric("exporter_log_parse_failure")),
+		LegendFormat: "parse failures",
+	})
+	return d
+}
+
+func (g *generator) sloGoodRatio(name, window string) string {
+	good := fmt.Sprintf(`sum(rate(%s_slo_good_total{slo=%q}[%s]))`, namespace, name, window)
+	bad := fmt.Sprintf(`sum(rate(%s_slo_bad_total{slo=%q}[%s]))`, namespace, name, window)
+	return fmt.Sprintf("%s / (%s + %s)", good, good, bad)
+}
+
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+type ruleGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []alertRule `yaml:"rules"`
+}
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+func (g *generator) rules(errorRate, p99, lag float64) *ruleFile {
+	timeMetric := g.metric("time")
+	warning := map[string]string{"severity": "warning"}
+	critical := map[string]string{"severity": "critical"}
+	group := ruleGroup{Name: "varnish_request"}
+	group.Rules = append(group.Rules,
+		alertRule{
+			Alert: "VarnishRequestHighErrorRate",
+			Expr: fmt.Sprintf(`sum by (host) (rate(%s_count{%s}[5m])) / sum by (host) (rate(%s_count{%s}[5m])) > %s`,
+				timeMetric, selector(`status=~"5.."`), timeMetric, selector(), formatFloat(errorRate)),
+			For:    "5m",
+			Labels: critical,
+			Annotations: map[string]string{
+				"summary": "{{ $labels.host }} answers {{ $value | humanizePercentage }} of requests with 5xx errors",
+			},
+		},
+		alertRule{
+			Alert: "VarnishRequestSlowResponses",
+			Expr: fmt.Sprintf(`histogram_quantile(0.99, sum by (host, le) (rate(%s_bucket{%s}[5m]))) > %s`,
+				timeMetric, selector(), formatFloat(p99)),
+			For:    "10m",
+			Labels: warning,
+			Annotations: map[string]string{
+				"summary": "99th percentile request time of {{ $labels.host }} is {{ $value | humanizeDuration }}",
+			},
+		},
+		alertRule{
+			Alert:  "VarnishRequestExporterNoLogs",
+			Expr:   fmt.Sprintf(`time() - %s_exporter_last_log_message_timestamp_seconds > %s`, namespace, formatFloat(lag)),
+			For:    "5m",
+			Labels: warning,
+			Annotations: map[string]string{
+				"summary": "The exporter on {{ $labels.instance }} has read no Varnish log lines for {{ $value | humanizeDuration }}",
+			},
+		},
+		alertRule{
+			Alert:  "VarnishRequestExporterParseFailures",
+			Expr:   fmt.Sprintf(`rate(%s[5m]) > 0`, g.metric("exporter_log_parse_failure")),
+			For:    "15m",
+			Labels: warning,
+			Annotations: map[string]string{
+				"summary": "The exporter on {{ $labels.instance }} fails to parse Varnish log lines",
+			},
+		},
+	)
+	// Multiwindow burn rate alerts, at the rate that uses up 2% of a
+	// 30-day error budget in an hour
+	for _, s := range g.cfg.SLOs {
+		budget := "(1 - " + formatFloat(s.Objective) + ")"
+		group.Rules = append(group.Rules, alertRule{
+			Alert: "VarnishRequestSLOBurnRate",
+			Expr: fmt.Sprintf("(1 - (%s)) / %s > 14.4\nand\n(1 - (%s)) / %s > 14.4",
+				g.sloGoodRatio(s.Name, "1h"), budget, g.sloGoodRatio(s.Name, "5m"), budget),
+			For:    "2m",
+			Labels: map[string]string{"severity": "critical", "slo": s.Name},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("SLO %s is using up its error budget {{ $value | humanize }} times too fast", s.Name),
+			},
+		})
+	}
+	return &ruleFile{Groups: []ruleGroup{group}}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
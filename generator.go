@@ -0,0 +1,195 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// generatorMix is the request mix the traffic generator draws requests
+// from, read from a YAML file.
+type generatorMix struct {
+	Requests []generatorRequest `yaml:"requests"`
+}
+
+// generatorRequest is a kind of request in the mix.
+type generatorRequest struct {
+	Host   string `yaml:"host"`
+	Method string `yaml:"method"`
+	// Path may have {id} placeholders, which are replaced with a random
+	// number up to 1000, and {hex}, replaced with 32 random hex digits.
+	Path string `yaml:"path"`
+	// Weight is how often the request comes relative to the others.
+	Weight float64 `yaml:"weight"`
+	// HitRatio is the fraction of requests served from cache.
+	HitRatio float64 `yaml:"hit_ratio"`
+	// Latency is the median time a miss takes. Hits take a fraction of a
+	// millisecond.
+	Latency time.Duration `yaml:"latency"`
+	// Status is the status of successful requests, 200 by default.
+	Status int `yaml:"status"`
+	// ErrorRatio is the fraction of misses that fail with a 503.
+	ErrorRatio float64 `yaml:"error_ratio"`
+	// Size is the median response size, in bytes.
+	Size int `yaml:"size"`
+}
+
+// defaultGeneratorMix is a small web site with an API.
+var defaultGeneratorMix = generatorMix{Requests: []generatorRequest{
+	{Host: "www.example.com", Path: "/", Weight: 10, HitRatio: 0.95, Latency: 80 * time.Millisecond, Size: 40000},
+	{Host: "www.example.com", Path: "/article/{id}/", Weight: 30, HitRatio: 0.8, Latency: 150 * time.Millisecond, Size: 60000},
+	{Host: "www.example.com", Path: "/static/{hex}.js", Weight: 40, HitRatio: 0.99, Latency: 20 * time.Millisecond, Size: 120000},
+	{Host: "www.example.com", Path: "/search", Weight: 5, Latency: 400 * time.Millisecond, ErrorRatio: 0.02, Size: 30000},
+	{Host: "api.example.com", Path: "/v1/users/{id}", Weight: 10, HitRatio: 0.3, Latency: 50 * time.Millisecond, ErrorRatio: 0.01, Size: 2000},
+	{Host: "api.example.com", Method: "POST", Path: "/v1/orders", Weight: 3, Status: 201, Latency: 250 * time.Millisecond, ErrorRatio: 0.05, Size: 500},
+	{Host: "www.example.com", Path: "/healthz", Weight: 2, Latency: time.Millisecond, Size: 2},
+}}
+
+// loadGeneratorMix reads a request mix from file, or returns the built-in
+// one for "default".
+func loadGeneratorMix(file string) (*generatorMix, error) {
+	if file == "default" {
+		return &defaultGeneratorMix, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	mix := &generatorMix{}
+	if err := yaml.UnmarshalStrict(data, mix); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if len(mix.Requests) == 0 {
+		return nil, fmt.Errorf("%s: no requests", file)
+	}
+	for i, r := range mix.Requests {
+		switch {
+		case r.Host == "" || r.Path == "":
+			return nil, fmt.Errorf("%s: requests[%d]: host and path are required", file, i)
+		case r.Weight < 0:
+			return nil, fmt.Errorf("%s: requests[%d]: weight can't be negative", file, i)
+		case r.HitRatio < 0 || r.HitRatio > 1 || r.ErrorRatio < 0 || r.ErrorRatio > 1:
+			return nil, fmt.Errorf("%s: requests[%d]: ratios must be between 0 and 1", file, i)
+		}
+	}
+	return mix, nil
+}
+
+// generateTraffic returns a reader of varnishncsa lines, in the exporter's
+// format, for requests drawn from mix at rate requests per second. It
+// never ends.
+func generateTraffic(mix *generatorMix, rate float64) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		out := bufio.NewWriter(w)
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		const tick = 10 * time.Millisecond
+		due := 0.0
+		for range time.Tick(tick) {
+			for due += rate * tick.Seconds(); due >= 1; due-- {
+				_, _ = out.WriteString(generateLine(mix, rnd))
+			}
+			if err := out.Flush(); err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// generateLine returns a log line, with a newline, for a random request
+// from mix. Besides the basic fields, it has the response size with
+// -varnish.sizes and the time to first byte with -varnish.firstbyte.
+func generateLine(mix *generatorMix, rnd *rand.Rand) string {
+	total := 0.0
+	for _, r := range mix.Requests {
+		total += weight(r)
+	}
+	req := mix.Requests[len(mix.Requests)-1]
+	x := rnd.Float64() * total
+	for _, r := range mix.Requests {
+		if x -= weight(r); x < 0 {
+			req = r
+			break
+		}
+	}
+
+	method, status := req.Method, req.Status
+	if method == "" {
+		method = "GET"
+	}
+	if status == 0 {
+		status = 200
+	}
+	cache := "miss"
+	// Log-normally distributed, as response times and sizes tend to be
+	spread := func(median float64) float64 {
+		return median * math.Exp(0.5*rnd.NormFloat64())
+	}
+	seconds := spread(req.Latency.Seconds())
+	if rnd.Float64() < req.HitRatio {
+		cache, seconds = "hit", spread(0.0002)
+	} else if rnd.Float64() < req.ErrorRatio {
+		status = 503
+	}
+	path := strings.Replace(req.Path, "{id}", strconv.Itoa(rnd.Intn(1000)+1), -1)
+	for strings.Contains(path, "{hex}") {
+		path = strings.Replace(path, "{hex}", fmt.Sprintf("%016x%016x", rnd.Uint64(), rnd.Uint64()), 1)
+	}
+
+	// Whole microseconds for %D, seconds with a fraction for timestamps
+	duration := seconds * durationName.Field().PerSecond
+	if durationName.Field().PerSecond > 1 {
+		duration = math.Round(duration)
+	}
+	line := fmt.Sprintf(`method="%s" status=%d path="%s" cache="%s" host="%s" time:%s`,
+		method, status, path, cache, req.Host, strconv.FormatFloat(duration, 'f', -1, 64))
+	if *beFirstByte {
+		line += fmt.Sprintf(" time_firstbyte:%f", seconds*0.8)
+	}
+	if *sizes {
+		line += fmt.Sprintf(" respsize:%d", int64(spread(float64(req.Size))))
+	}
+	return line + "\n"
+}
+
+// weight returns the weight of r, which is 1 if not set.
+func weight(r generatorRequest) float64 {
+	if r.Weight == 0 {
+		return 1
+	}
+	return r.Weight
+}
+
+// runDevServer implements the "devserver" command, which is the exporter
+// fed with generated traffic, for developing path mappings and dashboards
+// without a Varnish. It takes the same flags as serve, and uses the
+// built-in request mix unless -input.synthetic names another.
+func runDevServer(args []string) int {
+	if *inputSynth == "" {
+		*inputSynth = "default"
+	}
+	return runServe(args)
+}
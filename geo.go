@@ -0,0 +1,197 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// geoFormat returns the varnishncsa field with the client IP. That is
+// client.ip, which Varnish takes from the PROXY protocol header when
+// there is one, unless a header such as X-Forwarded-For is given.
+func geoFormat(header string) string {
+	if header != "" {
+		return `_client_ip="%{` + header + `}i"`
+	}
+	return `_client_ip="%h"`
+}
+
+var (
+	geoCountryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "requests_by_country_total"),
+		"Number of requests by the ISO country code of the client IP.",
+		[]string{"country"}, nil,
+	)
+	geoASNDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "requests_by_asn_total"),
+		"Number of requests from each of the autonomous systems with the most requests.",
+		[]string{"asn", "as_org"}, nil,
+	)
+)
+
+type geoCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type geoASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type geoASNCount struct {
+	org   string
+	count uint64
+}
+
+// geoSink counts requests by the country and autonomous system of the
+// client, looked up in MaxMind DB files such as GeoLite2-Country and
+// GeoLite2-ASN, to see DDoS attacks and traffic shifts. Countries are few
+// enough to export all of them. Of the autonomous systems, only the top
+// most requesting are exported, counted like the surrogate keys.
+type geoSink struct {
+	countries *maxminddb.Reader
+	asns      *maxminddb.Reader
+	top       int
+
+	mu            sync.Mutex
+	countryCounts map[string]uint64
+	asnCounts     map[uint]*geoASNCount
+}
+
+func newGeoSink(countryDB, asnDB string, top int) (*geoSink, error) {
+	s := &geoSink{
+		top:           top,
+		countryCounts: make(map[string]uint64),
+		asnCounts:     make(map[uint]*geoASNCount, top*surrogateKeyTrackFactor),
+	}
+	var err error
+	if countryDB != "" {
+		if s.countries, err = maxminddb.Open(countryDB); err != nil {
+			return nil, err
+		}
+	}
+	if asnDB != "" {
+		if s.asns, err = maxminddb.Open(asnDB); err != nil {
+			return nil, err
+		}
+	}
+	if err := prometheus.Register(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *geoSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	ip := clientIP(labels.Extra["_client_ip"])
+	country := "unknown"
+	var asn geoASNRecord
+	if ip != nil {
+		if s.countries != nil {
+			var record geoCountryRecord
+			if err := s.countries.Lookup(ip, &record); err == nil && record.Country.ISOCode != "" {
+				country = record.Country.ISOCode
+			}
+		}
+		if s.asns != nil {
+			_ = s.asns.Lookup(ip, &asn)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.countries != nil {
+		s.countryCounts[country]++
+	}
+	if s.asns != nil {
+		c := s.asnCounts[asn.Number]
+		if c == nil {
+			c = s.evict()
+			s.asnCounts[asn.Number] = c
+		}
+		c.org = asn.Organization
+		c.count++
+	}
+}
+
+// clientIP parses the client IP field, taking the first, original client
+// address if it is a list from X-Forwarded-For.
+func clientIP(field string) net.IP {
+	if i := strings.IndexByte(field, ','); i >= 0 {
+		field = field[:i]
+	}
+	return net.ParseIP(strings.TrimSpace(field))
+}
+
+// evict returns the count for a new autonomous system, taking over the
+// count of the one with the fewest requests if the table is full.
+func (s *geoSink) evict() *geoASNCount {
+	if len(s.asnCounts) < s.top*surrogateKeyTrackFactor {
+		return &geoASNCount{}
+	}
+	var minASN uint
+	var min *geoASNCount
+	for asn, c := range s.asnCounts {
+		if min == nil || c.count < min.count {
+			minASN, min = asn, c
+		}
+	}
+	delete(s.asnCounts, minASN)
+	return min
+}
+
+// Describe implements prometheus.Collector.
+func (s *geoSink) Describe(ch chan<- *prometheus.Desc) {
+	ch <- geoCountryDesc
+	ch <- geoASNDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *geoSink) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for country, count := range s.countryCounts {
+		ch <- prometheus.MustNewConstMetric(geoCountryDesc, prometheus.CounterValue, float64(count), country)
+	}
+	asns := make([]uint, 0, len(s.asnCounts))
+	for asn := range s.asnCounts {
+		asns = append(asns, asn)
+	}
+	sort.Slice(asns, func(i, j int) bool {
+		return s.asnCounts[asns[i]].count > s.asnCounts[asns[j]].count
+	})
+	if len(asns) > s.top {
+		asns = asns[:s.top]
+	}
+	for _, asn := range asns {
+		c := s.asnCounts[asn]
+		label := "unknown"
+		if asn != 0 {
+			label = strconv.FormatUint(uint64(asn), 10)
+		}
+		ch <- prometheus.MustNewConstMetric(geoASNDesc, prometheus.CounterValue, float64(c.count), label, c.org)
+	}
+}
@@ -4,10 +4,16 @@ go 1.13
 
 require (
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
-	github.com/facebookgo/atomicfile v0.0.0-20151019160806-2de1f203e7d5 // indirect
+	github.com/facebookgo/atomicfile v0.0.0-20151019160806-2de1f203e7d5
 	github.com/facebookgo/pidfile v0.0.0-20150612191647-f242e2999868
+	github.com/golang/protobuf v1.3.2
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
-	github.com/prometheus/client_golang v1.3.0
-	github.com/prometheus/common v0.7.0
-	golang.org/x/sys v0.0.0-20191228213918-04cbcbbfeed8 // indirect
+	github.com/oschwald/maxminddb-golang v1.6.0
+	github.com/prometheus/client_golang v1.4.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.9.1
+	github.com/prometheus/procfs v0.0.8
+	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82
+	google.golang.org/grpc v1.26.0
+	gopkg.in/yaml.v2 v2.2.5
 )
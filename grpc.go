@@ -0,0 +1,99 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+
+	"github.com/stigsb/varnishncsa_exporter/api"
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+)
+
+// grpcServer implements api.ExporterServer on top of liveStats.
+type grpcServer struct {
+	stats  *liveStats
+	mapper *mappings.PathMapper
+}
+
+func (s *grpcServer) GetTopPaths(ctx context.Context, req *api.GetTopPathsRequest) (*api.GetTopPathsResponse, error) {
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = 10
+	}
+	keys, totals := s.stats.TopPaths(limit, req.GetHost())
+	resp := &api.GetTopPathsResponse{Paths: make([]*api.PathStats, len(keys))}
+	for i, key := range keys {
+		ps := &api.PathStats{
+			Host:     key.Host,
+			Path:     key.Path,
+			Requests: totals[i].Requests,
+			Errors:   totals[i].Errors,
+		}
+		if totals[i].Requests > 0 {
+			ps.AvgTimeSeconds = totals[i].Time / float64(totals[i].Requests)
+		}
+		resp.Paths[i] = ps
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetRates(ctx context.Context, req *api.GetRatesRequest) (*api.GetRatesResponse, error) {
+	window := int(req.GetWindowSeconds())
+	if window <= 0 {
+		window = defaultRateWindow
+	} else if window > rateWindow {
+		window = rateWindow
+	}
+	requests, errors, hitRatio, total := s.stats.Rates(window)
+	return &api.GetRatesResponse{
+		WindowSeconds:     int32(window),
+		RequestsPerSecond: requests,
+		ErrorsPerSecond:   errors,
+		HitRatio:          hitRatio,
+		TotalRequests:     total,
+	}, nil
+}
+
+func (s *grpcServer) GetConfig(ctx context.Context, req *api.GetConfigRequest) (*api.GetConfigResponse, error) {
+	resp := &api.GetConfigResponse{
+		Instance:         *instance,
+		PathMappingsFile: *mappingsFile,
+		PathMappings:     int32(len(s.mapper.RuleStrings())),
+		InputFile:        *inputFile,
+	}
+	if *inputFile == "" {
+		resp.VslQuery = buildVslQuery()
+		resp.VarnishncsaArgs = buildVarnishNCSAArgs(resp.VslQuery, buildVarnishNCSAFormat())
+	}
+	return resp, nil
+}
+
+// startGRPCServer serves the Exporter gRPC API on listenAddress.
+func startGRPCServer(listenAddress string, stats *liveStats, mapper *mappings.PathMapper) {
+	lis, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := grpc.NewServer()
+	api.RegisterExporterServer(server, &grpcServer{stats: stats, mapper: mapper})
+	go func() {
+		log.Infof("Starting gRPC Server: %s", listenAddress)
+		log.Fatal(server.Serve(lis))
+	}()
+}
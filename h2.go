@@ -0,0 +1,121 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// The varnishncsa fields needed for HTTP/2 metrics. Begin[2] is the vxid of
+// the session, that is the client connection, the request arrived on.
+const h2Format = `_proto="%H" _sess="%{VSL:Begin[2]}x"`
+
+// Varnish 7.2 and later log a Reset timestamp for streams the client reset.
+const h2ResetFormat = `_ts_reset="%{VSL:Timestamp:Reset[1]}x"`
+
+// h2SessionIdle is how long a connection must have been without new streams
+// before it is considered closed and its stream count is observed.
+const h2SessionIdle = time.Minute
+
+type h2Session struct {
+	streams int
+	last    time.Time
+}
+
+// h2Sink exports stream counts per HTTP/2 connection and stream resets.
+// Connections are identified by their session vxid; as varnishncsa does
+// not see connections close, a connection counts as closed when no new
+// stream has arrived on it for h2SessionIdle.
+type h2Sink struct {
+	streams     prometheus.Histogram
+	resets      *prometheus.CounterVec
+	connections prometheus.Gauge
+
+	mu       sync.Mutex
+	sessions map[string]*h2Session
+}
+
+func newH2Sink() (*h2Sink, error) {
+	s := &h2Sink{
+		streams: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "h2_streams_per_connection",
+			Help:      "Number of HTTP/2 streams seen per client connection.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		resets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "h2_resets_total",
+			Help:      "Number of HTTP/2 streams reset by the client.",
+		}, []string{"host"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "h2_connections",
+			Help:      "Number of HTTP/2 client connections with recent streams.",
+		}),
+		sessions: make(map[string]*h2Session),
+	}
+	for _, c := range []prometheus.Collector{s.streams, s.resets, s.connections} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	go s.expire()
+	return s, nil
+}
+
+// Record implements sink.
+func (s *h2Sink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	if labels.Extra["_proto"] != "HTTP/2.0" {
+		return
+	}
+	if reset := labels.Extra["_ts_reset"]; reset != "" && reset != "-" {
+		s.resets.WithLabelValues(labels.Value("host")).Inc()
+	}
+	id := labels.Extra["_sess"]
+	if id == "" || id == "-" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		sess = &h2Session{}
+		s.sessions[id] = sess
+		s.connections.Inc()
+	}
+	sess.streams++
+	sess.last = time.Now()
+}
+
+func (s *h2Sink) expire() {
+	for now := range time.Tick(h2SessionIdle / 4) {
+		s.mu.Lock()
+		for id, sess := range s.sessions {
+			if now.Sub(sess.last) < h2SessionIdle {
+				continue
+			}
+			s.streams.Observe(float64(sess.streams))
+			s.connections.Dec()
+			delete(s.sessions, id)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// heartbeat pings a dead man's switch URL, healthchecks.io style, at every
+// interval in which log lines were received. If the exporter hangs, or
+// varnishncsa stops producing output, the pings stop and the external
+// service alerts, even though Prometheus can still scrape the exporter.
+func heartbeat(url string, interval time.Duration, messages func() int64) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	last := messages()
+	flowing := true
+	for range time.Tick(interval) {
+		current := messages()
+		if current == last {
+			if flowing {
+				log.Warnf("no log lines in the last %v, pausing heartbeat", interval)
+				flowing = false
+			}
+			continue
+		}
+		if !flowing {
+			log.Infof("log lines are flowing again, resuming heartbeat")
+			flowing = true
+		}
+		last = current
+		if err := ping(client, url); err != nil {
+			log.Errorf("heartbeat: %v", err)
+		}
+	}
+}
+
+func ping(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// heatmapSlot is the length of the time slots of the heatmap.
+const heatmapSlot = time.Minute
+
+// heatmapBuckets are the upper bounds of the latency buckets of the
+// heatmap, the same as those of the request time histograms. A last
+// bucket holds slower requests.
+var heatmapBuckets = prometheus.DefBuckets
+
+// heatmapSink counts requests per minute and request time bucket over a
+// sliding window, for operators who want a latency heatmap without a
+// Prometheus server that keeps the histograms long enough.
+type heatmapSink struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	slots map[int64]map[string][]uint64 // slot start -> host -> counts
+}
+
+func newHeatmapSink(window time.Duration) *heatmapSink {
+	return &heatmapSink{
+		window: window,
+		slots:  make(map[int64]map[string][]uint64),
+	}
+}
+
+// Record implements sink.
+func (s *heatmapSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	for _, m := range metrics {
+		if m.Name != "time" {
+			continue
+		}
+		now := time.Now()
+		slot := now.Truncate(heatmapSlot).Unix()
+		bucket := sort.SearchFloat64s(heatmapBuckets, m.Value)
+		host := labels.Value("host")
+		s.mu.Lock()
+		hosts, ok := s.slots[slot]
+		if !ok {
+			hosts = make(map[string][]uint64)
+			s.slots[slot] = hosts
+			s.expire(now)
+		}
+		counts, ok := hosts[host]
+		if !ok {
+			counts = make([]uint64, len(heatmapBuckets)+1)
+			hosts[host] = counts
+		}
+		counts[bucket]++
+		s.mu.Unlock()
+	}
+}
+
+// expire drops the slots that have left the window. s.mu must be held.
+func (s *heatmapSink) expire(now time.Time) {
+	oldest := now.Add(-s.window).Truncate(heatmapSlot).Unix()
+	for slot := range s.slots {
+		if slot < oldest {
+			delete(s.slots, slot)
+		}
+	}
+}
+
+// heatmapSeries is a time series in the format of Grafana's JSON data
+// source: datapoints are [value, unix milliseconds] pairs.
+type heatmapSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// ServeHTTP serves the heatmap as one time series per latency bucket,
+// named by the bucket's upper bound in seconds, with the number of
+// requests in each minute of the window. The host query parameter limits
+// it to one host.
+func (s *heatmapSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	now := time.Now()
+	first := now.Add(-s.window).Truncate(heatmapSlot)
+
+	series := make([]heatmapSeries, len(heatmapBuckets)+1)
+	for i := range series {
+		if i < len(heatmapBuckets) {
+			series[i].Target = strconv.FormatFloat(heatmapBuckets[i], 'g', -1, 64)
+		} else {
+			series[i].Target = "+Inf"
+		}
+		series[i].Datapoints = make([][2]float64, 0)
+	}
+	s.mu.Lock()
+	for t := first; !t.After(now); t = t.Add(heatmapSlot) {
+		counts := make([]uint64, len(series))
+		for h, c := range s.slots[t.Unix()] {
+			if host != "" && h != host {
+				continue
+			}
+			for i := range c {
+				counts[i] += c[i]
+			}
+		}
+		ms := float64(t.UnixNano() / int64(time.Millisecond))
+		for i := range series {
+			series[i].Datapoints = append(series[i].Datapoints, [2]float64{float64(counts[i]), ms})
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(series)
+}
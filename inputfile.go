@@ -0,0 +1,72 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/input"
+)
+
+// fileInput reads -input.file, following and pacing it as the flags say,
+// and can open it again where reading stopped after a read error.
+type fileInput struct {
+	name string
+	file *os.File
+}
+
+// openFileInput opens name and returns the reader to read lines from.
+func openFileInput(name string) (*fileInput, io.Reader, error) {
+	f := &fileInput{name: name}
+	r, err := f.open(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, r, nil
+}
+
+func (f *fileInput) open(offset int64) (io.Reader, error) {
+	file, err := os.Open(f.name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	f.file = file
+	var r io.Reader = file
+	if *inputFollow {
+		r = input.NewFollowReader(file, time.Second)
+	}
+	if *replaySpeed > 0 {
+		r = input.NewPacedReader(r, *replaySpeed)
+	}
+	return r, nil
+}
+
+// Reopen opens the file again at the offset reading had reached. A line
+// the error cut in two counts as two parse failures, and with
+// -input.replay-speed, the lines read ahead of the pace are skipped.
+func (f *fileInput) Reopen() (io.Reader, error) {
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	_ = f.file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return f.open(offset)
+}
@@ -0,0 +1,71 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const instanceLabelName = "varnish_instance"
+
+// instanceLabelValue returns the value of the varnish_instance label: the
+// -varnish.instance name, or with -metrics.instance-label the host name
+// varnishd defaults to. It returns "" if there should be no such label.
+func instanceLabelValue() (string, error) {
+	if *instance != "" {
+		return filepath.Base(*instance), nil
+	}
+	if *instanceLabel {
+		return os.Hostname()
+	}
+	return "", nil
+}
+
+// instanceGatherer adds a constant varnish_instance label to all series,
+// so that series from several Varnish instances on one host can be told
+// apart without relabeling in the scrape config.
+type instanceGatherer struct {
+	gatherer prometheus.Gatherer
+	value    string
+}
+
+func (g *instanceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			addLabel(m, instanceLabelName, g.value)
+		}
+	}
+	return mfs, err
+}
+
+// addLabel adds a label to m, keeping the labels sorted by name, unless
+// m already has a label with that name.
+func addLabel(m *dto.Metric, name, value string) {
+	i := sort.Search(len(m.Label), func(i int) bool { return m.Label[i].GetName() >= name })
+	if i < len(m.Label) && m.Label[i].GetName() == name {
+		return
+	}
+	label := &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+	m.Label = append(m.Label, nil)
+	copy(m.Label[i+1:], m.Label[i:])
+	m.Label[i] = label
+}
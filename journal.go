@@ -0,0 +1,62 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/prometheus/common/log"
+)
+
+// buildJournalArgs returns the journalctl arguments for following the
+// messages a systemd unit logs from now on, without journald's metadata.
+func buildJournalArgs(unit string) []string {
+	return []string{"--unit", unit, "--follow", "--lines", "0", "--output", "cat", "--no-pager"}
+}
+
+// openJournal runs journalctl to follow the journal of a systemd unit
+// running varnishncsa, and returns its output. Reading fails with an
+// error if journalctl exits.
+func openJournal(unit string) (io.Reader, error) {
+	args := buildJournalArgs(unit)
+	log.Infof("Running command: journalctl %v", args)
+	cmd := exec.Command("journalctl", args...)
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		forwardStderr(stderr, "journalctl")
+		close(done)
+	}()
+	go func() {
+		// Wait closes stderr, so it must all be read first
+		<-done
+		err := cmd.Wait()
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		_ = w.CloseWithError(fmt.Errorf("journalctl --unit %s: %v", unit, err))
+	}()
+	return r, nil
+}
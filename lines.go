@@ -0,0 +1,62 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// lineSplitter splits input into lines like bufio.ScanLines, but skips
+// lines longer than max instead of stopping with bufio.ErrTooLong, which
+// would leave the rest of the input unread. A line that doesn't fit is
+// skipped rather than truncated, as a varnishncsa line cut short loses
+// the fields at its end, and with them the request's metrics.
+type lineSplitter struct {
+	max  int
+	long func()
+	// skipping is set while the rest of a long line is being read.
+	skipping bool
+}
+
+func (s *lineSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if s.skipping {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			s.skipping = false
+			return i + 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+	advance, token, err = bufio.ScanLines(data, atEOF)
+	if advance == 0 && token == nil && err == nil && len(data) >= s.max {
+		// The buffer is full without a newline in it
+		s.skipping = true
+		if s.long != nil {
+			s.long()
+		}
+		return len(data), nil, nil
+	}
+	return advance, token, err
+}
+
+// newLineScanner returns a scanner for the lines of r that skips lines
+// of max bytes or more, calling long for each.
+func newLineScanner(r io.Reader, max int, long func()) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, max)
+	scanner.Split((&lineSplitter{max: max, long: long}).split)
+	return scanner
+}
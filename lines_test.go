@@ -0,0 +1,53 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineScanner(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		input string
+		lines []string
+		long  int
+	}{
+		{"a\nb\n", []string{"a", "b"}, 0},
+		{"a\r\nb", []string{"a", "b"}, 0},
+		{"a\n" + long + "\nb\n", []string{"a", "b"}, 1},
+		{long + "\n" + long + "\n", nil, 2},
+		// A long line at the end of the input without a newline
+		{"a\n" + long, []string{"a"}, 1},
+		// Lines just under the limit are kept
+		{strings.Repeat("y", 15) + "\n", []string{strings.Repeat("y", 15)}, 0},
+	}
+	for _, test := range tests {
+		longLines := 0
+		scanner := newLineScanner(strings.NewReader(test.input), 16, func() { longLines++ })
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("scanning %q: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(lines, test.lines) || longLines != test.long {
+			t.Errorf("scanning %q gave %q and %d long lines, want %q and %d", test.input, lines, longLines, test.lines, test.long)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const lockFileName = "varnish_request_exporter.lock"
+
+// varnishWorkdir returns the working directory of the Varnish instance
+// varnishncsa attaches to, following the rules varnishd uses for -n.
+func varnishWorkdir() (string, error) {
+	name := *instance
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		name = hostname
+	}
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	return filepath.Join("/var/lib/varnish", name), nil
+}
+
+// lockInstance takes an exclusive lock on a file in dir, so that only one
+// exporter at a time reads from the Varnish instance. The lock is held
+// until the process exits.
+func lockInstance(dir string) error {
+	lockFile := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("another exporter is already attached to the Varnish instance in %s (holding %s); use -varnish.force to start anyway", dir, lockFile)
+		}
+		return err
+	}
+	// f is deliberately never closed, as that would release the lock
+	return nil
+}
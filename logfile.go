@@ -0,0 +1,105 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/sys/unix"
+)
+
+// logFileCheckInterval is how often the size of the log file is checked.
+const logFileCheckInterval = 10 * time.Second
+
+// logFile sends everything the process writes to stderr, which is where
+// the logger, child processes and the Go runtime write, to a file. The
+// file is written to directly, so nothing is lost if the process dies.
+type logFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+}
+
+// openLogFile redirects stderr to the file name. If maxSize is not zero,
+// the file is rotated once it grows beyond maxSize bytes, keeping maxFiles
+// old files as name.1, name.2 and so on. The file is also reopened on
+// SIGUSR1, for use with an external logrotate.
+func openLogFile(name string, maxSize int64, maxFiles int) (*logFile, error) {
+	l := &logFile{name: name, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	go l.watch()
+	return l, nil
+}
+
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return unix.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts a
+// new file.
+func (l *logFile) rotate() error {
+	for i := l.maxFiles; i > 0; i-- {
+		from := l.name
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.name, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", l.name, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.maxFiles == 0 {
+		if err := os.Remove(l.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.reopen()
+}
+
+func (l *logFile) watch() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	ticker := time.NewTicker(logFileCheckInterval)
+	for {
+		select {
+		case <-usr1:
+			if err := l.reopen(); err != nil {
+				log.Errorf("reopening %s: %v", l.name, err)
+			}
+		case <-ticker.C:
+			if l.maxSize == 0 {
+				continue
+			}
+			fi, err := os.Stderr.Stat()
+			if err != nil || fi.Size() < l.maxSize {
+				continue
+			}
+			if err := l.rotate(); err != nil {
+				log.Errorf("rotating %s: %v", l.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// logThrottle logs errors one by one until there are more than limit of
+// them in an interval. It then only logs a summary at the end of each
+// interval, until an interval passes with no more than limit errors, so
+// that a flood of bad log lines doesn't make logging the bottleneck.
+type logThrottle struct {
+	what     string
+	limit    int
+	interval time.Duration
+
+	mu         sync.Mutex
+	count      int
+	suppressed int
+	last       error
+	tripped    bool
+}
+
+// newLogThrottle returns a throttle for errors described as what, such as
+// "parse failures".
+func newLogThrottle(what string, limit int, interval time.Duration) *logThrottle {
+	t := &logThrottle{what: what, limit: limit, interval: interval}
+	go func() {
+		for range time.Tick(interval) {
+			t.summarize()
+		}
+	}()
+	return t
+}
+
+// Error logs err, unless the throttle has tripped.
+func (t *logThrottle) Error(err error) {
+	t.mu.Lock()
+	t.count++
+	if !t.tripped && t.count > t.limit {
+		t.tripped = true
+		log.Warnf("more than %d %s in %v, logging a summary every %v instead of each one", t.limit, t.what, t.interval, t.interval)
+	}
+	if t.tripped {
+		t.suppressed++
+		t.last = err
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+	log.Error(err)
+}
+
+func (t *logThrottle) summarize() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.suppressed > 0 {
+		log.Errorf("%d %s in the last %v not logged, the last one: %v", t.suppressed, t.what, t.interval, t.last)
+	}
+	if t.tripped && t.count <= t.limit {
+		t.tripped = false
+		log.Infof("%s are down to %d in %v, logging each one again", t.what, t.count, t.interval)
+	}
+	t.count, t.suppressed, t.last = 0, 0, nil
+}
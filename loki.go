@@ -0,0 +1,232 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+const (
+	lokiBatchSize     = 1000
+	lokiFlushInterval = 2 * time.Second
+)
+
+type lokiEntry struct {
+	labels lokiStreamLabels
+	ts     time.Time
+	line   string
+}
+
+// lokiStreamLabels are the labels that select a Loki stream. They are kept
+// to a few low-cardinality values, everything else goes in the log line.
+type lokiStreamLabels struct {
+	Host        string
+	StatusClass string
+	Cache       string
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+// lokiSink sends normalized access log lines to Loki.
+type lokiSink struct {
+	url          string
+	staticLabels map[string]string
+	client       *http.Client
+	entries      chan lokiEntry
+	sent         prometheus.Counter
+	dropped      prometheus.Counter
+	spool        *diskSpool
+}
+
+func newLokiSink(url string, staticLabels string) (*lokiSink, error) {
+	labels, err := parseLabelPairs(staticLabels)
+	if err != nil {
+		return nil, fmt.Errorf("-loki.labels: %v", err)
+	}
+	l := &lokiSink{
+		url:          url,
+		staticLabels: labels,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		entries:      make(chan lokiEntry, lokiBatchSize),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_loki_lines_sent",
+			Help:      "Number of log lines sent to Loki.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_loki_lines_dropped",
+			Help:      "Number of log lines dropped because Loki was slow or failing.",
+		}),
+	}
+	if err := prometheus.Register(l.sent); err != nil {
+		return nil, err
+	}
+	if err := prometheus.Register(l.dropped); err != nil {
+		return nil, err
+	}
+	if l.spool, err = openSpool("loki", l.post, l.sent, l.dropped); err != nil {
+		return nil, err
+	}
+	watchQueue("loki", func() (int, int) { return len(l.entries), cap(l.entries) })
+	go l.run()
+	return l, nil
+}
+
+// Record queues a logfmt line with all labels and metrics of the request.
+func (l *lokiSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	e := labels.Event(metrics)
+	status := e.Label("status")
+	statusClass := "unknown"
+	if len(status) == 3 {
+		statusClass = status[:1] + "xx"
+	}
+	var b strings.Builder
+	for i, name := range e.LabelNames() {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(e.Labels[name]))
+	}
+	for _, name := range e.ValueNames() {
+		fmt.Fprintf(&b, " %s=%s", name, strconv.FormatFloat(e.Values[name], 'g', -1, 64))
+	}
+	entry := lokiEntry{
+		labels: lokiStreamLabels{
+			Host:        e.Label("host"),
+			StatusClass: statusClass,
+			Cache:       e.Label("cache"),
+		},
+		ts:   e.Time,
+		line: b.String(),
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		l.dropped.Inc()
+	}
+}
+
+func (l *lokiSink) run() {
+	batch := make([]lokiEntry, 0, lokiBatchSize)
+	ticker := time.NewTicker(lokiFlushInterval)
+	for {
+		select {
+		case entry := <-l.entries:
+			batch = append(batch, entry)
+			if len(batch) < lokiBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		body, err := l.encode(batch)
+		if err == nil {
+			err = l.post(body)
+		}
+		if err != nil {
+			log.Errorf("could not send log lines to Loki: %v", err)
+			if !l.spool.Save(body, len(batch)) {
+				l.dropped.Add(float64(len(batch)))
+			}
+		} else {
+			l.sent.Add(float64(len(batch)))
+			l.spool.Resume()
+		}
+		batch = batch[:0]
+	}
+}
+
+// encode makes a push request of a batch of entries.
+func (l *lokiSink) encode(batch []lokiEntry) ([]byte, error) {
+	streams := make(map[lokiStreamLabels]*lokiStream)
+	req := lokiPushRequest{}
+	for _, entry := range batch {
+		stream, ok := streams[entry.labels]
+		if !ok {
+			stream = &lokiStream{Stream: map[string]string{
+				"host":         entry.labels.Host,
+				"status_class": entry.labels.StatusClass,
+				"cache":        entry.labels.Cache,
+			}}
+			for name, value := range l.staticLabels {
+				stream.Stream[name] = value
+			}
+			streams[entry.labels] = stream
+			req.Streams = append(req.Streams, stream)
+		}
+		ts := strconv.FormatInt(entry.ts.UnixNano(), 10)
+		stream.Values = append(stream.Values, [2]string{ts, entry.line})
+	}
+	return json.Marshal(req)
+}
+
+func (l *lokiSink) post(body []byte) error {
+	resp, err := l.client.Post(l.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", l.url, resp.Status)
+	}
+	return nil
+}
+
+// logfmtValue quotes s if needed to make it a valid logfmt value.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// parseLabelPairs parses a comma-separated list of name=value pairs.
+func parseLabelPairs(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
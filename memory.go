@@ -0,0 +1,157 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/procfs"
+)
+
+const (
+	// memoryCheckInterval is how often the memory watchdog reads the RSS.
+	memoryCheckInterval = 5 * time.Second
+	// memoryHighWater is the fraction of -runtime.memory-limit at which
+	// the watchdog starts expiring series.
+	memoryHighWater = 0.9
+	// expireFraction is the fraction of series expired at a time.
+	expireFraction = 0.1
+)
+
+// ballast is a heap allocation that is never used, only kept, so that the
+// garbage collector, which runs when the heap has grown by GOGC percent,
+// runs less often with a small live heap. Its pages are never touched, so
+// it takes no resident memory.
+var ballast []byte
+
+// setupRuntime applies the -runtime.gogc and -runtime.ballast flags.
+func setupRuntime(gcPercent int, ballastSize int64) {
+	if gcPercent != 0 {
+		old := debug.SetGCPercent(gcPercent)
+		log.Infof("GOGC set to %d (was %d)", gcPercent, old)
+	}
+	if ballastSize > 0 {
+		ballast = make([]byte, ballastSize)
+		log.Infof("Allocated a heap ballast of %d bytes", ballastSize)
+	}
+}
+
+// seriesTracker remembers when each histogram series was last observed, so
+// that the least recently used ones can be deleted to free memory.
+type seriesTracker struct {
+	mu     sync.Mutex
+	series map[*prometheus.HistogramVec]map[string]*trackedSeries
+
+	expired prometheus.Counter
+}
+
+type trackedSeries struct {
+	values   []string
+	lastSeen time.Time
+}
+
+func newSeriesTracker() (*seriesTracker, error) {
+	t := &seriesTracker{
+		series: make(map[*prometheus.HistogramVec]map[string]*trackedSeries),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_series_expired_total",
+			Help:      "Number of series deleted by the memory watchdog to keep the exporter within -runtime.memory-limit.",
+		}),
+	}
+	if err := prometheus.Register(t.expired); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Touch records that the series of vec with the given label values was
+// just observed.
+func (t *seriesTracker) Touch(vec *prometheus.HistogramVec, values []string) {
+	key := strings.Join(values, "\xff")
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byValues, ok := t.series[vec]
+	if !ok {
+		byValues = make(map[string]*trackedSeries)
+		t.series[vec] = byValues
+	}
+	if s, ok := byValues[key]; ok {
+		s.lastSeen = now
+		return
+	}
+	byValues[key] = &trackedSeries{values: append([]string(nil), values...), lastSeen: now}
+}
+
+// ExpireOldest deletes the given fraction of all series, least recently
+// observed first, and returns the number deleted.
+func (t *seriesTracker) ExpireOldest(fraction float64) int {
+	type candidate struct {
+		vec *prometheus.HistogramVec
+		key string
+		s   *trackedSeries
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var all []candidate
+	for vec, byValues := range t.series {
+		for key, s := range byValues {
+			all = append(all, candidate{vec, key, s})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].s.lastSeen.Before(all[j].s.lastSeen) })
+	n := int(float64(len(all))*fraction + 0.5)
+	if n == 0 && len(all) > 0 {
+		n = 1
+	}
+	for _, c := range all[:n] {
+		c.vec.DeleteLabelValues(c.s.values...)
+		delete(t.series[c.vec], c.key)
+	}
+	t.expired.Add(float64(n))
+	return n
+}
+
+// watchMemory expires the oldest series whenever the exporter's resident
+// memory comes close to limit bytes, rather than let it grow until it is
+// OOM-killed. It never returns.
+func watchMemory(limit int64, tracker *seriesTracker) {
+	proc, err := procfs.Self()
+	if err != nil {
+		log.Errorf("memory watchdog can't read memory usage: %v", err)
+		return
+	}
+	for range time.Tick(memoryCheckInterval) {
+		stat, err := proc.Stat()
+		if err != nil {
+			log.Errorf("memory watchdog can't read memory usage: %v", err)
+			continue
+		}
+		rss := int64(stat.ResidentMemory())
+		if float64(rss) < memoryHighWater*float64(limit) {
+			continue
+		}
+		n := tracker.ExpireOldest(expireFraction)
+		debug.FreeOSMemory()
+		log.Warnf("resident memory of %d bytes is close to -runtime.memory-limit, expired the %d least recently used series", rss, n)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jsonFamily is a metric family in the /metrics.json format.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is one series. Counters, gauges and untyped metrics have a
+// value; histograms and summaries have a count, a sum, and cumulative
+// bucket counts or quantiles, keyed by upper bound or quantile.
+type jsonMetric struct {
+	Labels    map[string]string  `json:"labels"`
+	Value     *float64           `json:"value,omitempty"`
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// jsonMetricsHandler serves the metrics of gatherer as JSON, for consumers
+// that don't speak the Prometheus formats, such as simple dashboards and
+// Nagios checks. Values that JSON can't represent, NaN and the
+// infinities, are left out. The name query parameter, which may be
+// repeated, limits the response to the named metric families.
+func jsonMetricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := gatherer.Gather()
+		if err != nil && len(mfs) == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names := make(map[string]bool)
+		for _, name := range r.URL.Query()["name"] {
+			names[name] = true
+		}
+		families := make([]jsonFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			if len(names) > 0 && !names[mf.GetName()] {
+				continue
+			}
+			families = append(families, toJSONFamily(mf))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(families)
+	})
+}
+
+func toJSONFamily(mf *dto.MetricFamily) jsonFamily {
+	f := jsonFamily{
+		Name:    mf.GetName(),
+		Help:    mf.GetHelp(),
+		Type:    strings.ToLower(mf.GetType().String()),
+		Metrics: make([]jsonMetric, 0, len(mf.Metric)),
+	}
+	for _, m := range mf.Metric {
+		jm := jsonMetric{Labels: make(map[string]string, len(m.Label))}
+		for _, l := range m.Label {
+			jm.Labels[l.GetName()] = l.GetValue()
+		}
+		switch {
+		case m.Counter != nil:
+			jm.Value = jsonFloat(m.Counter.GetValue())
+		case m.Gauge != nil:
+			jm.Value = jsonFloat(m.Gauge.GetValue())
+		case m.Untyped != nil:
+			jm.Value = jsonFloat(m.Untyped.GetValue())
+		case m.Histogram != nil:
+			jm.Count = m.Histogram.SampleCount
+			jm.Sum = jsonFloat(m.Histogram.GetSampleSum())
+			jm.Buckets = make(map[string]uint64, len(m.Histogram.Bucket)+1)
+			for _, b := range m.Histogram.Bucket {
+				jm.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = b.GetCumulativeCount()
+			}
+			jm.Buckets["+Inf"] = m.Histogram.GetSampleCount()
+		case m.Summary != nil:
+			jm.Count = m.Summary.SampleCount
+			jm.Sum = jsonFloat(m.Summary.GetSampleSum())
+			jm.Quantiles = make(map[string]float64, len(m.Summary.Quantile))
+			for _, q := range m.Summary.Quantile {
+				if v := q.GetValue(); !math.IsNaN(v) && !math.IsInf(v, 0) {
+					jm.Quantiles[strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)] = v
+				}
+			}
+		}
+		f.Metrics = append(f.Metrics, jm)
+	}
+	return f
+}
+
+// jsonFloat returns a pointer to v, or nil if JSON can't represent it.
+func jsonFloat(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
@@ -0,0 +1,105 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// normalizerCacheSize is the number of distinct requests whose answers are
+// remembered before the cache is cleared.
+const normalizerCacheSize = 10000
+
+// externalNormalizer hands each request to a co-process for rules that
+// regexps can't express. For every request it writes one line
+//
+//	host<TAB>method<TAB>path
+//
+// to the co-process' stdin, and reads back one line of tab-separated
+// name=value pairs with the new values of any labels to change, e.g.
+//
+//	path=/article/ID
+//
+// An empty line leaves the labels unchanged. Only existing labels can be
+// changed, as adding labels would change the dimensions of the metrics.
+type externalNormalizer struct {
+	process *coProcess
+	cache   map[string][][2]string
+}
+
+// newExternalNormalizer starts command, and waits up to timeout for each
+// of its answers.
+func newExternalNormalizer(command string, timeout time.Duration) (*externalNormalizer, error) {
+	n := &externalNormalizer{
+		process: &coProcess{name: "normalizer", command: command, timeout: timeout},
+		cache:   make(map[string][][2]string),
+	}
+	if err := n.process.start(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Normalize updates labels with the answer from the co-process. If the
+// co-process fails or doesn't answer in time, it is restarted for the next
+// request and the labels are left as they are.
+func (n *externalNormalizer) Normalize(labels *parser.Labelset) {
+	request := strings.Join([]string{labels.Value("host"), labels.Value("method"), labels.Value("path")}, "\t")
+	changes, ok := n.cache[request]
+	if !ok {
+		var err error
+		changes, err = n.ask(request)
+		if err != nil {
+			log.Errorf("normalizer: %v", err)
+			return
+		}
+		if len(n.cache) >= normalizerCacheSize {
+			n.cache = make(map[string][][2]string)
+		}
+		n.cache[request] = changes
+	}
+	for _, change := range changes {
+		for i := range labels.Names {
+			if labels.Names[i] == change[0] {
+				labels.Values[i] = change[1]
+			}
+		}
+	}
+}
+
+func (n *externalNormalizer) ask(request string) ([][2]string, error) {
+	answer, err := n.process.ask(request)
+	if err != nil {
+		return nil, err
+	}
+	var changes [][2]string
+	if answer == "" {
+		return changes, nil
+	}
+	for _, pair := range strings.Split(answer, "\t") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid answer %q, expected name=value pairs", answer)
+		}
+		changes = append(changes, [2]string{parts[0], parts[1]})
+	}
+	return changes, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// outlierCaptureTimeout is how long varnishlog may take to find and dump a
+// transaction.
+const outlierCaptureTimeout = 30 * time.Second
+
+// outlierCapture dumps the full VSL transaction of requests slower than a
+// threshold, by running varnishlog on the log still in shared memory, to
+// save operators from finding the transaction by hand.
+type outlierCapture struct {
+	threshold float64
+	dir       string
+	maxFiles  int
+	perMinute int
+
+	mu     sync.Mutex
+	minute int64
+	taken  int
+
+	queue    chan string
+	captured prometheus.Counter
+	skipped  prometheus.Counter
+}
+
+func newOutlierCapture(threshold time.Duration, dir string, perMinute, maxFiles int) (*outlierCapture, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	c := &outlierCapture{
+		threshold: threshold.Seconds(),
+		dir:       dir,
+		maxFiles:  maxFiles,
+		perMinute: perMinute,
+		queue:     make(chan string, perMinute),
+		captured: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_outliers_captured_total",
+			Help:      "Number of slow requests whose VSL transaction was dumped.",
+		}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_outliers_skipped_total",
+			Help:      "Number of slow requests not dumped because of the rate limit.",
+		}),
+	}
+	for _, m := range []prometheus.Collector{c.captured, c.skipped} {
+		if err := prometheus.Register(m); err != nil {
+			return nil, err
+		}
+	}
+	go c.run()
+	return c, nil
+}
+
+// Record implements sink.
+func (c *outlierCapture) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	vxid := labels.Extra["_vxid"]
+	if _, err := strconv.ParseUint(vxid, 10, 64); err != nil {
+		return
+	}
+	for _, m := range metrics {
+		if m.Name != "time" || m.Value < c.threshold {
+			continue
+		}
+		if c.allow() {
+			select {
+			case c.queue <- vxid:
+				return
+			default:
+			}
+		}
+		c.skipped.Inc()
+	}
+}
+
+// allow tells whether another capture fits in the rate limit.
+func (c *outlierCapture) allow() bool {
+	minute := time.Now().Unix() / 60
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if minute != c.minute {
+		c.minute, c.taken = minute, 0
+	}
+	if c.taken >= c.perMinute {
+		return false
+	}
+	c.taken++
+	return true
+}
+
+func (c *outlierCapture) run() {
+	for vxid := range c.queue {
+		if err := c.capture(vxid); err != nil {
+			log.Errorf("could not capture transaction %s: %v", vxid, err)
+			continue
+		}
+		c.captured.Inc()
+		c.prune()
+	}
+}
+
+// capture runs varnishlog over the shared memory log, grouped by request
+// so that backend and ESI transactions are included, and saves the output.
+func (c *outlierCapture) capture(vxid string) error {
+	args := []string{"-d", "-g", "request", "-q", "vxid == " + vxid}
+	if *instance != "" {
+		args = append(args, "-n", *instance)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outlierCaptureTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "varnishlog", args...).Output()
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("no longer in the shared memory log")
+	}
+	name := fmt.Sprintf("%s-%s.vsl", time.Now().UTC().Format("20060102T150405Z"), vxid)
+	return ioutil.WriteFile(filepath.Join(c.dir, name), out, 0640)
+}
+
+// prune removes the oldest dumps beyond maxFiles.
+func (c *outlierCapture) prune() {
+	if c.maxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.vsl"))
+	if err != nil || len(files) <= c.maxFiles {
+		return
+	}
+	// The names start with the capture time, so they sort oldest first
+	sort.Strings(files)
+	for _, f := range files[:len(files)-c.maxFiles] {
+		if err := os.Remove(f); err != nil {
+			log.Warnf("could not remove old outlier dump: %v", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pipelineObjectives are the quantiles of the pipeline stage summaries.
+var pipelineObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+var (
+	queueLengthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "exporter_queue_length"),
+		"Number of items waiting in each internal queue.",
+		[]string{"queue"}, nil,
+	)
+	queueCapacityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "exporter_queue_capacity"),
+		"Number of items each internal queue can hold.",
+		[]string{"queue"}, nil,
+	)
+)
+
+// queueCollector exports the fill level of the channels between the
+// stages of the pipeline: the log line queue in front of the parser, and
+// the queues in front of the sinks that send to other systems.
+type queueCollector struct {
+	mu     sync.Mutex
+	queues map[string]func() (int, int)
+}
+
+var pipelineQueues = &queueCollector{queues: make(map[string]func() (int, int))}
+
+var registerQueuesOnce sync.Once
+
+// watchQueue exports the length and capacity of the named queue, as
+// returned by lengthFunc.
+func watchQueue(name string, lengthFunc func() (int, int)) {
+	registerQueuesOnce.Do(func() {
+		prometheus.MustRegister(pipelineQueues)
+	})
+	pipelineQueues.mu.Lock()
+	pipelineQueues.queues[name] = lengthFunc
+	pipelineQueues.mu.Unlock()
+}
+
+// Describe implements prometheus.Collector.
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- queueCapacityDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.queues))
+	for name := range c.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		length, capacity := c.queues[name]()
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(length), name)
+		ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(capacity), name)
+	}
+}
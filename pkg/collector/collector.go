@@ -0,0 +1,247 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector records parsed requests in Prometheus histograms, one
+// per metric name.
+package collector
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// Collector creates histograms as requests with new metrics come along,
+// and registers them. The label names of each metric are fixed by
+// Declare, or else by the first request recorded in it, so that requests
+// whose labels come in another order, or that lack a label, go into the
+// same histogram instead of failing to register another one.
+type Collector struct {
+	namespace  string
+	registerer prometheus.Registerer
+	help       func(name string) string
+
+	mu         sync.Mutex
+	histograms map[string]*prometheus.HistogramVec
+	labelNames map[string][]string
+	warned     map[string]bool
+	rules      []BucketRule
+	overrides  map[string][]bucketOverride
+}
+
+// BucketRule gives the histograms of some metrics other buckets for the
+// requests whose labels match.
+type BucketRule struct {
+	// Metrics are the names of the metrics the rule applies to.
+	Metrics []string
+	// Labels are regexps that the values of the named labels must match.
+	// Labels a metric doesn't have match as empty values.
+	Labels map[string]*regexp.Regexp
+	// Buckets are the upper bounds of the buckets, in increasing order.
+	Buckets []float64
+}
+
+// bucketOverride is the histogram for the requests matching a rule.
+type bucketOverride struct {
+	rule *BucketRule
+	vec  *prometheus.HistogramVec
+}
+
+// histogramGroup exports a metric whose series are spread over histograms
+// with different buckets, but the same name and label names.
+type histogramGroup struct {
+	vec       *prometheus.HistogramVec
+	overrides []bucketOverride
+}
+
+// Describe implements prometheus.Collector.
+func (g *histogramGroup) Describe(ch chan<- *prometheus.Desc) {
+	g.vec.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (g *histogramGroup) Collect(ch chan<- prometheus.Metric) {
+	g.vec.Collect(ch)
+	for _, o := range g.overrides {
+		o.vec.Collect(ch)
+	}
+}
+
+// New creates a Collector that registers its histograms with registerer,
+// with names in namespace. help gives the help text of each metric.
+func New(namespace string, registerer prometheus.Registerer, help func(name string) string) *Collector {
+	return &Collector{
+		namespace:  namespace,
+		registerer: registerer,
+		help:       help,
+		histograms: make(map[string]*prometheus.HistogramVec),
+		labelNames: make(map[string][]string),
+		warned:     make(map[string]bool),
+		overrides:  make(map[string][]bucketOverride),
+	}
+}
+
+// SetBucketRules makes the histograms of requests matching a rule use its
+// buckets instead of the default ones. The first matching rule wins. It
+// must be called before the first request.
+func (c *Collector) SetBucketRules(rules []BucketRule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rules
+}
+
+// Declare fixes the label names of the named metric, before its first
+// request. Requests that lack some of these labels get empty values for
+// them. It has no effect once the metric has been recorded.
+func (c *Collector) Declare(name string, labelNames []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.histograms[name]; ok {
+		return
+	}
+	names := make([]string, 0, len(labelNames))
+	seen := make(map[string]bool, len(labelNames))
+	for _, n := range labelNames {
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	c.labelNames[name] = names
+}
+
+// Histogram returns the HistogramVec for the named metric, registering it
+// on first use with the declared label names, or else with the given
+// ones, in sorted order. Later calls return the same HistogramVec
+// whatever labelNames are. It returns nil if
+// the metric can't be registered, typically because something else
+// registered it with other label names.
+func (c *Collector) Histogram(name string, labelNames []string) *prometheus.HistogramVec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.histogram(name, labelNames)
+}
+
+func (c *Collector) histogram(name string, labelNames []string) *prometheus.HistogramVec {
+	if vec, ok := c.histograms[name]; ok {
+		return vec
+	}
+	names, ok := c.labelNames[name]
+	if !ok {
+		names = append([]string(nil), labelNames...)
+		sort.Strings(names)
+	}
+	opts := prometheus.HistogramOpts{
+		Namespace: c.namespace,
+		Name:      name,
+		Help:      c.help(name),
+	}
+	vec := prometheus.NewHistogramVec(opts, names)
+	var overrides []bucketOverride
+	for i := range c.rules {
+		if rule := &c.rules[i]; rule.appliesTo(name) {
+			opts.Buckets = rule.Buckets
+			overrides = append(overrides, bucketOverride{rule, prometheus.NewHistogramVec(opts, names)})
+		}
+	}
+	var registered prometheus.Collector = vec
+	if len(overrides) > 0 {
+		registered = &histogramGroup{vec, overrides}
+	}
+	if err := c.registerer.Register(registered); err != nil {
+		are, _ := err.(prometheus.AlreadyRegisteredError)
+		switch existing := are.ExistingCollector.(type) {
+		case *prometheus.HistogramVec:
+			vec, overrides = existing, nil
+		case *histogramGroup:
+			vec, overrides = existing.vec, existing.overrides
+		default:
+			log.Error(err)
+			vec, overrides = nil, nil
+		}
+	}
+	c.histograms[name] = vec
+	c.labelNames[name] = names
+	c.overrides[name] = overrides
+	return vec
+}
+
+func (r *BucketRule) appliesTo(name string) bool {
+	for _, m := range r.Metrics {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matches tells whether the series with the given label names and values
+// belongs to the rule. It only looks at the labels of the series, so
+// that a series always goes into the same histogram.
+func (r *BucketRule) matches(names, values []string) bool {
+	for n, re := range r.Labels {
+		value := ""
+		if i := sort.SearchStrings(names, n); i < len(names) && names[i] == n {
+			value = values[i]
+		}
+		if !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Series returns the HistogramVec for the named metric, as Histogram
+// does, or the one of the first bucket rule the labels match, and the
+// values of labels in the order of its label names. Labels
+// the metric doesn't have are left out, with a warning the first time,
+// and labels it has that are missing are empty.
+func (c *Collector) Series(name string, labels *parser.Labelset) (*prometheus.HistogramVec, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vec := c.histogram(name, labels.Names)
+	if vec == nil {
+		return nil, nil
+	}
+	names := c.labelNames[name]
+	values := make([]string, len(names))
+	for i, n := range names {
+		values[i] = labels.Value(n)
+	}
+	for _, n := range labels.Names {
+		if i := sort.SearchStrings(names, n); (i == len(names) || names[i] != n) && !c.warned[name+"\xff"+n] {
+			c.warned[name+"\xff"+n] = true
+			log.Warnf("label %s is not among the labels of %s_%s, leaving it out", n, c.namespace, name)
+		}
+	}
+	for _, o := range c.overrides[name] {
+		if o.rule.matches(names, values) {
+			return o.vec, values
+		}
+	}
+	return vec, values
+}
+
+// Observe records value in the histogram for the named metric.
+func (c *Collector) Observe(name string, labels *parser.Labelset, value float64) {
+	if vec, values := c.Series(name, labels); vec != nil {
+		vec.WithLabelValues(values...).Observe(value)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package input provides readers for feeding varnishncsa output from files
+// to the exporter, or to anything embedding its parser.
+package input
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// FollowReader keeps reading from a file that is being appended to,
+// like tail -f. It never returns io.EOF.
+type FollowReader struct {
+	r        io.Reader
+	interval time.Duration
+}
+
+// NewFollowReader reads from r, waiting interval before trying again
+// whenever it reaches the end.
+func NewFollowReader(r io.Reader, interval time.Duration) *FollowReader {
+	return &FollowReader{r: r, interval: interval}
+}
+
+func (f *FollowReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		time.Sleep(f.interval)
+	}
+}
+
+// PacedReader passes on one line at a time, at most one per interval, to
+// replay captured logs at a steady rate.
+type PacedReader struct {
+	r        *bufio.Reader
+	interval time.Duration
+	next     time.Time
+	line     []byte
+	err      error
+}
+
+// NewPacedReader reads lines from r at linesPerSecond.
+func NewPacedReader(r io.Reader, linesPerSecond float64) *PacedReader {
+	return &PacedReader{
+		r:        bufio.NewReader(r),
+		interval: time.Duration(float64(time.Second) / linesPerSecond),
+	}
+}
+
+func (p *PacedReader) Read(b []byte) (int, error) {
+	if len(p.line) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if wait := time.Until(p.next); wait > 0 {
+			time.Sleep(wait)
+		} else {
+			p.next = time.Now()
+		}
+		p.next = p.next.Add(p.interval)
+		p.line, p.err = p.r.ReadBytes('\n')
+		if len(p.line) == 0 {
+			return 0, p.err
+		}
+	}
+	n := copy(b, p.line)
+	p.line = p.line[n:]
+	return n, nil
+}
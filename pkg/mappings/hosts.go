@@ -0,0 +1,124 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// HostMapping is a single host mapping rule.
+type HostMapping struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// HostMapper normalizes Host: header values. Ports are stripped and names
+// lowercased, then the first matching host mapping, if any, replaces the
+// name.
+type HostMapper struct {
+	Rules []HostMapping
+
+	mu sync.RWMutex
+}
+
+// String returns the rule, with the pattern as a regexp.
+func (m HostMapping) String() string {
+	return m.Pattern.String() + " " + m.Replacement
+}
+
+// SetRules replaces the rules, as when reloading the mappings file.
+func (m *HostMapper) SetRules(rules []HostMapping) {
+	m.mu.Lock()
+	m.Rules = rules
+	m.mu.Unlock()
+}
+
+// RuleStrings returns the rules, with the patterns as regexps.
+func (m *HostMapper) RuleStrings() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := make([]string, len(m.Rules))
+	for i, mapping := range m.Rules {
+		rules[i] = mapping.String()
+	}
+	return rules
+}
+
+// Map returns the normalized form of host.
+func (m *HostMapper) Map(host string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, mapping := range m.Rules {
+		if mapping.Pattern.MatchString(host) {
+			return mapping.Replacement
+		}
+	}
+	return host
+}
+
+// HostPattern compiles a host name pattern, in which * matches any part of
+// a name, into a regexp matching whole, lowercased names.
+func HostPattern(pattern string) *regexp.Regexp {
+	quoted := strings.Replace(regexp.QuoteMeta(strings.ToLower(pattern)), "\\*", ".*", -1)
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+// LoadHosts loads host mappings from mappingsFile. Each line holds
+// a host name pattern, in which * matches any part of a name, and the name
+// to replace matching hosts with.
+func LoadHosts(mappingsFile string) (mapper *HostMapper, err error) {
+	mapper = &HostMapper{}
+	if mappingsFile == "" {
+		return
+	}
+	inFile, err := os.Open(mappingsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = inFile.Close() }()
+	scanner := bufio.NewScanner(inFile)
+	commentRegexp := regexp.MustCompile("(#.*|^\\s+|\\s+$)")
+	splitRegexp := regexp.MustCompile("\\s+")
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := commentRegexp.ReplaceAllString(scanner.Text(), "")
+		if line == "" {
+			continue
+		}
+		parts := splitRegexp.Split(line, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a host pattern and a replacement", mappingsFile, lineNo)
+		}
+		log.Debugf("host mapping: %s => %s", parts[0], parts[1])
+		mapper.Rules = append(mapper.Rules, HostMapping{
+			Pattern:     HostPattern(parts[0]),
+			Replacement: parts[1],
+		})
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,43 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import "testing"
+
+func TestHostMapperMap(t *testing.T) {
+	mapper := &HostMapper{}
+	mapper.SetRules([]HostMapping{
+		{Pattern: HostPattern("*.Example.com"), Replacement: "example.com"},
+		{Pattern: HostPattern("static?.cdn.net"), Replacement: "cdn"},
+	})
+	tests := []struct {
+		host, want string
+	}{
+		{"www.example.com", "example.com"},
+		{"WWW.EXAMPLE.COM.", "example.com"},
+		{"www.example.com:8080", "example.com"},
+		{"example.com", "example.com"},
+		{"other.org:443", "other.org"},
+		{"[::1]:8080", "[::1]"},
+		{"[::1]", "[::1]"},
+		// * is the only wildcard
+		{"static1.cdn.net", "static1.cdn.net"},
+	}
+	for _, test := range tests {
+		if got := mapper.Map(test.host); got != test.want {
+			t.Errorf("Map(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
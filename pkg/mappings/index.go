@@ -0,0 +1,116 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"unicode/utf8"
+)
+
+// ruleIndex finds the rules that can match a path without evaluating all
+// of them. Most rules are anchored at the start of the path and begin with
+// a literal prefix, like ^/api/v1/; those are kept in a trie of their
+// prefixes, so that a path is only matched against the ones whose prefix
+// it starts with, along with the rules that have no such prefix.
+type ruleIndex struct {
+	root trieNode
+	// unindexed are the rules without a literal prefix, in order.
+	unindexed []int
+	// rules is the number of rules the index was built for.
+	rules int
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	// rules are the rules whose prefix ends at this node, in order.
+	rules []int
+}
+
+func newRuleIndex(rules []*PathMapping) *ruleIndex {
+	x := &ruleIndex{rules: len(rules)}
+	for i, mapping := range rules {
+		prefix := anchoredPrefix(mapping.Pattern)
+		if prefix == "" {
+			x.unindexed = append(x.unindexed, i)
+			continue
+		}
+		node := &x.root
+		for j := 0; j < len(prefix); j++ {
+			child, ok := node.children[prefix[j]]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[byte]*trieNode)
+				}
+				child = &trieNode{}
+				node.children[prefix[j]] = child
+			}
+			node = child
+		}
+		node.rules = append(node.rules, i)
+	}
+	return x
+}
+
+// candidates returns the rules, from the one at index from on, that path
+// may match, in order.
+func (x *ruleIndex) candidates(path string, from int) []int {
+	var rules []int
+	node := &x.root
+	for i := 0; node != nil; i++ {
+		rules = appendFrom(rules, node.rules, from)
+		if i == len(path) {
+			break
+		}
+		node = node.children[path[i]]
+	}
+	rules = appendFrom(rules, x.unindexed, from)
+	sort.Ints(rules)
+	return rules
+}
+
+func appendFrom(dst, rules []int, from int) []int {
+	i := sort.SearchInts(rules, from)
+	return append(dst, rules[i:]...)
+}
+
+// anchoredPrefix returns the literal text every match of re starts with,
+// if re is anchored at the start of the text, or "" if it isn't or has no
+// such prefix. A case-insensitive literal ends the prefix, as does U+FFFD,
+// which regexp also matches against invalid UTF-8 in the path.
+func anchoredPrefix(re *regexp.Regexp) string {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	parsed = parsed.Simplify()
+	if parsed.Op != syntax.OpConcat || len(parsed.Sub) < 2 || parsed.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var prefix []rune
+	for _, sub := range parsed.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		for _, r := range sub.Rune {
+			if r == utf8.RuneError {
+				return string(prefix)
+			}
+			prefix = append(prefix, r)
+		}
+	}
+	return string(prefix)
+}
@@ -0,0 +1,78 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAnchoredPrefix(t *testing.T) {
+	tests := []struct {
+		pattern, want string
+	}{
+		{`^/api/v1/users/\d+`, "/api/v1/users/"},
+		{`^/static/.*\.js$`, "/static/"},
+		{`^/`, "/"},
+		{`/api/`, ""},
+		{`^/a|^/b`, ""},
+		{`^(/x)/y`, ""},
+		{`(?i)^/Case/`, ""},
+		{`^/API/(?i)x`, "/API/"},
+		{`(?m)^/line`, ""},
+		{`^/a\.b`, "/a.b"},
+	}
+	for _, test := range tests {
+		if got := anchoredPrefix(regexp.MustCompile(test.pattern)); got != test.want {
+			t.Errorf("anchoredPrefix(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+// TestIndexMatchesSequential checks that mapping with the prefix index
+// gives the same results as trying every rule in order.
+func TestIndexMatchesSequential(t *testing.T) {
+	patterns := []string{
+		`^/api/v1/users/\d+`, `^/api/`, `^/API/(?i)x`, `^/static/.*\.js$`, `\d+`,
+		`^/a(b|c)`, `^(/x)/y`, `^/api/v1/`, `/z$`, `^/r/`, `(?i)^/Case/`, `^/`,
+		`^/api/v2`, `^/renamed/`, `^/p/\w+`,
+	}
+	var rules []*PathMapping
+	for i, pattern := range patterns {
+		rules = append(rules, rule(pattern, "/r/"+string(rune('a'+i))))
+	}
+	rules[9].Replacement = "/renamed/"
+	rules[13].Drop = true
+	indexed := &PathMapper{}
+	indexed.SetRules(rules)
+	sequential := &PathMapper{Rules: rules}
+
+	parts := []string{"/api", "/v1", "/v2", "/users", "/123", "/static", "/x", "/y", "/ab",
+		"/z", "/r", "/Case", "/case", "/p", "/API", "/a.js"}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		var path strings.Builder
+		for n := random.Intn(5); n >= 0; n-- {
+			path.WriteString(parts[random.Intn(len(parts))])
+		}
+		got, gotDrop := indexed.Map(path.String())
+		want, wantDrop := sequential.Map(path.String())
+		if got != want || gotDrop != wantDrop {
+			t.Fatalf("Map(%q) = %q, %v with the index, %q, %v without", path.String(), got, gotDrop, want, wantDrop)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mappings normalizes the paths and host names of requests, so that
+// they make usable metric labels.
+package mappings
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// PathMapping is a single path mapping rule.
+type PathMapping struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	// Drop makes requests whose path matches Pattern be ignored entirely.
+	Drop bool
+	// Hash makes the match, or its first group if Pattern has one, be
+	// replaced with a short keyed hash of it instead of Replacement.
+	Hash bool
+	// Source is the file and line the rule was read from.
+	Source string
+	hits   uint64
+	// evals and evalNanos are the number of timed evaluations and the
+	// time they took.
+	evals     uint64
+	evalNanos uint64
+	// warned is when an evaluation taking too long was last logged, in
+	// unix nanoseconds.
+	warned int64
+}
+
+// String returns the rule as it would be written in a mappings file.
+func (m *PathMapping) String() string {
+	switch {
+	case m.Drop:
+		return "!" + m.Pattern.String()
+	case m.Hash:
+		return "~" + m.Pattern.String()
+	case m.Replacement == "":
+		return m.Pattern.String()
+	}
+	return m.Pattern.String() + " " + m.Replacement
+}
+
+// PathMapper normalizes paths with an ordered list of mapping rules.
+type PathMapper struct {
+	Rules []*PathMapping
+	// Unmatched, if set, samples the paths that matched no rule.
+	Unmatched *Sampler
+	// MaxEvalTime, if set, is the time a rule may take to evaluate
+	// before it is logged as expensive.
+	MaxEvalTime time.Duration
+	// HashKey is the secret key hash rules hash with. Without it the
+	// hashes could be reversed by hashing every likely value.
+	HashKey []byte
+
+	mu       sync.RWMutex
+	index    *ruleIndex
+	calls    uint64
+	mapNanos uint64
+}
+
+// SetRules replaces the rules, as when reloading the mappings file.
+func (m *PathMapper) SetRules(rules []*PathMapping) {
+	index := newRuleIndex(rules)
+	m.mu.Lock()
+	m.Rules = rules
+	m.index = index
+	m.mu.Unlock()
+}
+
+// RuleStrings returns the rules as they would be written in a mappings file.
+func (m *PathMapper) RuleStrings() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := make([]string, len(m.Rules))
+	for i, mapping := range m.Rules {
+		rules[i] = mapping.String()
+	}
+	return rules
+}
+
+// evalSampling is how many paths there are to each one whose rule
+// evaluations are timed, since timing each of hundreds of rules for every
+// path would cost more than some of the rules do.
+const evalSampling = 16
+
+// Map applies all rules to path. It returns drop = true if a drop rule
+// matched, in which case the request should not be recorded.
+func (m *PathMapper) Map(path string) (mapped string, drop bool) {
+	start := time.Now()
+	m.mu.RLock()
+	defer func() {
+		m.mu.RUnlock()
+		atomic.AddUint64(&m.mapNanos, uint64(time.Since(start)))
+	}()
+	timed := atomic.AddUint64(&m.calls, 1)%evalSampling == 0
+	matched := false
+	candidates := m.candidates(path, 0)
+	for i := 0; i < len(candidates); i++ {
+		mapping := m.Rules[candidates[i]]
+		var evalStart time.Time
+		if timed {
+			evalStart = time.Now()
+		}
+		ok := mapping.Pattern.MatchString(path)
+		if ok {
+			matched = true
+			atomic.AddUint64(&mapping.hits, 1)
+			if mapping.Drop {
+				log.Debugf("dropping '%s', matched '%v'", path, mapping.Pattern)
+			} else if mapping.Hash {
+				path = hashMatches(m.HashKey, mapping.Pattern, path)
+			} else {
+				log.Debugf("replacing '%v' with '%s' in '%s'\n", mapping.Pattern, mapping.Replacement, path)
+				path = mapping.Pattern.ReplaceAllString(path, mapping.Replacement)
+			}
+		}
+		if timed {
+			m.timeEval(mapping, time.Since(evalStart))
+		}
+		if ok && mapping.Drop {
+			return path, true
+		}
+		if ok && m.index != nil {
+			// The rule may have changed the prefix the rest are indexed by
+			candidates = append(candidates[:i+1], m.candidates(path, candidates[i]+1)...)
+		}
+	}
+	if !matched && m.Unmatched != nil {
+		m.Unmatched.Add(path)
+	}
+	return path, false
+}
+
+// candidates returns the rules, from the one at index from on, that path
+// may match. Without an index for the current rules, which is the case if
+// Rules was set directly, that is all of them.
+func (m *PathMapper) candidates(path string, from int) []int {
+	if m.index != nil && m.index.rules == len(m.Rules) {
+		return m.index.candidates(path, from)
+	}
+	rules := make([]int, 0, len(m.Rules)-from)
+	for i := from; i < len(m.Rules); i++ {
+		rules = append(rules, i)
+	}
+	return rules
+}
+
+// timeEval records the time a rule took to evaluate, and logs it if it
+// is more than MaxEvalTime, at most once a minute per rule. The path is
+// not logged, as it may hold sensitive data.
+func (m *PathMapper) timeEval(mapping *PathMapping, took time.Duration) {
+	atomic.AddUint64(&mapping.evals, 1)
+	atomic.AddUint64(&mapping.evalNanos, uint64(took))
+	if m.MaxEvalTime <= 0 || took <= m.MaxEvalTime {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&mapping.warned)
+	if now-last < int64(time.Minute) || !atomic.CompareAndSwapInt64(&mapping.warned, last, now) {
+		return
+	}
+	log.Warnf("path mapping rule %s (%s) took %v to evaluate, more than -mappings.max-eval-time", mapping.Source, mapping.Pattern, took)
+}
+
+// HasHashRules tells whether any of the rules is a hash rule.
+func (m *PathMapper) HasHashRules() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, mapping := range m.Rules {
+		if mapping.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+// hashMatches replaces every match of pattern in path, or the first group
+// of the match if pattern has groups, with its pathHash.
+func hashMatches(key []byte, pattern *regexp.Regexp, path string) string {
+	group := 0
+	if pattern.NumSubexp() > 0 {
+		group = 1
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range pattern.FindAllStringSubmatchIndex(path, -1) {
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(path[last:start])
+		b.WriteString(pathHash(key, path[start:end]))
+		last = end
+	}
+	b.WriteString(path[last:])
+	return b.String()
+}
+
+// pathHashLength is the number of hex digits of a pathHash, enough for
+// millions of distinct values to get distinct hashes.
+const pathHashLength = 16
+
+// pathHash returns a short HMAC-SHA256 of s. It stays the same across
+// restarts and hosts with the same key, so that hashed labels can be
+// compared over time, but can't be reversed without the key.
+func pathHash(key []byte, s string) string {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:pathHashLength]
+}
+
+// namespace is the exporter's metric namespace.
+const namespace = "varnish_request"
+
+var (
+	mappingHitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "exporter_mapping_hits_total"),
+		"Number of paths each path mapping rule matched.",
+		[]string{"rule", "pattern"}, nil,
+	)
+	mappingEvalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "exporter_mapping_eval_seconds"),
+		"Time each path mapping rule took to evaluate, for a sample of one in 16 paths.",
+		[]string{"rule", "pattern"}, nil,
+	)
+	mappingTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "exporter_path_mapping_seconds"),
+		"Time normalizing paths with the path mappings took.",
+		nil, nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (m *PathMapper) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mappingHitsDesc
+	ch <- mappingEvalDesc
+	ch <- mappingTimeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (m *PathMapper) Collect(ch chan<- prometheus.Metric) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, mapping := range m.Rules {
+		ch <- prometheus.MustNewConstMetric(mappingHitsDesc, prometheus.CounterValue,
+			float64(atomic.LoadUint64(&mapping.hits)), mapping.Source, mapping.Pattern.String())
+		ch <- prometheus.MustNewConstSummary(mappingEvalDesc, atomic.LoadUint64(&mapping.evals),
+			time.Duration(atomic.LoadUint64(&mapping.evalNanos)).Seconds(), nil, mapping.Source, mapping.Pattern.String())
+	}
+	ch <- prometheus.MustNewConstSummary(mappingTimeDesc, atomic.LoadUint64(&m.calls),
+		time.Duration(atomic.LoadUint64(&m.mapNanos)).Seconds(), nil)
+}
+
+// LoadPaths loads path mappings from mappingsFile. If mappingsFile is
+// a directory, all *.map files in it are loaded in lexical order, so that
+// separate teams can own separate mapping files.
+func LoadPaths(mappingsFile string) (mapper *PathMapper, err error) {
+	mapper = &PathMapper{Rules: make([]*PathMapping, 0)}
+	if mappingsFile == "" {
+		return
+	}
+	fi, err := os.Stat(mappingsFile)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{mappingsFile}
+	if fi.IsDir() {
+		files, err = filepath.Glob(filepath.Join(mappingsFile, "*.map"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+	for _, file := range files {
+		rules, err := parseMappingsFile(file)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("loaded %d mappings from %s", len(rules), file)
+		mapper.Rules = append(mapper.Rules, rules...)
+	}
+	mapper.index = newRuleIndex(mapper.Rules)
+	return
+}
+
+func parseMappingsFile(mappingsFile string) (rules []*PathMapping, err error) {
+	rules = make([]*PathMapping, 0)
+	inFile, err := os.Open(mappingsFile)
+	if err != nil {
+		return
+	}
+	defer func() { _ = inFile.Close() }()
+	scanner := bufio.NewScanner(inFile)
+	scanner.Split(bufio.ScanLines)
+	commentRegexp := regexp.MustCompile("(#.*|^\\s+|\\s+$)")
+	splitRegexp := regexp.MustCompile("\\s+")
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := commentRegexp.ReplaceAllString(scanner.Text(), "")
+		if line == "" {
+			continue
+		}
+		parts := splitRegexp.Split(line, 2)
+		source := fmt.Sprintf("%s:%d", mappingsFile, lineNo)
+		expr := parts[0]
+		drop := strings.HasPrefix(expr, "!")
+		hash := strings.HasPrefix(expr, "~")
+		if drop || hash {
+			expr = expr[1:]
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		switch {
+		case drop && len(parts) == 2:
+			return nil, fmt.Errorf("%s: drop rules take no replacement", source)
+		case hash && len(parts) == 2:
+			return nil, fmt.Errorf("%s: hash rules take no replacement", source)
+		case hash:
+			log.Debugf("mapping hash: %s", parts[0])
+			rules = append(rules, &PathMapping{Pattern: pattern, Hash: true, Source: source})
+		case drop:
+			log.Debugf("mapping drop: %s", parts[0])
+			rules = append(rules, &PathMapping{Pattern: pattern, Drop: true, Source: source})
+		case len(parts) == 1:
+			log.Debugf("mapping strip: %s", parts[0])
+			rules = append(rules, &PathMapping{Pattern: pattern, Source: source})
+		default:
+			log.Debugf("mapping replace: %s => %s", parts[0], parts[1])
+			rules = append(rules, &PathMapping{Pattern: pattern, Replacement: parts[1], Source: source})
+		}
+	}
+	err = scanner.Err()
+	return
+}
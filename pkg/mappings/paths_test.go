@@ -0,0 +1,95 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"regexp"
+	"testing"
+)
+
+func rule(pattern, replacement string) *PathMapping {
+	return &PathMapping{Pattern: regexp.MustCompile(pattern), Replacement: replacement}
+}
+
+var testKey = []byte("test key")
+
+func TestPathMapperMap(t *testing.T) {
+	mapper := &PathMapper{HashKey: testKey}
+	mapper.SetRules([]*PathMapping{
+		{Pattern: regexp.MustCompile(`^/health$`), Drop: true},
+		rule(`^/old/`, "/api/"),
+		rule(`^/api/users/\d+`, "/api/users/:id"),
+		{Pattern: regexp.MustCompile(`^/s/([^/]+)`), Hash: true},
+		rule(`\.(js|css)$`, ".asset"),
+	})
+	tests := []struct {
+		path   string
+		mapped string
+		drop   bool
+	}{
+		{"/health", "/health", true},
+		{"/api/users/42", "/api/users/:id", false},
+		// Later rules see the path as rewritten by earlier ones
+		{"/old/users/42", "/api/users/:id", false},
+		{"/s/token/x", "/s/" + pathHash(testKey, "token") + "/x", false},
+		{"/static/app.js", "/static/app.asset", false},
+		{"/other", "/other", false},
+	}
+	for _, test := range tests {
+		mapped, drop := mapper.Map(test.path)
+		if mapped != test.mapped || drop != test.drop {
+			t.Errorf("Map(%q) = %q, %v, want %q, %v", test.path, mapped, drop, test.mapped, test.drop)
+		}
+	}
+}
+
+func TestHashMatches(t *testing.T) {
+	tests := []struct {
+		pattern, path, want string
+	}{
+		{`[0-9a-f]{8}`, "/a/deadbeef/b", "/a/" + pathHash(testKey, "deadbeef") + "/b"},
+		{`/u/(\w+)`, "/u/alice/x", "/u/" + pathHash(testKey, "alice") + "/x"},
+		{`\d+`, "/1/2", "/" + pathHash(testKey, "1") + "/" + pathHash(testKey, "2")},
+		{`\d+`, "/none", "/none"},
+	}
+	for _, test := range tests {
+		if got := hashMatches(testKey, regexp.MustCompile(test.pattern), test.path); got != test.want {
+			t.Errorf("hashMatches(%q, %q) = %q, want %q", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestPathHash(t *testing.T) {
+	// The well-known HMAC-SHA256 example, cut to 16 digits
+	if got, want := pathHash([]byte("key"), "The quick brown fox jumps over the lazy dog"), "f7bc83f430538424"; got != want {
+		t.Errorf("pathHash = %q, want %q", got, want)
+	}
+	if pathHash(testKey, "alice") == pathHash([]byte("other key"), "alice") {
+		t.Error("the hash doesn't depend on the key")
+	}
+}
+
+func TestLoadPaths(t *testing.T) {
+	mapper, err := LoadPaths("../../testdata/e2e.map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapper.Rules) == 0 {
+		t.Fatal("no rules loaded")
+	}
+	if mapper.index == nil || mapper.index.rules != len(mapper.Rules) {
+		t.Error("rules loaded without an index")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Sampler keeps a bounded sample of distinct paths with the number of
+// times each was seen. Once full, a new path replaces a random old one with
+// a probability that keeps the sample representative.
+type Sampler struct {
+	// Redact, if set, is applied to paths before they are sampled, so
+	// that the sample doesn't show what the metrics never would.
+	Redact func(path string) string
+
+	mu     sync.Mutex
+	size   int
+	seen   uint64
+	counts map[string]uint64
+	paths  []string
+}
+
+// NewSampler keeps at most size paths.
+func NewSampler(size int) *Sampler {
+	return &Sampler{
+		size:   size,
+		counts: make(map[string]uint64, size),
+	}
+}
+
+// Add counts one occurrence of path.
+func (s *Sampler) Add(path string) {
+	if s.Redact != nil {
+		path = s.Redact(path)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen++
+	if _, ok := s.counts[path]; ok {
+		s.counts[path]++
+		return
+	}
+	if len(s.paths) < s.size {
+		s.paths = append(s.paths, path)
+		s.counts[path] = 1
+		return
+	}
+	if i := rand.Int63n(int64(s.seen)); i < int64(s.size) {
+		delete(s.counts, s.paths[i])
+		s.paths[i] = path
+		s.counts[path] = 1
+	}
+}
+
+// ServeHTTP lists the sampled paths, most frequent first, as plain text.
+func (s *Sampler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	paths := append([]string(nil), s.paths...)
+	counts := make(map[string]uint64, len(s.counts))
+	for path, count := range s.counts {
+		counts[path] = count
+	}
+	seen := s.seen
+	s.mu.Unlock()
+
+	sort.Slice(paths, func(i, j int) bool {
+		if counts[paths[i]] != counts[paths[j]] {
+			return counts[paths[i]] > counts[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# %d unmatched paths seen, %d distinct paths sampled\n", seen, len(paths))
+	for _, path := range paths {
+		fmt.Fprintf(w, "%d\t%s\n", counts[path], path)
+	}
+}
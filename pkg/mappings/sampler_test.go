@@ -0,0 +1,48 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(2)
+	for _, path := range []string{"/a", "/a", "/b", "/c", "/a"} {
+		s.Add(path)
+	}
+	if len(s.paths) != 2 || len(s.counts) != 2 {
+		t.Fatalf("sampled %v, want 2 paths", s.paths)
+	}
+	if s.seen != 5 {
+		t.Errorf("seen = %d, want 5", s.seen)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/unmatched-paths", nil))
+	if body := rec.Body.String(); !strings.HasPrefix(body, "# 5 unmatched paths seen, 2 distinct paths sampled\n") {
+		t.Errorf("unexpected listing:\n%s", body)
+	}
+}
+
+func TestSamplerRedact(t *testing.T) {
+	s := NewSampler(10)
+	s.Redact = func(path string) string { return strings.Replace(path, "secret", "<redacted>", -1) }
+	s.Add("/u/secret/x")
+	if _, ok := s.counts["/u/<redacted>/x"]; !ok || len(s.counts) != 1 {
+		t.Errorf("sampled %v, want only the redacted path", s.paths)
+	}
+}
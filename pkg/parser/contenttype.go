@@ -0,0 +1,43 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"strings"
+)
+
+// ContentTypeFamily reduces a Content-Type header value to one of a few
+// families, to keep the content_type label's cardinality low: html, json,
+// image, video, font or other.
+func ContentTypeFamily(contentType string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return "html"
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case strings.HasPrefix(mediaType, "image/"):
+		return "image"
+	case strings.HasPrefix(mediaType, "video/") ||
+		mediaType == "application/vnd.apple.mpegurl" || mediaType == "application/x-mpegurl" ||
+		mediaType == "application/dash+xml":
+		return "video"
+	case strings.HasPrefix(mediaType, "font/") ||
+		strings.HasPrefix(mediaType, "application/font-") || strings.HasPrefix(mediaType, "application/x-font-") ||
+		mediaType == "application/vnd.ms-fontobject":
+		return "font"
+	}
+	return "other"
+}
@@ -0,0 +1,232 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package parser parses the key/value lines the exporter has varnishncsa
+// write, such as
+//
+//	time:0.012 method="GET" status=200 path="/foo" host="example.com"
+//
+// into metric values and labels.
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"time"
+
+	"github.com/stigsb/varnishncsa_exporter/event"
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+)
+
+// Metric is a value to record, such as the time a request took.
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// Labelset holds the labels of a request, in the order they were logged.
+type Labelset struct {
+	Names  []string
+	Values []string
+	// Extra holds fields whose name starts with an underscore. They are
+	// available to the exporter but are not used as metric labels.
+	Extra map[string]string
+}
+
+// Equals tells whether l has exactly the given label names, in order.
+func (l *Labelset) Equals(labels []string) bool {
+	if len(l.Names) != len(labels) {
+		return false
+	}
+	for i := range l.Names {
+		if l.Names[i] != labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Value returns the value of the named label, or "" if it is not set.
+func (l *Labelset) Value(name string) string {
+	for i := range l.Names {
+		if l.Names[i] == name {
+			return l.Values[i]
+		}
+	}
+	return ""
+}
+
+// Event returns the request as an event.RequestEvent, the form in which
+// sinks that send whole requests elsewhere pass them on.
+func (l *Labelset) Event(metrics []Metric) *event.RequestEvent {
+	e := event.New(time.Now())
+	for i, name := range l.Names {
+		e.Labels[name] = l.Values[i]
+	}
+	for _, m := range metrics {
+		e.Values[m.Name] = m.Value
+	}
+	if len(l.Extra) > 0 {
+		e.Extra = make(map[string]string, len(l.Extra))
+		for name, value := range l.Extra {
+			e.Extra[name] = value
+		}
+	}
+	return e
+}
+
+// NoHost is the host label of requests without a Host header, such as
+// HTTP/1.0 health checks and scanners.
+const NoHost = "(none)"
+
+// sideNames are the side label values for the Varnish:side field.
+var sideNames = map[string]string{"c": "client", "b": "backend"}
+
+// ErrDropped is returned by Parse for requests whose path matched a drop
+// rule in the path mappings.
+var ErrDropped = errors.New("request dropped by path mappings")
+
+// Parser parses log lines, normalizing paths and hosts on the way.
+type Parser struct {
+	// Paths normalizes the path label. If nil, paths are left as they are.
+	Paths *mappings.PathMapper
+	// Hosts normalizes the host label. If nil, hosts are left as they are.
+	Hosts *mappings.HostMapper
+	// TimeUnits is the number of units of the time metric per second,
+	// such as 1e6 for %D. If zero, time is taken to be in seconds.
+	TimeUnits float64
+	// RawPaths keeps the path as it was before mapping in the _raw_path
+	// extra field.
+	RawPaths bool
+}
+
+// Parse parses one log line.
+func (p *Parser) Parse(src string) (metrics []Metric, labels *Labelset, err error) {
+	metrics = make([]Metric, 0)
+	labels = &Labelset{
+		Names:  make([]string, 0),
+		Values: make([]string, 0),
+	}
+
+	var s scanner.Scanner
+	s.Init(strings.NewReader(src))
+	var tok rune
+	for {
+		tok = s.Scan()
+		if tok == scanner.EOF {
+			return
+		} else if tok != scanner.Ident {
+			err = fmt.Errorf("Ident expected at %v, got %s", s.Pos(), scanner.TokenString(tok))
+			return
+		}
+		name := s.TokenText()
+
+		tok = s.Scan()
+		if tok == ':' {
+			// Metric
+			tok = s.Scan()
+			if tok == scanner.Float || tok == scanner.Int {
+				var value float64
+				value, err = strconv.ParseFloat(s.TokenText(), 64)
+				if err != nil {
+					return
+				}
+				if name == "time" && p.TimeUnits != 0 {
+					value = value / p.TimeUnits
+				}
+				metrics = append(metrics, Metric{
+					Name:  name,
+					Value: value,
+				})
+			} else {
+				err = fmt.Errorf("Float or Int expected at %v, got %s", s.Pos(), scanner.TokenString(tok))
+				return
+			}
+
+		} else if tok == '=' {
+			// Label
+			tok = s.Scan()
+			var value string
+			if tok == scanner.Ident || tok == scanner.Float || tok == scanner.Int {
+				value = s.TokenText()
+			} else if tok == scanner.String || tok == scanner.RawString {
+				value, err = strconv.Unquote(s.TokenText())
+				if err != nil {
+					return
+				}
+				// a bit nasty to hardcode this, but we do hardcode the field name when running varnishncsa..
+				if name == "path" && p.RawPaths {
+					if labels.Extra == nil {
+						labels.Extra = make(map[string]string)
+					}
+					labels.Extra["_raw_path"] = value
+				}
+				if name == "path" && p.Paths != nil {
+					var drop bool
+					if value, drop = p.Paths.Map(value); drop {
+						err = ErrDropped
+						return
+					}
+				} else if name == "host" && (value == "" || value == "-") {
+					// varnishncsa prints "-" for a missing header
+					value = NoHost
+				} else if name == "host" && p.Hosts != nil {
+					value = p.Hosts.Map(value)
+				} else if name == "content_type" {
+					value = ContentTypeFamily(value)
+				} else if side, ok := sideNames[value]; ok && name == "side" {
+					value = side
+				}
+			} else {
+				err = fmt.Errorf("Ident or String expected at %v, got %s", s.Pos(), scanner.TokenString(tok))
+			}
+
+			if strings.HasPrefix(name, "_") {
+				if labels.Extra == nil {
+					labels.Extra = make(map[string]string)
+				}
+				labels.Extra[name] = value
+				continue
+			}
+			labels.Names = append(labels.Names, name)
+			labels.Values = append(labels.Values, value)
+		} else {
+			err = fmt.Errorf(": or = expected at %v, got %s", s.Pos(), scanner.TokenString(tok))
+			return
+		}
+	}
+}
+
+// formatNameRegexp matches the field names of a varnishncsa format in the
+// exporter's key/value style, followed by ":" for metrics or "=" for labels.
+var formatNameRegexp = regexp.MustCompile(`(?:^|\s)([A-Za-z_][A-Za-z0-9_]*)([:=])`)
+
+// FormatNames returns the names of the metrics and labels that lines
+// written with a varnishncsa format will have. Fields whose name starts
+// with an underscore are left out, as they are not labels.
+func FormatNames(format string) (metrics, labels []string) {
+	for _, m := range formatNameRegexp.FindAllStringSubmatch(format, -1) {
+		switch {
+		case m[2] == ":":
+			metrics = append(metrics, m[1])
+		case !strings.HasPrefix(m[1], "_"):
+			labels = append(labels, m[1])
+		}
+	}
+	return metrics, labels
+}
@@ -0,0 +1,122 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+)
+
+func TestParse(t *testing.T) {
+	paths := &mappings.PathMapper{}
+	paths.SetRules([]*mappings.PathMapping{
+		{Pattern: regexp.MustCompile(`^/healthz$`), Drop: true},
+		{Pattern: regexp.MustCompile(`/\d+`), Replacement: "/ID"},
+	})
+	p := &Parser{Paths: paths, Hosts: &mappings.HostMapper{}, TimeUnits: 1e6, RawPaths: true}
+	tests := []struct {
+		line    string
+		metrics []Metric
+		names   []string
+		values  []string
+		extra   map[string]string
+		err     bool
+	}{
+		{
+			line:    `method="GET" status=200 path="/u/42" cache="hit" host="WWW.Example.com:80" time:1500`,
+			metrics: []Metric{{"time", 0.0015}},
+			names:   []string{"method", "status", "path", "cache", "host"},
+			values:  []string{"GET", "200", "/u/ID", "hit", "www.example.com"},
+			extra:   map[string]string{"_raw_path": "/u/42"},
+		},
+		{
+			line:    `host="-" side="b" content_type="text/html; charset=utf-8" _vxid="12" respsize:512`,
+			metrics: []Metric{{"respsize", 512}},
+			names:   []string{"host", "side", "content_type"},
+			values:  []string{NoHost, "backend", "html"},
+			extra:   map[string]string{"_vxid": "12"},
+		},
+		{line: `path="/healthz" time:1`, err: true},
+		{line: `method=`, err: true},
+		{line: `"GET"`, err: true},
+		{line: `time:fast`, err: true},
+	}
+	for _, test := range tests {
+		metrics, labels, err := p.Parse(test.line)
+		if test.err {
+			if err == nil {
+				t.Errorf("Parse(%q) succeeded, want an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(metrics, test.metrics) {
+			t.Errorf("Parse(%q) metrics = %v, want %v", test.line, metrics, test.metrics)
+		}
+		if !reflect.DeepEqual(labels.Names, test.names) || !reflect.DeepEqual(labels.Values, test.values) {
+			t.Errorf("Parse(%q) labels = %v %v, want %v %v", test.line, labels.Names, labels.Values, test.names, test.values)
+		}
+		if !reflect.DeepEqual(labels.Extra, test.extra) {
+			t.Errorf("Parse(%q) extra = %v, want %v", test.line, labels.Extra, test.extra)
+		}
+	}
+}
+
+func TestParseDropped(t *testing.T) {
+	paths := &mappings.PathMapper{}
+	paths.SetRules([]*mappings.PathMapping{{Pattern: regexp.MustCompile(`^/healthz$`), Drop: true}})
+	p := &Parser{Paths: paths}
+	if _, _, err := p.Parse(`path="/healthz"`); err != ErrDropped {
+		t.Errorf("Parse of a dropped path returned %v, want ErrDropped", err)
+	}
+}
+
+func TestFormatNames(t *testing.T) {
+	metrics, labels := FormatNames(`method="%m" status=%s path="%U" _vxid="%{Varnish:vxid}x" time:%D respsize:%b`)
+	if want := []string{"time", "respsize"}; !reflect.DeepEqual(metrics, want) {
+		t.Errorf("metrics = %v, want %v", metrics, want)
+	}
+	if want := []string{"method", "status", "path"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+}
+
+func TestContentTypeFamily(t *testing.T) {
+	tests := []struct {
+		contentType, want string
+	}{
+		{"text/html; charset=utf-8", "html"},
+		{"application/xhtml+xml", "html"},
+		{"Application/JSON", "json"},
+		{"application/ld+json", "json"},
+		{"image/webp", "image"},
+		{"application/vnd.apple.mpegurl", "video"},
+		{"font/woff2", "font"},
+		{"application/x-font-ttf", "font"},
+		{"text/css", "other"},
+		{"", "other"},
+	}
+	for _, test := range tests {
+		if got := ContentTypeFamily(test.contentType); got != test.want {
+			t.Errorf("ContentTypeFamily(%q) = %q, want %q", test.contentType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/event"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// eventPlugin hands each request to a co-process that may change it or
+// enrich it with data from elsewhere, such as the team owning a path in a
+// service catalog. For every request it writes the event.RequestEvent as
+// one line of JSON to the co-process' stdin, and reads back one line:
+// the event with any changes, or an empty line to leave it as it is.
+//
+// Existing labels, values and extra fields can be changed. New labels are
+// only taken if they are among labels, which every request gets, empty if
+// the co-process didn't set them, so that the metrics keep the same
+// dimensions.
+type eventPlugin struct {
+	process  *coProcess
+	labels   []string
+	errors   prometheus.Counter
+	timeouts prometheus.Counter
+}
+
+// newEventPlugin starts command, and waits up to timeout for each of its
+// answers.
+func newEventPlugin(command string, labels []string, timeout time.Duration) (*eventPlugin, error) {
+	p := &eventPlugin{
+		process: &coProcess{name: "plugin", command: command, timeout: timeout},
+		labels:  labels,
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_plugin_errors_total",
+			Help:      "Number of requests the plugin failed to process, which were recorded unchanged.",
+		}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_plugin_timeouts_total",
+			Help:      "Number of requests the plugin didn't answer for in time, after which it was restarted.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{p.errors, p.timeouts} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.process.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Process updates metrics and labels with the answer from the co-process.
+// If the co-process fails or doesn't answer in time, it is restarted for
+// the next request and the request is left as it is, apart from getting
+// the plugin's labels.
+func (p *eventPlugin) Process(metrics []parser.Metric, labels *parser.Labelset) {
+	answer, err := p.ask(labels.Event(metrics))
+	if err != nil {
+		log.Errorf("plugin: %v", err)
+		p.errors.Inc()
+		if err == errCoProcessTimeout {
+			p.timeouts.Inc()
+		}
+	}
+	if answer == nil {
+		answer = &event.RequestEvent{}
+	}
+	logged := make(map[string]bool, len(labels.Names))
+	for i, name := range labels.Names {
+		logged[name] = true
+		if value, ok := answer.Labels[name]; ok {
+			labels.Values[i] = value
+		}
+	}
+	for _, name := range p.labels {
+		if !logged[name] {
+			labels.Names = append(labels.Names, name)
+			labels.Values = append(labels.Values, answer.Labels[name])
+		}
+	}
+	for i := range metrics {
+		if value, ok := answer.Values[metrics[i].Name]; ok {
+			metrics[i].Value = value
+		}
+	}
+	if answer.Extra != nil {
+		labels.Extra = answer.Extra
+	}
+}
+
+func (p *eventPlugin) ask(e *event.RequestEvent) (*event.RequestEvent, error) {
+	request, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	line, err := p.process.ask(string(request))
+	if err != nil {
+		return nil, err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return nil, nil
+	}
+	var answer event.RequestEvent
+	if err := json.Unmarshal([]byte(line), &answer); err != nil {
+		return nil, fmt.Errorf("invalid answer %q: %v", line, err)
+	}
+	return &answer, nil
+}
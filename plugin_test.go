@@ -0,0 +1,71 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+func TestEventPlugin(t *testing.T) {
+	// Not made with newEventPlugin, which registers its counters
+	p := &eventPlugin{
+		process: &coProcess{
+			name: "plugin",
+			command: `while read line; do case "$line" in
+				*/slow*) sleep 10 ;;
+				*/api*) echo '{"labels":{"path":"/api","team":"api"},"values":{"time":2}}' ;;
+				*) echo ;;
+			esac; done`,
+			timeout: 200 * time.Millisecond,
+		},
+		labels:   []string{"team"},
+		errors:   prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{Name: "timeouts"}),
+	}
+	if err := p.process.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.process.stop()
+	tests := []struct {
+		path, wantPath, wantTeam string
+		wantTime                 float64
+	}{
+		{"/api/1", "/api", "api", 2},
+		{"/about", "/about", "", 1},
+		// A request the plugin hangs on is recorded unchanged
+		{"/slow", "/slow", "", 1},
+		{"/api/2", "/api", "api", 2},
+	}
+	for _, test := range tests {
+		metrics := []parser.Metric{{Name: "time", Value: 1}}
+		labels := request("x", test.path, "200", "hit")
+		p.Process(metrics, labels)
+		if labels.Value("path") != test.wantPath || labels.Value("team") != test.wantTeam || metrics[0].Value != test.wantTime {
+			t.Errorf("processed %s to %v %v, %v", test.path, labels.Names, labels.Values, metrics)
+		}
+		if n := len(labels.Names); n != 5 {
+			t.Errorf("processed %s to %d labels, want 5", test.path, n)
+		}
+	}
+	if n := testutil.ToFloat64(p.timeouts); n != 1 {
+		t.Errorf("%g timeouts counted, want 1", n)
+	}
+}
@@ -0,0 +1,690 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/collector"
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// queueSize is the number of log lines that can be waiting to be
+// processed.
+const queueSize = 10000
+
+// maxBatched is the number of observations batched before they are
+// applied, even if the flush interval has not passed, so that a burst of
+// requests can't grow the batch without bound.
+const maxBatched = 100000
+
+// sink receives every successfully parsed log line, in addition to the
+// Prometheus metrics.
+type sink interface {
+	Record(metrics []parser.Metric, labels *parser.Labelset)
+}
+
+// logProcessor turns varnishncsa log lines into Prometheus metrics.
+type logProcessor struct {
+	mapper        *mappings.PathMapper
+	hosts         *mappings.HostMapper
+	namer         *metricNamer
+	messages      counterSet
+	parseFailures counterSet
+	dropped       counterSet
+	redacted      prometheus.Counter
+	longLines     prometheus.Counter
+	inputErrors   prometheus.Counter
+	panics        prometheus.Counter
+	noHost        prometheus.Counter
+	parseTime     prometheus.Summary
+	observeTime   prometheus.Summary
+	msgs          int64
+	lastMsg       int64 // unix nanoseconds
+	sinks         []sink
+	sampler       *sampler
+	reopen        func() (io.Reader, error)
+	normalizer    *externalNormalizer
+	plugin        *eventPlugin
+	series        *seriesTracker
+	replays       *replayFilter
+	parseErrors   *logThrottle
+	classifier    *contentClassifier
+	delivery      bool
+	rawPaths      bool
+	schema        []string        // labels of the request metrics, once known
+	declared      map[string]bool // request metrics declared with schema
+	errorDetail   bool
+	excludeNoHost bool
+	configMu      sync.RWMutex
+	config        *config
+	redactor      *pathRedactor
+	queue         chan string
+
+	collector *collector.Collector
+
+	flushInterval time.Duration
+	batchMu       sync.Mutex
+	batch         map[uint64][]*pendingObservations
+	batched       int
+}
+
+// newLogProcessor creates a logProcessor. If flushInterval is not zero,
+// observations are batched per series and applied every flushInterval.
+// Metrics are exported under the names namer gives them.
+func newLogProcessor(mapper *mappings.PathMapper, hosts *mappings.HostMapper, flushInterval time.Duration, namer *metricNamer) (*logProcessor, error) {
+	p := &logProcessor{
+		config:        &config{},
+		mapper:        mapper,
+		hosts:         hosts,
+		namer:         namer,
+		queue:         make(chan string, queueSize),
+		flushInterval: flushInterval,
+		batch:         make(map[uint64][]*pendingObservations),
+	}
+	p.collector = collector.New(namespace, prometheus.DefaultRegisterer, p.metricHelp)
+	var err error
+	p.messages, err = newCounterSet(namer, prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_log_messages",
+		Help:      "Current total log messages received.",
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.parseFailures, err = newCounterSet(namer, prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_log_parse_failure",
+		Help:      "Number of errors while parsing log messages.",
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.dropped, err = newCounterSet(namer, prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_log_dropped",
+		Help:      "Number of log messages ignored because of a drop rule in the path mappings.",
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.redacted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_paths_redacted_total",
+		Help:      "Number of requests whose path had sensitive parts redacted.",
+	})
+	if err := prometheus.Register(p.redacted); err != nil {
+		return nil, err
+	}
+	p.longLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_long_lines_total",
+		Help:      "Number of log lines skipped for being longer than -input.max-line-size.",
+	})
+	if err := prometheus.Register(p.longLines); err != nil {
+		return nil, err
+	}
+	p.inputErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_input_errors_total",
+		Help:      "Number of times reading log lines failed with an error other than the end of the input.",
+	})
+	if err := prometheus.Register(p.inputErrors); err != nil {
+		return nil, err
+	}
+	if p.redactor, err = newPathRedactor(nil); err != nil {
+		return nil, err
+	}
+	p.panics = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_panics_total",
+		Help:      "Number of log lines whose processing panicked.",
+	})
+	p.noHost = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "without_host_total",
+		Help:      "Number of requests without a Host header, including those left out by -varnish.exclude-no-host.",
+	})
+	p.parseTime = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Name:       "exporter_parse_duration_seconds",
+		Help:       "Time spent parsing and normalizing each log line.",
+		Objectives: pipelineObjectives,
+	})
+	p.observeTime = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Name:       "exporter_observe_duration_seconds",
+		Help:       "Time spent recording each parsed log line in the metrics and sinks.",
+		Objectives: pipelineObjectives,
+	})
+	lastMessage := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_last_log_message_timestamp_seconds",
+		Help:      "Time the last log message was received, in seconds since the epoch.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&p.lastMsg)) / 1e9
+	})
+	for _, c := range []prometheus.Collector{p.panics, p.noHost, p.parseTime, p.observeTime, lastMessage} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	watchQueue("lines", p.QueueLength)
+	if flushInterval > 0 {
+		go p.flushLoop()
+	}
+	return p, nil
+}
+
+// AddSink makes the processor pass parsed log lines to s. It must be
+// called before ProcessLines.
+func (p *logProcessor) AddSink(s sink) {
+	p.sinks = append(p.sinks, s)
+}
+
+// Messages returns the number of log lines processed so far.
+func (p *logProcessor) Messages() int64 {
+	return atomic.LoadInt64(&p.msgs)
+}
+
+// SetSampler makes the processor only record the log lines s keeps. It
+// must be called before ProcessLines.
+func (p *logProcessor) SetSampler(s *sampler) {
+	p.sampler = s
+}
+
+// SetNormalizer makes the processor pass the labels of every request
+// through n. It must be called before ProcessLines.
+func (p *logProcessor) SetNormalizer(n *externalNormalizer) {
+	p.normalizer = n
+}
+
+// SetPlugin makes the processor pass every request through pl before
+// recording it. It must be called before ProcessLines.
+func (p *logProcessor) SetPlugin(pl *eventPlugin) {
+	p.plugin = pl
+}
+
+// SetSeriesTracker makes the processor record in t when each series was
+// last observed. It must be called before ProcessLines.
+func (p *logProcessor) SetSeriesTracker(t *seriesTracker) {
+	p.series = t
+}
+
+// SetReplayFilter makes the processor skip the transactions f tells have
+// been logged before. It must be called before ProcessLines.
+func (p *logProcessor) SetReplayFilter(f *replayFilter) {
+	p.replays = f
+}
+
+// SetParseErrorThrottle makes the processor log parse failures through t.
+// It must be called before ProcessLines.
+func (p *logProcessor) SetParseErrorThrottle(t *logThrottle) {
+	p.parseErrors = t
+}
+
+// SetErrorDetail makes the processor record error responses with exact
+// paths and without sampling, and other responses by the first segment of
+// the path only. It must be called before ProcessLines.
+func (p *logProcessor) SetErrorDetail(enabled bool) {
+	p.errorDetail = enabled
+}
+
+// SetExcludeNoHost makes the processor leave out requests without a Host
+// header, other than counting them. It must be called before
+// ProcessLines.
+func (p *logProcessor) SetExcludeNoHost(enabled bool) {
+	p.excludeNoHost = enabled
+}
+
+// SetClassifier makes the processor add a content_class label, as given
+// by c, to every request. It must be called before ProcessLines.
+func (p *logProcessor) SetClassifier(c *contentClassifier) {
+	p.classifier = c
+}
+
+// SetDeliveryMode makes the processor add a delivery label, telling
+// streamed responses from others, to every request. It must be called
+// before ProcessLines.
+func (p *logProcessor) SetDeliveryMode(enabled bool) {
+	p.delivery = enabled
+}
+
+// SetReopen makes the processor read on from the reader reopen returns
+// when reading log lines fails, instead of stopping. It must be called
+// before ProcessLines.
+func (p *logProcessor) SetReopen(reopen func() (io.Reader, error)) {
+	p.reopen = reopen
+}
+
+// SetRawPaths makes the processor keep the path of each request as it
+// was before mapping, redacted, in the _raw_path extra field for sinks.
+// It must be called before ProcessLines.
+func (p *logProcessor) SetRawPaths(enabled bool) {
+	p.rawPaths = enabled
+}
+
+// SetBucketRules makes the request metrics use other buckets for the
+// requests matching a rule. It must be called before ProcessLines.
+func (p *logProcessor) SetBucketRules(rules []collector.BucketRule) {
+	p.collector.SetBucketRules(rules)
+}
+
+// schemaSink is a sink with request metrics of its own, which must get
+// the same labels as the processor's.
+type schemaSink interface {
+	Declare(name string, labelNames []string)
+}
+
+// SetSchema declares the labels of the request metrics from the
+// varnishncsa format, so that every series of a metric has the same labels
+// whichever request comes first. It must be called after SetClassifier,
+// SetDeliveryMode, SetPlugin and AddSink, and before ProcessLines. Without
+// it the labels of the first parsed line are used.
+func (p *logProcessor) SetSchema(format string) {
+	metrics, labels := parser.FormatNames(format)
+	labels = append(labels, "cache")
+	if p.classifier != nil {
+		labels = append(labels, "content_class")
+	}
+	if p.delivery {
+		labels = append(labels, "delivery")
+	}
+	if p.plugin != nil {
+		labels = append(labels, p.plugin.labels...)
+	}
+	p.schema = labels
+	for _, metric := range metrics {
+		p.declare(metric)
+	}
+}
+
+// declare fixes the labels of a request metric to the schema, in the
+// processor's collector and in those of the sinks.
+func (p *logProcessor) declare(metric string) {
+	if p.declared == nil {
+		p.declared = make(map[string]bool)
+	}
+	p.declared[metric] = true
+	for _, name := range p.namer.Names(metric) {
+		p.collector.Declare(name, p.schema)
+		for _, s := range p.sinks {
+			if d, ok := s.(schemaSink); ok {
+				d.Declare(name, p.schema)
+			}
+		}
+	}
+}
+
+// SetConfig makes the processor take metric settings, such as help texts
+// and redact patterns, from cfg.
+func (p *logProcessor) SetConfig(cfg *config) error {
+	redactor, err := newPathRedactor(cfg.Redact)
+	if err != nil {
+		return err
+	}
+	p.configMu.Lock()
+	p.config, p.redactor = cfg, redactor
+	p.configMu.Unlock()
+	return nil
+}
+
+// redactPath returns path with its sensitive parts replaced, as they are
+// in the path label.
+func (p *logProcessor) redactPath(path string) string {
+	p.configMu.RLock()
+	redactor := p.redactor
+	p.configMu.RUnlock()
+	path, _ = redactor.Redact(path)
+	return path
+}
+
+// QueueLength returns the number of log lines read but not yet processed,
+// and the capacity of the queue.
+func (p *logProcessor) QueueLength() (int, int) {
+	return len(p.queue), cap(p.queue)
+}
+
+// reopenDelay is the time to wait before reopening the input after a
+// read error, so that an input that keeps failing doesn't spin.
+const reopenDelay = time.Second
+
+// maxReopens is the number of times in a row the input is reopened
+// without a line being read from it before reading gives up.
+const maxReopens = 5
+
+// ProcessLines reads log lines from r until EOF or a read error. Reading
+// and parsing happen in separate goroutines, connected by a queue. Lines
+// longer than -input.max-line-size are counted and skipped. After a read
+// error, reading goes on from a new reader if SetReopen was called. It
+// must only be called once.
+func (p *logProcessor) ProcessLines(r io.Reader) error {
+	var err error
+	long := newLogThrottle("long log lines", 10, time.Minute)
+	go func() {
+		reopens := 0
+		for {
+			var lines int
+			if lines, err = p.readLines(r, long); err == nil {
+				break
+			}
+			p.inputErrors.Inc()
+			if lines > 0 {
+				reopens = 0
+			}
+			if p.reopen == nil || reopens == maxReopens {
+				break
+			}
+			reopens++
+			log.Errorf("error reading log lines: %v, reopening the input in %v", err, reopenDelay)
+			time.Sleep(reopenDelay)
+			if r, err = p.reopen(); err != nil {
+				err = fmt.Errorf("reopening the input: %v", err)
+				break
+			}
+		}
+		close(p.queue)
+	}()
+	for content := range p.queue {
+		p.safeProcessLine(content)
+	}
+	p.Flush()
+	return err
+}
+
+// readLines queues the lines of r until EOF or a read error, and returns
+// the number of lines read.
+func (p *logProcessor) readLines(r io.Reader, long *logThrottle) (lines int, err error) {
+	scanner := newLineScanner(r, *maxLineSize, func() {
+		p.longLines.Inc()
+		long.Error(fmt.Errorf("skipped a log line of %d bytes or more, see -input.max-line-size", *maxLineSize))
+	})
+	for scanner.Scan() {
+		lines++
+		p.messages.Inc()
+		atomic.AddInt64(&p.msgs, 1)
+		atomic.StoreInt64(&p.lastMsg, time.Now().UnixNano())
+		detailed := p.errorDetail && isErrorStatus(lineStatus(scanner.Text()))
+		if p.sampler != nil && !detailed && !p.sampler.Keep() {
+			continue
+		}
+		p.queue <- scanner.Text()
+	}
+	return lines, scanner.Err()
+}
+
+// safeProcessLine processes a log line, recovering from any panic so that
+// one bad line doesn't take down the exporter and its metrics. The line is
+// logged with its sensitive parts redacted.
+func (p *logProcessor) safeProcessLine(content string) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.panics.Inc()
+			p.configMu.RLock()
+			line, _ := p.redactor.Redact(content)
+			p.configMu.RUnlock()
+			log.Errorf("panic while processing log line %q: %v\n%s", line, r, debug.Stack())
+		}
+	}()
+	p.ProcessLine(content)
+}
+
+func (p *logProcessor) ProcessLine(content string) {
+	start := time.Now()
+	mapper, detailed := p.mapper, false
+	if p.errorDetail {
+		if detailed = isErrorStatus(lineStatus(content)); detailed {
+			mapper = exactPaths
+		}
+	}
+	// The time metric's unit depends on -varnish.duration-field, e.g.
+	// microseconds for %D
+	lineParser := parser.Parser{Paths: mapper, Hosts: p.hosts, TimeUnits: durationName.Field().PerSecond, RawPaths: p.rawPaths}
+	metrics, labels, err := lineParser.Parse(content)
+	if err == parser.ErrDropped {
+		p.dropped.Inc()
+		return
+	} else if err != nil {
+		p.parseFailures.Inc()
+		if p.parseErrors != nil {
+			p.parseErrors.Error(err)
+		} else {
+			log.Error(err)
+		}
+		return
+	}
+	if p.replays != nil && p.replays.Replayed(labels.Extra["_vxid"]) {
+		return
+	}
+	if !hasLabel(labels, "cache") {
+		// Keep the label set of the request metrics the same for all
+		// requests, also when the cache field was left out of the format
+		labels.Names = append(labels.Names, "cache")
+		labels.Values = append(labels.Values, "unknown")
+	}
+	if labels.Value("host") == parser.NoHost {
+		p.noHost.Inc()
+		if p.excludeNoHost {
+			return
+		}
+	}
+	if p.normalizer != nil {
+		p.normalizer.Normalize(labels)
+	}
+	p.configMu.RLock()
+	redactor := p.redactor
+	p.configMu.RUnlock()
+	for i, name := range labels.Names {
+		if name != "path" {
+			continue
+		}
+		if path, changed := redactor.Redact(labels.Values[i]); changed {
+			labels.Values[i] = path
+			p.redacted.Inc()
+		}
+		if p.errorDetail && !detailed {
+			labels.Values[i] = coarsePath(labels.Values[i])
+		}
+	}
+	if raw, ok := labels.Extra["_raw_path"]; ok {
+		labels.Extra["_raw_path"], _ = redactor.Redact(raw)
+	}
+	if p.classifier != nil {
+		labels.Names = append(labels.Names, "content_class")
+		labels.Values = append(labels.Values, p.classifier.Classify(labels.Value("path"), labels.Extra["_content_type"]))
+	}
+	if p.delivery {
+		labels.Names = append(labels.Names, "delivery")
+		labels.Values = append(labels.Values, deliveryMode(labels.Extra))
+	}
+	if p.plugin != nil {
+		p.plugin.Process(metrics, labels)
+	}
+	p.declareSchema(metrics, labels)
+	parsed := time.Now()
+	p.parseTime.Observe(parsed.Sub(start).Seconds())
+	// Sinks count client requests, backend requests are only in the
+	// request metrics
+	if labels.Value("side") != "backend" {
+		for _, s := range p.sinks {
+			s.Record(metrics, labels)
+		}
+	}
+	for _, metric := range metrics {
+		for _, name := range p.namer.Names(metric.Name) {
+			p.observe(name, metric, labels)
+		}
+	}
+	p.observeTime.Observe(time.Since(parsed).Seconds())
+}
+
+// declareSchema declares the request metrics of a line that are not
+// declared yet. Without a format, e.g. when reading -input.file, the first
+// line fixes the labels and later lines are padded to them.
+func (p *logProcessor) declareSchema(metrics []parser.Metric, labels *parser.Labelset) {
+	if p.schema == nil {
+		p.schema = append([]string(nil), labels.Names...)
+	}
+	for _, m := range metrics {
+		if !p.declared[m.Name] {
+			p.declare(m.Name)
+		}
+	}
+}
+
+// observe records a metric value in the histogram with the given name,
+// either right away or, if batching is enabled, at the next flush.
+func (p *logProcessor) observe(name string, m parser.Metric, labels *parser.Labelset) {
+	if traceID := labels.Extra["_trace_id"]; traceID != "" && m.Name == "time" {
+		// Traced requests are rare, so they skip batching to keep the exemplar
+		if vec, values := p.collector.Series(name, labels); vec != nil {
+			vec.WithLabelValues(values...).(prometheus.ExemplarObserver).ObserveWithExemplar(
+				m.Value, prometheus.Labels{"trace_id": traceID},
+			)
+			p.touch(vec, values)
+		}
+		return
+	}
+	if p.flushInterval == 0 {
+		if vec, values := p.collector.Series(name, labels); vec != nil {
+			vec.WithLabelValues(values...).Observe(m.Value)
+			p.touch(vec, values)
+		}
+		return
+	}
+	key := seriesHash(name, labels)
+	p.batchMu.Lock()
+	var b *pendingObservations
+	for _, pending := range p.batch[key] {
+		if pending.name == name && sameLabels(pending.labels, labels) {
+			b = pending
+			break
+		}
+	}
+	if b == nil {
+		b = &pendingObservations{name: name, labels: labels}
+		p.batch[key] = append(p.batch[key], b)
+	}
+	b.values = append(b.values, m.Value)
+	p.batched++
+	full := p.batched >= maxBatched
+	p.batchMu.Unlock()
+	if full {
+		p.Flush()
+	}
+}
+
+// pendingObservations are the values observed for one series since the
+// last flush.
+type pendingObservations struct {
+	name   string
+	labels *parser.Labelset
+	values []float64
+}
+
+// seriesHash returns the FNV-1a hash of a metric name and its labels,
+// computed in place so that batching an observation doesn't allocate a
+// key for it.
+func seriesHash(name string, labels *parser.Labelset) uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	add := func(s string) {
+		for i := 0; i < len(s); i++ {
+			h ^= uint64(s[i])
+			h *= prime
+		}
+		h ^= 0xff
+		h *= prime
+	}
+	add(name)
+	for i := range labels.Names {
+		add(labels.Names[i])
+		add(labels.Values[i])
+	}
+	return h
+}
+
+// sameLabels tells whether two label sets have the same names and values.
+func sameLabels(a, b *parser.Labelset) bool {
+	if len(a.Names) != len(b.Names) || len(a.Values) != len(b.Values) {
+		return false
+	}
+	for i := range a.Names {
+		if a.Names[i] != b.Names[i] || a.Values[i] != b.Values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush applies all batched observations.
+func (p *logProcessor) Flush() {
+	p.batchMu.Lock()
+	batch := p.batch
+	p.batch = make(map[uint64][]*pendingObservations, len(batch))
+	p.batched = 0
+	p.batchMu.Unlock()
+	for _, pending := range batch {
+		for _, b := range pending {
+			vec, values := p.collector.Series(b.name, b.labels)
+			if vec == nil {
+				continue
+			}
+			observer := vec.WithLabelValues(values...)
+			for _, v := range b.values {
+				observer.Observe(v)
+			}
+			p.touch(vec, values)
+		}
+	}
+}
+
+// touch records that a series was observed, if series are tracked.
+func (p *logProcessor) touch(vec *prometheus.HistogramVec, values []string) {
+	if p.series != nil {
+		p.series.Touch(vec, values)
+	}
+}
+
+func (p *logProcessor) flushLoop() {
+	for range time.Tick(p.flushInterval) {
+		p.Flush()
+	}
+}
+
+// metricHelp returns the help text of the named metric.
+func (p *logProcessor) metricHelp(name string) string {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	return p.config.MetricHelp(name)
+}
+
+func hasLabel(labels *parser.Labelset, name string) bool {
+	for _, n := range labels.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/collector"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+func TestSeriesHash(t *testing.T) {
+	a := &parser.Labelset{Names: []string{"host", "path"}, Values: []string{"x", "/a"}}
+	b := &parser.Labelset{Names: []string{"host", "path"}, Values: []string{"x", "/a"}}
+	if seriesHash("time", a) != seriesHash("time", b) || !sameLabels(a, b) {
+		t.Error("equal series differ")
+	}
+	// Moving a byte from one value to the next is a different series
+	c := &parser.Labelset{Names: []string{"host", "path"}, Values: []string{"x/", "a"}}
+	if seriesHash("time", a) == seriesHash("time", c) || sameLabels(a, c) {
+		t.Error("different series are the same")
+	}
+	if seriesHash("time", a) == seriesHash("respsize", a) {
+		t.Error("series of different metrics are the same")
+	}
+}
+
+func TestObserveBatching(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p := &logProcessor{
+		flushInterval: time.Hour,
+		batch:         make(map[uint64][]*pendingObservations),
+		collector:     collector.New(namespace, registry, func(string) string { return "Help." }),
+	}
+	count := func() uint64 {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n uint64
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				n += m.GetHistogram().GetSampleCount()
+			}
+		}
+		return n
+	}
+	labels := func(path string) *parser.Labelset {
+		return &parser.Labelset{Names: []string{"path"}, Values: []string{path}}
+	}
+	for i := 0; i < 3; i++ {
+		p.observe("time", parser.Metric{Name: "time", Value: 1}, labels("/a"))
+	}
+	p.observe("time", parser.Metric{Name: "time", Value: 1}, labels("/b"))
+	if n := len(p.batch); n != 2 {
+		t.Errorf("%d series batched, want 2", n)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("%d observations applied before the flush", n)
+	}
+	p.Flush()
+	if n := count(); n != 4 {
+		t.Errorf("%d observations applied by the flush, want 4", n)
+	}
+	// A full batch is applied right away
+	for i := 0; i < maxBatched; i++ {
+		p.observe("time", parser.Metric{Name: "time", Value: 1}, labels("/a"))
+	}
+	if p.batched != 0 || len(p.batch) != 0 {
+		t.Errorf("%d observations still batched", p.batched)
+	}
+	if n := count(); n != 4+maxBatched {
+		t.Errorf("%d observations applied, want %d", n, 4+maxBatched)
+	}
+}
+
+func TestDeclareSchema(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	tenants := newTenantSink(&config{Tenants: map[string]tenantConfig{
+		"shop": {Hosts: []string{"shop.example"}},
+	}}, &metricNamer{old: true})
+	p := &logProcessor{
+		namer:     &metricNamer{old: true},
+		collector: collector.New(namespace, registry, func(string) string { return "Help." }),
+		sinks:     []sink{tenants},
+	}
+	line := func(host string, names ...string) ([]parser.Metric, *parser.Labelset) {
+		labels := &parser.Labelset{Names: []string{"host"}, Values: []string{host}}
+		for _, name := range names {
+			labels.Names = append(labels.Names, name)
+			labels.Values = append(labels.Values, name+"-value")
+		}
+		return []parser.Metric{{Name: "time", Value: 1}}, labels
+	}
+	// Without a format the first line fixes the labels, also of the
+	// tenant, whose first line lacks some of them, and later lines are
+	// padded to them
+	for _, l := range []struct {
+		host  string
+		names []string
+	}{
+		{"other.example", []string{"path", "cache"}},
+		{"shop.example", []string{"cache"}},
+		{"shop.example", []string{"path", "cache", "extra"}},
+	} {
+		metrics, labels := line(l.host, l.names...)
+		p.declareSchema(metrics, labels)
+		p.collector.Observe("time", labels, 1)
+		tenants.Record(metrics, labels)
+	}
+	for name, gatherer := range map[string]prometheus.Gatherer{"main": registry, "tenant": tenants.byName["shop"].registry} {
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mfs) != 1 {
+			t.Fatalf("%s: %d metric families, want 1", name, len(mfs))
+		}
+		for _, m := range mfs[0].Metric {
+			var got []string
+			for _, l := range m.Label {
+				got = append(got, l.GetName())
+			}
+			if strings.Join(got, ",") != "cache,host,path" {
+				t.Errorf("%s: labels %v, want cache, host and path", name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// rateLimitFormat logs the Retry-After response header, which is either a
+// number of seconds or an HTTP date.
+const rateLimitFormat = `_retry_after="%{Retry-After}o"`
+
+// rateLimitSink makes rate limiting done in VCL visible: the requests
+// turned away with 429 Too Many Requests, and how long clients were told
+// to wait before retrying, by status, which besides 429 is typically 503.
+type rateLimitSink struct {
+	limited    *prometheus.CounterVec
+	retryAfter *prometheus.HistogramVec
+}
+
+func newRateLimitSink() (*rateLimitSink, error) {
+	s := &rateLimitSink{
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of requests answered with 429 Too Many Requests.",
+		}, []string{"host"}),
+		retryAfter: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "retry_after_seconds",
+			Help:      "Time clients were told to wait before retrying by the Retry-After header, in seconds.",
+			Buckets:   []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+		}, []string{"host", "status"}),
+	}
+	for _, c := range []prometheus.Collector{s.limited, s.retryAfter} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *rateLimitSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	host, status := labels.Value("host"), labels.Value("status")
+	if status == "429" {
+		s.limited.WithLabelValues(host).Inc()
+	}
+	if wait, ok := parseRetryAfter(labels.Extra["_retry_after"], time.Now()); ok {
+		s.retryAfter.WithLabelValues(host, status).Observe(wait.Seconds())
+	}
+}
+
+// parseRetryAfter returns the time to wait that a Retry-After header
+// value asks for, as of now. A date in the past means no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" || value == "-" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
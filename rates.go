@@ -0,0 +1,63 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ratesResponse is the /api/v1/rates response.
+type ratesResponse struct {
+	WindowSeconds     int                `json:"window_seconds"`
+	RequestsPerSecond float64            `json:"requests_per_second"`
+	ErrorsPerSecond   float64            `json:"errors_per_second"`
+	HitRatio          float64            `json:"hit_ratio"`
+	TotalRequests     uint64             `json:"total_requests"`
+	TimeQuantiles     map[string]float64 `json:"time_quantiles_seconds"`
+	Seconds           []secondRates      `json:"seconds"`
+}
+
+// ratesHandler serves the rates over a recent window, and the aggregates
+// of each second in it, as JSON. The window query parameter is a duration
+// such as 5m, by default 1m and at most 15m, so that what just happened
+// can be seen without waiting for Prometheus to scrape twice.
+func ratesHandler(stats *liveStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window := defaultRateWindow
+		if s := r.URL.Query().Get("window"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < time.Second {
+				http.Error(w, "invalid window "+s, http.StatusBadRequest)
+				return
+			}
+			if window = int(d / time.Second); window > rateWindow {
+				window = rateWindow
+			}
+		}
+		resp := ratesResponse{WindowSeconds: window, TimeQuantiles: make(map[string]float64)}
+		resp.RequestsPerSecond, resp.ErrorsPerSecond, resp.HitRatio, resp.TotalRequests = stats.Rates(window)
+		for _, q := range []struct {
+			name  string
+			value float64
+		}{{"0.5", 0.5}, {"0.9", 0.9}, {"0.99", 0.99}} {
+			resp.TimeQuantiles[q.name] = stats.Latency(window, q.value)
+		}
+		resp.Seconds = stats.Seconds(window)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// rawPathTrackFactor is how many more raw paths than are exported are
+// counted, so that paths on their way up can enter the top.
+const rawPathTrackFactor = 10
+
+var rawPathDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "raw_path_total"),
+	"Number of requests for each of the most requested paths as they were before path mappings, with the path they were mapped to.",
+	[]string{"path", "mapped"}, nil,
+)
+
+type rawPathCount struct {
+	mapped string
+	count  uint64
+}
+
+// rawPathSink counts requests by their path before mapping, so that
+// paths the mappings don't normalize, or normalize wrongly, can be found
+// from the metrics. Like surrogate keys, only the top most requested
+// paths are exported and a bounded number is counted, evicting the least
+// requested path for a new one, so the counts near the bottom are
+// overestimates.
+type rawPathSink struct {
+	top int
+
+	mu     sync.Mutex
+	counts map[string]*rawPathCount
+}
+
+func newRawPathSink(top int) (*rawPathSink, error) {
+	s := &rawPathSink{
+		top:    top,
+		counts: make(map[string]*rawPathCount, top*rawPathTrackFactor),
+	}
+	if err := prometheus.Register(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *rawPathSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	raw, ok := labels.Extra["_raw_path"]
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counts[raw]
+	if c == nil {
+		c = s.evict()
+		s.counts[raw] = c
+	}
+	// The mappings may have been reloaded since the path was last seen
+	c.mapped = labels.Value("path")
+	c.count++
+}
+
+// evict returns the count for a new path, taking over the count of the
+// least requested path if the table is full.
+func (s *rawPathSink) evict() *rawPathCount {
+	if len(s.counts) < s.top*rawPathTrackFactor {
+		return &rawPathCount{}
+	}
+	var minPath string
+	var min *rawPathCount
+	for path, c := range s.counts {
+		if min == nil || c.count < min.count {
+			minPath, min = path, c
+		}
+	}
+	delete(s.counts, minPath)
+	return min
+}
+
+// Describe implements prometheus.Collector.
+func (s *rawPathSink) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rawPathDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *rawPathSink) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	paths := make([]string, 0, len(s.counts))
+	for path := range s.counts {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		ci, cj := s.counts[paths[i]].count, s.counts[paths[j]].count
+		return ci > cj || ci == cj && paths[i] < paths[j]
+	})
+	if len(paths) > s.top {
+		paths = paths[:s.top]
+	}
+	counts := make([]rawPathCount, len(paths))
+	for i, path := range paths {
+		counts[i] = *s.counts[path]
+	}
+	s.mu.Unlock()
+	for i, path := range paths {
+		ch <- prometheus.MustNewConstMetric(rawPathDesc, prometheus.CounterValue, float64(counts[i].count), path, counts[i].mapped)
+	}
+}
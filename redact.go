@@ -0,0 +1,71 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const redacted = "<redacted>"
+
+// emailDomainLabel is a part of the domain of an email address. A number
+// followed by x is left out, so that the pixel densities of images such as
+// icon@2x.png or icon@1.5x.png aren't taken for domains.
+const emailDomainLabel = `(?:[A-Za-z-][A-Za-z0-9-]*|\d+|\d+[A-WYZa-wyz-][A-Za-z0-9-]*|\d+[xX][A-Za-z0-9-]+)`
+
+// defaultRedactPatterns match things that should never end up in a label:
+// email addresses, JSON Web Tokens, session IDs in path parameters, UUIDs
+// and long hex strings such as API keys.
+var defaultRedactPatterns = []string{
+	`[^/@]+@(?:` + emailDomainLabel + `\.)+[A-Za-z]{2,}\b`,
+	`eyJ[\w-]+\.[\w-]+\.[\w-]+`,
+	`(?i);(jsessionid|phpsessid|sid)=[^/;]*`,
+	`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	`[0-9a-fA-F]{32,}`,
+}
+
+// pathRedactor replaces sensitive parts of paths with "<redacted>". It is
+// applied after path mappings and the external normalizer, so whatever
+// those rules do, the patterns never reach the metrics.
+type pathRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+// newPathRedactor compiles the default patterns and any extra ones.
+func newPathRedactor(extra []string) (*pathRedactor, error) {
+	r := &pathRedactor{}
+	for _, expr := range append(append([]string(nil), defaultRedactPatterns...), extra...) {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %v", expr, err)
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+	return r, nil
+}
+
+// Redact returns path with all sensitive parts replaced, and whether
+// anything was.
+func (r *pathRedactor) Redact(path string) (string, bool) {
+	changed := false
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(path) {
+			path = pattern.ReplaceAllLiteralString(path, redacted)
+			changed = true
+		}
+	}
+	return path, changed
+}
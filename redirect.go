@@ -0,0 +1,84 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// redirectFormat logs the redirect target, and the Host header as sent,
+// since the host label may have been changed by the host mappings.
+const redirectFormat = `_location="%{Location}o" _request_host="%{host}i"`
+
+// redirectSink counts redirects by where they point, so that redirect
+// loops, such as between http and https or between www and the bare
+// domain, stand out from the other 3xx responses.
+type redirectSink struct {
+	redirects *prometheus.CounterVec
+}
+
+func newRedirectSink() (*redirectSink, error) {
+	s := &redirectSink{
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redirects_total",
+			Help:      "Number of 301, 302, 307 and 308 responses, by whether the Location is on the same host, another host, or missing.",
+		}, []string{"host", "status", "target"}),
+	}
+	if err := prometheus.Register(s.redirects); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *redirectSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	switch status := labels.Value("status"); status {
+	case "301", "302", "307", "308":
+		target := redirectTarget(labels.Extra["_location"], labels.Extra["_request_host"])
+		s.redirects.WithLabelValues(labels.Value("host"), status, target).Inc()
+	}
+}
+
+// redirectTarget tells whether location points to host: "same_host" if it
+// does or is relative, "other_host" if it doesn't, and "none" if it is
+// missing or not a URL.
+func redirectTarget(location, host string) string {
+	if location == "" || location == "-" {
+		return "none"
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "none"
+	}
+	if u.Host == "" || normalizeHost(u.Host) == normalizeHost(host) {
+		return "same_host"
+	}
+	return "other_host"
+}
+
+// normalizeHost lowercases a host name and strips the port and any
+// trailing dot.
+func normalizeHost(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i > strings.LastIndexByte(host, ']') {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,38 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestRedirectTarget(t *testing.T) {
+	tests := []struct {
+		location, host, want string
+	}{
+		{"", "example.com", "none"},
+		{"-", "example.com", "none"},
+		{"%zz", "example.com", "none"},
+		{"/login", "example.com", "same_host"},
+		{"https://example.com/login", "example.com", "same_host"},
+		{"https://Example.COM./login", "example.com:443", "same_host"},
+		{"https://[::1]:8443/", "[::1]", "same_host"},
+		{"//cdn.example.com/x", "example.com", "other_host"},
+		{"https://other.example/", "example.com", "other_host"},
+	}
+	for _, test := range tests {
+		if got := redirectTarget(test.location, test.host); got != test.want {
+			t.Errorf("redirectTarget(%q, %q) = %q, want %q", test.location, test.host, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+)
+
+// reloadStatus describes the outcome of the last reload.
+type reloadStatus struct {
+	Time    time.Time
+	Err     error
+	Changes []string
+}
+
+// reloader reloads the path mappings, host mappings and config file while
+// the exporter is running, and reports what changed. Settings given as
+// flags, like the VSL query, need a restart.
+type reloader struct {
+	mapper    *mappings.PathMapper
+	hosts     *mappings.HostMapper
+	processor *logProcessor
+	// allowPost makes POST /-/reload reload, as -web.enable-lifecycle asks.
+	allowPost bool
+
+	mu        sync.Mutex
+	cfg       *config
+	last      reloadStatus
+	success   prometheus.Gauge
+	timestamp prometheus.Gauge
+}
+
+// newReloader creates a reloader. Reloading over HTTP is only allowed if
+// allowPost is set; SIGHUP always works.
+func newReloader(mapper *mappings.PathMapper, hosts *mappings.HostMapper, processor *logProcessor, cfg *config, allowPost bool) (*reloader, error) {
+	r := &reloader{
+		mapper:    mapper,
+		hosts:     hosts,
+		processor: processor,
+		allowPost: allowPost,
+		cfg:       cfg,
+		last:      reloadStatus{Time: time.Now()},
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		}),
+		timestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_config_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{r.success, r.timestamp} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	r.success.Set(1)
+	r.timestamp.SetToCurrentTime()
+	return r, nil
+}
+
+// Reload reads the files again and applies them. Nothing is applied
+// unless all of them are valid.
+func (r *reloader) Reload() reloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := reloadStatus{Time: time.Now()}
+	status.Changes, status.Err = r.reload()
+	r.last = status
+	if status.Err != nil {
+		log.Errorf("reload failed: %v", status.Err)
+		r.success.Set(0)
+		return status
+	}
+	if len(status.Changes) == 0 {
+		log.Info("reloaded, nothing changed")
+	}
+	for _, change := range status.Changes {
+		log.Infof("reloaded: %s", change)
+	}
+	r.success.Set(1)
+	r.timestamp.SetToCurrentTime()
+	return status
+}
+
+func (r *reloader) reload() ([]string, error) {
+	mapper, err := loadPathMappings()
+	if err != nil {
+		return nil, fmt.Errorf("path mappings: %v", err)
+	}
+	hosts, err := mappings.LoadHosts(*hostMapFile)
+	if err != nil {
+		return nil, fmt.Errorf("host mappings: %v", err)
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.processor.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	changes = append(changes, diffLists("path mapping rules", r.mapper.RuleStrings(), mapper.RuleStrings())...)
+	r.mapper.SetRules(mapper.Rules)
+	changes = append(changes, diffLists("host mapping rules", r.hosts.RuleStrings(), hosts.RuleStrings())...)
+	r.hosts.SetRules(hosts.Rules)
+
+	changes = append(changes, diffLists("redact patterns", r.cfg.Redact, cfg.Redact)...)
+	if !reflect.DeepEqual(r.cfg.Metrics, cfg.Metrics) {
+		changes = append(changes, "metric help texts changed, which only applies to metrics not exported yet")
+	}
+	if !reflect.DeepEqual(r.cfg.Tenants, cfg.Tenants) {
+		changes = append(changes, "tenants changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.SLOs, cfg.SLOs) {
+		changes = append(changes, "SLOs changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.Apdex, cfg.Apdex) {
+		changes = append(changes, "Apdex groups changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.Rollups, cfg.Rollups) {
+		changes = append(changes, "rollups changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.ContentClass, cfg.ContentClass) {
+		changes = append(changes, "content classes changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.Buckets, cfg.Buckets) {
+		changes = append(changes, "bucket layouts changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.Labels, cfg.Labels) {
+		changes = append(changes, "labels changed, which needs a restart")
+	}
+	if !reflect.DeepEqual(r.cfg.Shard, cfg.Shard) {
+		changes = append(changes, "shard label changed, which needs a restart")
+	}
+	r.cfg = cfg
+	return changes, nil
+}
+
+// diffLists describes how the list of things old became new, as a summary
+// followed by the added and removed items.
+func diffLists(what string, old, new []string) []string {
+	count := func(list []string) map[string]int {
+		counts := make(map[string]int, len(list))
+		for _, item := range list {
+			counts[item]++
+		}
+		return counts
+	}
+	oldCounts, newCounts := count(old), count(new)
+	var added, removed []string
+	for _, item := range new {
+		if oldCounts[item] > 0 {
+			oldCounts[item]--
+		} else {
+			added = append(added, "+ "+item)
+		}
+	}
+	for _, item := range old {
+		if newCounts[item] > 0 {
+			newCounts[item]--
+		} else {
+			removed = append(removed, "- "+item)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		if !reflect.DeepEqual(old, new) {
+			return []string{what + " reordered"}
+		}
+		return nil
+	}
+	summary := fmt.Sprintf("%s: %d added, %d removed", what, len(added), len(removed))
+	return append(append([]string{summary}, added...), removed...)
+}
+
+// Status returns the outcome of the last reload.
+func (r *reloader) Status() reloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// ServeHTTP reloads on POST, if allowed, and shows the outcome of the last
+// reload on GET.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var status reloadStatus
+	switch req.Method {
+	case http.MethodPost:
+		if !r.allowPost {
+			http.Error(w, "Lifecycle API is not enabled.", http.StatusForbidden)
+			return
+		}
+		status = r.Reload()
+	case http.MethodGet, http.MethodHead:
+		status = r.Status()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if status.Err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "reload at %s failed: %v\n", status.Time.Format(time.RFC3339), status.Err)
+		return
+	}
+	fmt.Fprintf(w, "reloaded at %s\n", status.Time.Format(time.RFC3339))
+	for _, change := range status.Changes {
+		fmt.Fprintln(w, change)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffLists(t *testing.T) {
+	tests := []struct {
+		old, new []string
+		want     []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, nil},
+		{nil, nil, nil},
+		{[]string{"a", "b"}, []string{"b", "a"}, []string{"rules reordered"}},
+		{[]string{"a"}, []string{"a", "b"}, []string{"rules: 1 added, 0 removed", "+ b"}},
+		{[]string{"a", "b"}, []string{"c"}, []string{"rules: 1 added, 2 removed", "+ c", "- a", "- b"}},
+		// Duplicates are counted
+		{[]string{"a", "a"}, []string{"a"}, []string{"rules: 0 added, 1 removed", "- a"}},
+	}
+	for _, test := range tests {
+		if got := diffLists("rules", test.old, test.new); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diffLists(%q, %q) = %q, want %q", test.old, test.new, got, test.want)
+		}
+	}
+}
+
+func TestReloaderServeHTTP(t *testing.T) {
+	// Without allowPost, nothing here reaches Reload, which needs a
+	// processor and mappings
+	r := &reloader{last: reloadStatus{Time: time.Unix(0, 0).UTC(), Changes: []string{"rules reordered"}}}
+	tests := []struct {
+		method string
+		code   int
+		body   string
+	}{
+		{http.MethodGet, http.StatusOK, "reloaded at 1970-01-01T00:00:00Z\nrules reordered\n"},
+		{http.MethodPost, http.StatusForbidden, "Lifecycle API is not enabled.\n"},
+		{http.MethodPut, http.StatusMethodNotAllowed, "method not allowed\n"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(test.method, "/-/reload", strings.NewReader("")))
+		if rec.Code != test.code || rec.Body.String() != test.body {
+			t.Errorf("%s /-/reload = %d %q, want %d %q", test.method, rec.Code, rec.Body.String(), test.code, test.body)
+		}
+	}
+}
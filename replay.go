@@ -0,0 +1,101 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// vxidFormat is the varnishncsa field with the transaction ID, used to
+// recognize transactions that a restarted varnishncsa logs again, and to
+// find the transactions of slow requests.
+const vxidFormat = `_vxid="%{Varnish:vxid}x"`
+
+const (
+	// replayMemory is the number of most recent transaction IDs kept.
+	replayMemory = 100000
+	// replayWindow is how long after a restart transactions are checked
+	// against the IDs seen before it. It is kept short, as transaction IDs
+	// start over when varnishd itself restarts.
+	replayWindow = 30 * time.Second
+)
+
+// replayFilter remembers the IDs of the most recent transactions, and
+// for a while after varnishncsa restarts, tells which transactions it has
+// seen before.
+type replayFilter struct {
+	mu      sync.Mutex
+	seen    map[uint64]bool
+	ring    []uint64
+	next    int
+	checkTo time.Time
+
+	skipped prometheus.Counter
+}
+
+func newReplayFilter() (*replayFilter, error) {
+	f := &replayFilter{
+		seen: make(map[uint64]bool, replayMemory),
+		ring: make([]uint64, 0, replayMemory),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_replayed_lines_skipped_total",
+			Help:      "Number of log lines skipped because a restarted varnishncsa logged their transactions again.",
+		}),
+	}
+	if err := prometheus.Register(f.skipped); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Restarted starts checking transactions against those seen so far.
+func (f *replayFilter) Restarted() {
+	f.mu.Lock()
+	f.checkTo = time.Now().Add(replayWindow)
+	f.mu.Unlock()
+}
+
+// Replayed records the transaction with the given ID, and tells whether it
+// was already seen before a recent restart. Transactions without an ID are
+// never considered replayed.
+func (f *replayFilter) Replayed(vxid string) bool {
+	id, err := strconv.ParseUint(vxid, 10, 64)
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[id] {
+		if time.Now().Before(f.checkTo) {
+			f.skipped.Inc()
+			return true
+		}
+		return false
+	}
+	if len(f.ring) < replayMemory {
+		f.ring = append(f.ring, id)
+	} else {
+		delete(f.seen, f.ring[f.next])
+		f.ring[f.next] = id
+		f.next = (f.next + 1) % replayMemory
+	}
+	f.seen[id] = true
+	return false
+}
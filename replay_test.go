@@ -0,0 +1,54 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReplayFilter(t *testing.T) {
+	// Not made with newReplayFilter, which registers its counter
+	f := &replayFilter{
+		seen:    make(map[uint64]bool),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{Name: "skipped"}),
+	}
+	steps := []struct {
+		restart bool
+		vxid    string
+		want    bool
+	}{
+		{vxid: "1"},
+		{vxid: "2"},
+		// Before a restart, a repeated ID is counted again
+		{vxid: "1"},
+		{vxid: "-"},
+		{restart: true, vxid: "1", want: true},
+		{vxid: "2", want: true},
+		{vxid: "3"},
+		{vxid: "3", want: true},
+		{vxid: "-"},
+		{vxid: ""},
+	}
+	for i, step := range steps {
+		if step.restart {
+			f.Restarted()
+		}
+		if got := f.Replayed(step.vxid); got != step.want {
+			t.Errorf("step %d: Replayed(%q) = %v, want %v", i, step.vxid, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/collector"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// rollup is a view of the request metrics with only some of the labels.
+type rollup struct {
+	suffix    string
+	labels    []string
+	collector *collector.Collector
+}
+
+// rollupSink keeps lower-cardinality copies of the request metrics, such
+// as varnish_request_time_by_host with only a host label, so that alerting
+// rules don't have to aggregate all series at query time.
+type rollupSink struct {
+	rollups []*rollup
+	namer   *metricNamer
+}
+
+func newRollupSink(cfg *config, namer *metricNamer) *rollupSink {
+	s := &rollupSink{namer: namer}
+	for _, c := range cfg.Rollups {
+		r := &rollup{suffix: "_" + c.Name, labels: c.Labels}
+		by := " Rolled up by " + strings.Join(c.Labels, ", ") + "."
+		r.collector = collector.New(namespace, prometheus.DefaultRegisterer, func(name string) string {
+			return cfg.MetricHelp(strings.TrimSuffix(name, r.suffix)) + by
+		})
+		s.rollups = append(s.rollups, r)
+	}
+	return s
+}
+
+// Record implements sink.
+func (s *rollupSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	for _, r := range s.rollups {
+		view := &parser.Labelset{Names: r.labels, Values: make([]string, len(r.labels))}
+		for i, name := range r.labels {
+			view.Values[i] = rollupLabelValue(labels, name)
+		}
+		for _, m := range metrics {
+			for _, name := range s.namer.Names(m.Name) {
+				r.collector.Observe(name+r.suffix, view, m.Value)
+			}
+		}
+	}
+}
+
+// rollupLabelValue returns the value of the named label. status_class is
+// derived from the status, as 2xx, 3xx and so on.
+func rollupLabelValue(labels *parser.Labelset, name string) string {
+	if name == "status_class" {
+		if status := labels.Value("status"); len(status) == 3 {
+			return status[:1] + "xx"
+		}
+		return "unknown"
+	}
+	return labels.Value(name)
+}
@@ -0,0 +1,115 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/procfs"
+)
+
+// maxSampleDivisor is the most adaptive sampling will back off to.
+const maxSampleDivisor = 1024
+
+// sampler keeps every n-th log line. With adaptive sampling, n is doubled
+// while the exporter is overloaded and halved again when the load drops,
+// but never goes below the configured divisor.
+type sampler struct {
+	base    int64
+	divisor int64
+	n       uint64
+	rate    prometheus.Gauge
+}
+
+func newSampler(divisor int) (*sampler, error) {
+	if divisor < 1 {
+		divisor = 1
+	}
+	s := &sampler{
+		base:    int64(divisor),
+		divisor: int64(divisor),
+		rate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_sample_rate",
+			Help:      "Fraction of log lines currently recorded in request metrics. Divide counts by this to estimate the real totals.",
+		}),
+	}
+	s.rate.Set(1 / float64(divisor))
+	if err := prometheus.Register(s.rate); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Keep reports whether the next log line should be processed.
+func (s *sampler) Keep() bool {
+	divisor := atomic.LoadInt64(&s.divisor)
+	return atomic.AddUint64(&s.n, 1)%uint64(divisor) == 0
+}
+
+func (s *sampler) setDivisor(divisor int64) {
+	if divisor < s.base {
+		divisor = s.base
+	}
+	if divisor > maxSampleDivisor {
+		divisor = maxSampleDivisor
+	}
+	if old := atomic.SwapInt64(&s.divisor, divisor); old != divisor {
+		log.Infof("sampling 1 of every %d log lines", divisor)
+	}
+	s.rate.Set(1 / float64(divisor))
+}
+
+// adapt checks the queue fill level and the exporter's CPU usage every
+// interval and adjusts the sampling divisor. maxCPU is the CPU usage, in
+// cores, at which the exporter is considered overloaded.
+func (s *sampler) adapt(queueLen func() (int, int), maxCPU float64, interval time.Duration) {
+	proc, err := procfs.Self()
+	if err != nil {
+		log.Errorf("adaptive sampling can't read CPU usage: %v", err)
+	}
+	lastCPU := cpuTime(proc, err)
+	lastTime := time.Now()
+	for range time.Tick(interval) {
+		now := time.Now()
+		cpu := cpuTime(proc, err)
+		usage := (cpu - lastCPU) / now.Sub(lastTime).Seconds()
+		lastCPU, lastTime = cpu, now
+
+		length, capacity := queueLen()
+		fill := float64(length) / float64(capacity)
+		divisor := atomic.LoadInt64(&s.divisor)
+		switch {
+		case fill > 0.5 || usage > maxCPU:
+			s.setDivisor(divisor * 2)
+		case fill < 0.1 && usage < maxCPU/2:
+			s.setDivisor(divisor / 2)
+		}
+	}
+}
+
+func cpuTime(proc procfs.Proc, err error) float64 {
+	if err != nil {
+		return 0
+	}
+	stat, err := proc.Stat()
+	if err != nil {
+		return 0
+	}
+	return stat.CPUTime()
+}
@@ -0,0 +1,188 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// slowScrape is how long a scrape may take before it is logged as a
+// warning, as scrapers typically time out after 10 seconds.
+const slowScrape = 5 * time.Second
+
+var (
+	scrapesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_scrapes_in_flight",
+		Help:      "Number of scrapes of the metrics endpoints being served.",
+	})
+	scrapesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_scrapes_rejected_total",
+		Help:      "Number of scrapes rejected because -web.max-concurrent-scrapes were already being served.",
+	})
+	scrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "exporter_scrape_duration_seconds",
+		Help:      "Time taken to serve scrapes of the metrics endpoints.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(scrapesInFlight, scrapesRejected, scrapeDuration)
+}
+
+// scrapeSlots limits the number of concurrent scrapes across all metrics
+// endpoints, as each one gathers and encodes the whole registry.
+var (
+	scrapeSlots     chan struct{}
+	scrapeSlotsOnce sync.Once
+)
+
+// metricsHandler serves the metrics of gatherer, gzip-compressed for
+// scrapers that accept it, and limited to -web.max-response-bytes.
+// Scrapes beyond -web.max-concurrent-scrapes are rejected with 503
+// Service Unavailable.
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	if *maxRespBytes > 0 {
+		gatherer = &limitGatherer{gatherer: gatherer, limit: *maxRespBytes}
+	}
+	return scrapeHandler(promhttp.HandlerFor(gatherer, handlerOpts()))
+}
+
+// scrapeHandler wraps a handler that serves metrics, to limit the number
+// of concurrent scrapes and to measure and log them.
+func scrapeHandler(handler http.Handler) http.Handler {
+	scrapeSlotsOnce.Do(func() {
+		if *maxScrapes > 0 {
+			scrapeSlots = make(chan struct{}, *maxScrapes)
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scrapeSlots != nil {
+			select {
+			case scrapeSlots <- struct{}{}:
+				defer func() { <-scrapeSlots }()
+			default:
+				scrapesRejected.Inc()
+				http.Error(w, "too many concurrent scrapes", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		scrapesInFlight.Inc()
+		defer scrapesInFlight.Dec()
+		start := time.Now()
+		cw := &countingResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(cw, r)
+		took := time.Since(start)
+		scrapeDuration.Observe(took.Seconds())
+		if took > slowScrape {
+			log.Warnf("slow scrape of %s from %s took %v, %d bytes", r.URL.Path, r.RemoteAddr, took, cw.bytes)
+		} else {
+			log.Debugf("scrape of %s from %s took %v, %d bytes", r.URL.Path, r.RemoteAddr, took, cw.bytes)
+		}
+	})
+}
+
+// countingResponseWriter counts the bytes written to the response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// truncatedFamiliesName is the metric that tells how many metric families
+// were left out of a scrape to keep it within -web.max-response-bytes.
+const truncatedFamiliesName = namespace + "_exporter_scrape_truncated_families"
+
+// limitGatherer leaves out the biggest metric families, by the size of
+// their uncompressed text exposition, until the rest fit within limit
+// bytes. It adds a gauge with the number of families left out, so that
+// truncated scrapes can be told from shrinking traffic.
+type limitGatherer struct {
+	gatherer prometheus.Gatherer
+	limit    int64
+}
+
+func (g *limitGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	if err != nil {
+		return mfs, err
+	}
+	sizes := make([]int64, len(mfs))
+	var total int64
+	for i, mf := range mfs {
+		n, err := expfmt.MetricFamilyToText(ioutil.Discard, mf)
+		if err != nil {
+			return mfs, err
+		}
+		sizes[i] = int64(n)
+		total += sizes[i]
+	}
+	var dropped []string
+	if total > g.limit {
+		bySize := make([]int, len(mfs))
+		for i := range bySize {
+			bySize[i] = i
+		}
+		sort.SliceStable(bySize, func(i, j int) bool { return sizes[bySize[i]] > sizes[bySize[j]] })
+		drop := make(map[int]bool)
+		for _, i := range bySize {
+			if total <= g.limit {
+				break
+			}
+			drop[i] = true
+			total -= sizes[i]
+			dropped = append(dropped, mfs[i].GetName())
+		}
+		kept := mfs[:0]
+		for i, mf := range mfs {
+			if !drop[i] {
+				kept = append(kept, mf)
+			}
+		}
+		mfs = kept
+		log.Warnf("scrape exceeded -web.max-response-bytes, left out %d metric families: %v", len(dropped), dropped)
+	}
+	truncated := &dto.MetricFamily{
+		Name: proto.String(truncatedFamiliesName),
+		Help: proto.String("Number of metric families left out of this scrape to keep it within -web.max-response-bytes."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(len(dropped)))},
+		}},
+	}
+	i := sort.Search(len(mfs), func(i int) bool { return mfs[i].GetName() >= truncatedFamiliesName })
+	mfs = append(mfs, nil)
+	copy(mfs[i+1:], mfs[i:])
+	mfs[i] = truncated
+	return mfs, nil
+}
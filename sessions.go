@@ -0,0 +1,151 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// sessionCollector exports client connection metrics from the SessOpen and
+// SessClose records, which varnishncsa doesn't show, by running a separate
+// varnishlog in raw grouping mode. If requests are counted, the Begin
+// records of the requests tell which connection they arrived on.
+type sessionCollector struct {
+	opened   prometheus.Counter
+	closed   *prometheus.CounterVec
+	duration prometheus.Histogram
+	requests prometheus.Histogram
+
+	// open has the number of requests so far on each connection seen
+	// opening, by session vxid.
+	open map[string]int
+}
+
+// newSessionCollector creates a sessionCollector, which counts the
+// requests on each connection if requests is set.
+func newSessionCollector(requests bool) (*sessionCollector, error) {
+	c := &sessionCollector{
+		opened: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_opened_total",
+			Help:      "Number of client connections opened.",
+		}),
+		closed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_closed_total",
+			Help:      "Number of client connections closed, by reason.",
+		}, []string{"reason"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_duration_seconds",
+			Help:      "Time client connections were open, in seconds.",
+			Buckets:   []float64{.01, .1, 1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+		}),
+	}
+	collectors := []prometheus.Collector{c.opened, c.closed, c.duration}
+	if requests {
+		c.requests = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_requests",
+			Help:      "Number of requests on client connections, observed when they are closed.",
+			Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		})
+		c.open = make(map[string]int)
+		collectors = append(collectors, c.requests)
+	}
+	for _, col := range collectors {
+		if err := prometheus.Register(col); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Run starts varnishlog and processes its output until it exits.
+func (c *sessionCollector) Run() error {
+	tags := "SessOpen,SessClose"
+	if c.requests != nil {
+		tags += ",Begin"
+	}
+	args := []string{"-g", "raw", "-i", tags}
+	if *instance != "" {
+		args = append(args, "-n", *instance)
+	}
+	cmd := exec.Command("varnishlog", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	log.Infof("Running command: varnishlog %v", args)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.processLines(stdout)
+	return cmd.Wait()
+}
+
+// processLines reads varnishlog raw output, such as
+//
+//	32769 SessOpen       c 127.0.0.1 39458 a0 127.0.0.1 6081 1580000000.000000 17
+//	32770 Begin          c req 32769 rxreq
+//	32769 SessClose      c REM_CLOSE 0.010
+//
+// Requests on connections opened before varnishlog started are not
+// counted, since their count would be too low.
+func (c *sessionCollector) processLines(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[1] {
+		case "SessOpen":
+			c.opened.Inc()
+			if c.open != nil {
+				c.open[fields[0]] = 0
+			}
+		case "Begin":
+			// ESI subrequests and restarts are not requests of their own
+			if c.open == nil || len(fields) < 6 || fields[3] != "req" || fields[5] != "rxreq" {
+				continue
+			}
+			if n, ok := c.open[fields[4]]; ok {
+				c.open[fields[4]] = n + 1
+			}
+		case "SessClose":
+			if len(fields) < 5 {
+				continue
+			}
+			c.closed.WithLabelValues(fields[3]).Inc()
+			if duration, err := strconv.ParseFloat(fields[4], 64); err == nil {
+				c.duration.Observe(duration)
+			}
+			if n, ok := c.open[fields[0]]; ok {
+				c.requests.Observe(float64(n))
+				delete(c.open, fields[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// shardGatherer only returns the series whose hash modulo total equals
+// shard, so that a set of shards partitions all series.
+type shardGatherer struct {
+	gatherer prometheus.Gatherer
+	shard    uint64
+	total    uint64
+}
+
+func (g *shardGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	result := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		metrics := make([]*dto.Metric, 0, len(mf.Metric))
+		for _, m := range mf.Metric {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(mf.GetName()))
+			_, _ = h.Write([]byte(labelSignature(m)))
+			if h.Sum64()%g.total == g.shard {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			result = append(result, mf)
+		}
+	}
+	return result, err
+}
+
+// parseShard parses "n-of-m", where n counts from 1.
+func parseShard(s string) (shard, total uint64, err error) {
+	if _, err = fmt.Sscanf(s, "%d-of-%d", &shard, &total); err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected n-of-m", s)
+	}
+	if total == 0 || shard == 0 || shard > total {
+		return 0, 0, fmt.Errorf("invalid shard %q, n must be between 1 and m", s)
+	}
+	if fmt.Sprintf("%d-of-%d", shard, total) != s {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected n-of-m", s)
+	}
+	return shard - 1, total, nil
+}
+
+// shardHandler serves <prefix><n-of-m>, exposing shard n of m disjoint
+// subsets of all series.
+func shardHandler(prefix string, gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shard, total, err := parseShard(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		sg := &shardGatherer{gatherer: gatherer, shard: shard, total: total}
+		metricsHandler(sg).ServeHTTP(w, r)
+	})
+}
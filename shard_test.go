@@ -0,0 +1,88 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		s            string
+		shard, total uint64
+		err          bool
+	}{
+		{s: "1-of-3", shard: 0, total: 3},
+		{s: "3-of-3", shard: 2, total: 3},
+		{s: "0-of-3", err: true},
+		{s: "4-of-3", err: true},
+		{s: "1-of-0", err: true},
+		{s: "01-of-3", err: true},
+		{s: "1-of-3x", err: true},
+		{s: "one", err: true},
+	}
+	for _, test := range tests {
+		shard, total, err := parseShard(test.s)
+		if test.err != (err != nil) || shard != test.shard || total != test.total {
+			t.Errorf("parseShard(%q) = %d, %d, %v", test.s, shard, total, err)
+		}
+	}
+}
+
+// TestShardGatherer checks that the shards of a set partition the series.
+func TestShardGatherer(t *testing.T) {
+	families := func() ([]*dto.MetricFamily, error) {
+		var mfs []*dto.MetricFamily
+		for _, name := range []string{"requests", "errors"} {
+			mf := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_COUNTER.Enum()}
+			for i := 0; i < 100; i++ {
+				mf.Metric = append(mf.Metric, &dto.Metric{
+					Label:   []*dto.LabelPair{labelPair("path", fmt.Sprintf("/%d", i))},
+					Counter: &dto.Counter{Value: proto.Float64(1)},
+				})
+			}
+			mfs = append(mfs, mf)
+		}
+		return mfs, nil
+	}
+	const total = 3
+	served := make(map[string]int)
+	for shard := uint64(0); shard < total; shard++ {
+		mfs, err := (&shardGatherer{gatherer: gatherFunc(families), shard: shard, total: total}).Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if len(mf.Metric) == 0 {
+				t.Errorf("shard %d serves %s without series", shard, mf.GetName())
+			}
+			for _, m := range mf.Metric {
+				served[mf.GetName()+labelSignature(m)]++
+			}
+		}
+	}
+	if len(served) != 200 {
+		t.Errorf("the shards serve %d series, want 200", len(served))
+	}
+	for series, n := range served {
+		if n != 1 {
+			t.Errorf("%q is served by %d shards", series, n)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// sideFormat is the varnishncsa field telling client transactions from
+// backend transactions, which the parser turns into a side label of
+// "client" or "backend".
+const sideFormat = `side="%{Varnish:side}x"`
+
+// sideExamples are PromQL queries relating the backend requests to the
+// client requests. TIME is replaced by the name of the request time
+// histogram.
+const sideExamples = `# Fraction of client requests that needed a backend request, by host
+sum by (host) (rate(TIME_count{side="backend"}[5m]))
+  / sum by (host) (rate(TIME_count{side="client"}[5m]))
+
+# Time spent waiting for backends, as a fraction of the time spent on
+# client requests, by host
+sum by (host) (rate(TIME_sum{side="backend"}[5m]))
+  / sum by (host) (rate(TIME_sum{side="client"}[5m]))
+
+# 99th percentile request time on each side, by host
+histogram_quantile(0.99, sum by (side, host, le) (rate(TIME_bucket[5m])))
+
+# Backend 5xx responses that reached clients as 5xx responses, by host
+sum by (host) (rate(TIME_count{side="client",status=~"5.."}[5m]))
+  / sum by (host) (rate(TIME_count{side="backend",status=~"5.."}[5m]))
+`
+
+// examplesHandler serves the example PromQL queries for the metrics as
+// they are named with the current -metrics.names.
+func examplesHandler(namer *metricNamer, backend bool) http.Handler {
+	examples := strings.Replace(sideExamples, "TIME", namespace+"_"+namer.Names("time")[0], -1)
+	if !backend {
+		examples = "# These need -varnish.backend, which adds the side label.\n\n" + examples
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(examples))
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// requestMatcher selects requests by host name patterns and a path regexp.
+type requestMatcher struct {
+	hosts []*regexp.Regexp
+	path  *regexp.Regexp
+}
+
+// newRequestMatcher compiles host name patterns, in which * matches any
+// part of a name, and a path regexp that has already been validated. No
+// patterns match all hosts, and an empty path regexp all paths.
+func newRequestMatcher(hosts []string, path string) requestMatcher {
+	var m requestMatcher
+	for _, host := range hosts {
+		m.hosts = append(m.hosts, mappings.HostPattern(host))
+	}
+	if path != "" {
+		m.path = regexp.MustCompile(path)
+	}
+	return m
+}
+
+// Matches tells whether a request for host and path is selected.
+func (m *requestMatcher) Matches(host, path string) bool {
+	if m.path != nil && !m.path.MatchString(path) {
+		return false
+	}
+	if len(m.hosts) == 0 {
+		return true
+	}
+	for _, pattern := range m.hosts {
+		if pattern.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// slo is a latency objective from the config file.
+type slo struct {
+	requestMatcher
+	name      string
+	threshold float64
+}
+
+// sloSink counts the requests that met or missed each latency objective,
+// so that burn rates can be computed from plain counter rates instead of
+// histogram_quantile.
+type sloSink struct {
+	slos      []*slo
+	good      *prometheus.CounterVec
+	bad       *prometheus.CounterVec
+	objective *prometheus.GaugeVec
+}
+
+func newSLOSink(configs []sloConfig) (*sloSink, error) {
+	s := &sloSink{
+		good: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "slo_good_total",
+			Help:      "Number of requests served within the latency threshold of the SLO.",
+		}, []string{"slo", "host"}),
+		bad: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "slo_bad_total",
+			Help:      "Number of requests that took longer than the latency threshold of the SLO.",
+		}, []string{"slo", "host"}),
+		objective: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "slo_objective",
+			Help:      "Fraction of requests that should be good, by SLO.",
+		}, []string{"slo"}),
+	}
+	for _, c := range []prometheus.Collector{s.good, s.bad, s.objective} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range configs {
+		o := &slo{
+			requestMatcher: newRequestMatcher(c.Hosts, c.Path),
+			name:           c.Name,
+			threshold:      c.Threshold.Seconds(),
+		}
+		s.objective.WithLabelValues(c.Name).Set(c.Objective)
+		s.slos = append(s.slos, o)
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *sloSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	for _, m := range metrics {
+		if m.Name != "time" {
+			continue
+		}
+		host, path := labels.Value("host"), labels.Value("path")
+		for _, o := range s.slos {
+			if !o.Matches(host, path) {
+				continue
+			}
+			if m.Value <= o.threshold {
+				s.good.WithLabelValues(o.name, host).Inc()
+			} else {
+				s.bad.WithLabelValues(o.name, host).Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// AgentX PDU types and header flags, from RFC 2741.
+const (
+	agentxOpen       = 1
+	agentxClose      = 2
+	agentxRegister   = 3
+	agentxGet        = 5
+	agentxGetNext    = 6
+	agentxGetBulk    = 7
+	agentxTestSet    = 8
+	agentxCommitSet  = 9
+	agentxUndoSet    = 10
+	agentxCleanupSet = 11
+	agentxResponse   = 18
+
+	agentxNonDefaultContext = 0x08
+	agentxNetworkByteOrder  = 0x10
+
+	agentxNotWritable = 17
+)
+
+// SNMP value types.
+const (
+	snmpGauge32      = 66
+	snmpCounter64    = 70
+	snmpNoSuchObject = 128
+	snmpEndOfMibView = 130
+)
+
+const (
+	// agentxRetryDelay is how long to wait before reconnecting to the
+	// master agent.
+	agentxRetryDelay = 10 * time.Second
+	// agentxDescription is how the sub-agent describes itself when opening
+	// a session.
+	agentxDescription = "varnish_request_exporter"
+)
+
+type oid []uint32
+
+func parseOID(s string) (oid, error) {
+	var o oid
+	for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		o = append(o, uint32(n))
+	}
+	return o, nil
+}
+
+func (o oid) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare orders OIDs lexicographically.
+func (o oid) compare(other oid) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+// snmpObject is a scalar served by the sub-agent.
+type snmpObject struct {
+	oid   oid
+	kind  uint16
+	value func() uint64
+}
+
+// snmpSubagent serves request aggregates as an AgentX sub-agent of a
+// master agent such as net-snmp's snmpd, for network management systems
+// that poll with SNMP.
+type snmpSubagent struct {
+	address string
+	base    oid
+	objects []snmpObject
+	order   binary.ByteOrder
+}
+
+func newSNMPSubagent(address, baseOID string, stats *liveStats) (*snmpSubagent, error) {
+	base, err := parseOID(baseOID)
+	if err != nil {
+		return nil, err
+	}
+	scalar := func(n uint32) oid {
+		return append(append(oid{}, base...), n, 0)
+	}
+	a := &snmpSubagent{address: address, base: base, order: binary.BigEndian}
+	a.objects = []snmpObject{
+		{scalar(1), snmpCounter64, func() uint64 {
+			_, _, _, total := stats.Rates(defaultRateWindow)
+			return total
+		}},
+		{scalar(2), snmpGauge32, func() uint64 {
+			requests, _, _, _ := stats.Rates(defaultRateWindow)
+			return uint64(math.Round(requests * defaultRateWindow))
+		}},
+		{scalar(3), snmpGauge32, func() uint64 {
+			_, _, hitRatio, _ := stats.Rates(defaultRateWindow)
+			return uint64(math.Round(hitRatio * 10000))
+		}},
+		{scalar(4), snmpGauge32, func() uint64 {
+			return uint64(math.Round(stats.Latency(defaultRateWindow, 0.95) * 1e6))
+		}},
+	}
+	return a, nil
+}
+
+// Run connects to the master agent and serves requests, reconnecting
+// whenever the connection is lost.
+func (a *snmpSubagent) Run() {
+	for {
+		if err := a.session(); err != nil {
+			log.Errorf("AgentX session with %s: %v, reconnecting in %v", a.address, err, agentxRetryDelay)
+		}
+		time.Sleep(agentxRetryDelay)
+	}
+}
+
+// dialAgentX connects to a master agent address in the net-snmp
+// agentXSocket format: a Unix socket path, optionally prefixed by
+// "unix:", or "tcp:host:port".
+func dialAgentX(address string) (net.Conn, error) {
+	if strings.HasPrefix(address, "tcp:") {
+		return net.DialTimeout("tcp", strings.TrimPrefix(address, "tcp:"), 10*time.Second)
+	}
+	return net.DialTimeout("unix", strings.TrimPrefix(address, "unix:"), 10*time.Second)
+}
+
+func (a *snmpSubagent) session() error {
+	conn, err := dialAgentX(a.address)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	var open bytes.Buffer
+	open.Write([]byte{0, 0, 0, 0}) // default timeout
+	a.writeOID(&open, a.base, false)
+	a.writeString(&open, agentxDescription)
+	if err := a.writePDU(conn, agentxOpen, 0, 0, 1, open.Bytes()); err != nil {
+		return err
+	}
+	resp, err := a.readResponse(conn)
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	sessionID := resp.sessionID
+
+	var register bytes.Buffer
+	register.Write([]byte{0, 127, 0, 0}) // default timeout and priority
+	a.writeOID(&register, a.base, false)
+	if err := a.writePDU(conn, agentxRegister, sessionID, 0, 2, register.Bytes()); err != nil {
+		return err
+	}
+	if _, err := a.readResponse(conn); err != nil {
+		return fmt.Errorf("register %s: %v", a.base, err)
+	}
+	log.Infof("Registered %s with the AgentX master agent at %s", a.base, a.address)
+
+	for {
+		p, err := a.readPDU(conn)
+		if err != nil {
+			return err
+		}
+		var errorStatus uint16
+		var varbinds []byte
+		switch p.kind {
+		case agentxGet, agentxGetNext, agentxGetBulk:
+			varbinds, err = a.handleGet(p)
+			if err != nil {
+				return err
+			}
+		case agentxTestSet:
+			errorStatus = agentxNotWritable
+		case agentxCommitSet, agentxUndoSet, agentxCleanupSet:
+		case agentxClose:
+			return fmt.Errorf("closed by the master agent")
+		default:
+			continue
+		}
+		var body bytes.Buffer
+		_ = binary.Write(&body, a.order, uint32(0)) // sysUpTime
+		_ = binary.Write(&body, a.order, errorStatus)
+		if errorStatus != 0 {
+			_ = binary.Write(&body, a.order, uint16(1))
+		} else {
+			_ = binary.Write(&body, a.order, uint16(0))
+		}
+		body.Write(varbinds)
+		if err := a.writePDU(conn, agentxResponse, p.sessionID, p.transactionID, p.packetID, body.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// handleGet answers Get, GetNext and GetBulk PDUs with a varbind list.
+func (a *snmpSubagent) handleGet(p *agentxPDU) ([]byte, error) {
+	r := &agentxReader{data: p.payload, order: p.order}
+	if p.flags&agentxNonDefaultContext != 0 {
+		r.readString()
+	}
+	var nonRepeaters, maxRepetitions int
+	if p.kind == agentxGetBulk {
+		nonRepeaters, maxRepetitions = int(r.uint16()), int(r.uint16())
+	}
+	type searchRange struct {
+		start, end oid
+		include    bool
+	}
+	var ranges []searchRange
+	for r.err == nil && len(r.data) > 0 {
+		start, include := r.readOID()
+		end, _ := r.readOID()
+		ranges = append(ranges, searchRange{start, end, include})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var out bytes.Buffer
+	if p.kind == agentxGet {
+		for _, sr := range ranges {
+			obj := a.lookup(sr.start)
+			if obj == nil {
+				a.writeVarbind(&out, sr.start, snmpNoSuchObject, 0)
+			} else {
+				a.writeVarbind(&out, obj.oid, obj.kind, obj.value())
+			}
+		}
+		return out.Bytes(), nil
+	}
+	next := func(sr searchRange) oid {
+		obj := a.next(sr.start, sr.include, sr.end)
+		if obj == nil {
+			a.writeVarbind(&out, sr.start, snmpEndOfMibView, 0)
+			return sr.start
+		}
+		a.writeVarbind(&out, obj.oid, obj.kind, obj.value())
+		return obj.oid
+	}
+	if p.kind == agentxGetNext {
+		maxRepetitions, nonRepeaters = 0, len(ranges)
+	}
+	if nonRepeaters > len(ranges) {
+		nonRepeaters = len(ranges)
+	}
+	for _, sr := range ranges[:nonRepeaters] {
+		next(sr)
+	}
+	repeaters := ranges[nonRepeaters:]
+	for i := 0; i < maxRepetitions; i++ {
+		for j := range repeaters {
+			repeaters[j].start, repeaters[j].include = next(repeaters[j]), false
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func (a *snmpSubagent) lookup(o oid) *snmpObject {
+	for i := range a.objects {
+		if a.objects[i].oid.compare(o) == 0 {
+			return &a.objects[i]
+		}
+	}
+	return nil
+}
+
+// next returns the first object after start, or at it if include is set,
+// and before end unless end is empty.
+func (a *snmpSubagent) next(start oid, include bool, end oid) *snmpObject {
+	for i := range a.objects {
+		c := a.objects[i].oid.compare(start)
+		if c < 0 || c == 0 && !include {
+			continue
+		}
+		if len(end) > 0 && a.objects[i].oid.compare(end) >= 0 {
+			return nil
+		}
+		return &a.objects[i]
+	}
+	return nil
+}
+
+func (a *snmpSubagent) writeOID(w *bytes.Buffer, o oid, include bool) {
+	var inc byte
+	if include {
+		inc = 1
+	}
+	w.Write([]byte{byte(len(o)), 0, inc, 0})
+	for _, n := range o {
+		_ = binary.Write(w, a.order, n)
+	}
+}
+
+func (a *snmpSubagent) writeString(w *bytes.Buffer, s string) {
+	_ = binary.Write(w, a.order, uint32(len(s)))
+	w.WriteString(s)
+	w.Write(make([]byte, (4-len(s)%4)%4))
+}
+
+func (a *snmpSubagent) writeVarbind(w *bytes.Buffer, name oid, kind uint16, value uint64) {
+	_ = binary.Write(w, a.order, kind)
+	w.Write([]byte{0, 0})
+	a.writeOID(w, name, false)
+	switch kind {
+	case snmpGauge32:
+		if value > math.MaxUint32 {
+			value = math.MaxUint32
+		}
+		_ = binary.Write(w, a.order, uint32(value))
+	case snmpCounter64:
+		_ = binary.Write(w, a.order, value)
+	}
+}
+
+func (a *snmpSubagent) writePDU(w io.Writer, kind byte, sessionID, transactionID, packetID uint32, payload []byte) error {
+	var pdu bytes.Buffer
+	pdu.Write([]byte{1, kind, agentxNetworkByteOrder, 0})
+	for _, n := range []uint32{sessionID, transactionID, packetID, uint32(len(payload))} {
+		_ = binary.Write(&pdu, a.order, n)
+	}
+	pdu.Write(payload)
+	_, err := w.Write(pdu.Bytes())
+	return err
+}
+
+type agentxPDU struct {
+	kind, flags   byte
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+	order         binary.ByteOrder
+	payload       []byte
+}
+
+func (a *snmpSubagent) readPDU(r io.Reader) (*agentxPDU, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	p := &agentxPDU{kind: header[1], flags: header[2], order: binary.LittleEndian}
+	if p.flags&agentxNetworkByteOrder != 0 {
+		p.order = binary.BigEndian
+	}
+	p.sessionID = p.order.Uint32(header[4:])
+	p.transactionID = p.order.Uint32(header[8:])
+	p.packetID = p.order.Uint32(header[12:])
+	size := p.order.Uint32(header[16:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("PDU too large (%d bytes)", size)
+	}
+	p.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, p.payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readResponse reads the response to an Open or Register PDU and returns
+// an error if the master agent reported one.
+func (a *snmpSubagent) readResponse(r io.Reader) (*agentxPDU, error) {
+	p, err := a.readPDU(r)
+	if err != nil {
+		return nil, err
+	}
+	if p.kind != agentxResponse || len(p.payload) < 8 {
+		return nil, fmt.Errorf("unexpected PDU type %d", p.kind)
+	}
+	if status := p.order.Uint16(p.payload[4:]); status != 0 {
+		return nil, fmt.Errorf("master agent returned error %d", status)
+	}
+	return p, nil
+}
+
+// agentxReader decodes the fields of a PDU payload, remembering the first
+// error.
+type agentxReader struct {
+	data  []byte
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *agentxReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("truncated PDU")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *agentxReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return r.order.Uint16(b)
+	}
+	return 0
+}
+
+func (r *agentxReader) readOID() (oid, bool) {
+	header := r.take(4)
+	if header == nil {
+		return nil, false
+	}
+	var o oid
+	if header[1] != 0 {
+		o = oid{1, 3, 6, 1, uint32(header[1])}
+	}
+	for i := 0; i < int(header[0]); i++ {
+		if b := r.take(4); b != nil {
+			o = append(o, r.order.Uint32(b))
+		}
+	}
+	return o, header[2] != 0
+}
+
+func (r *agentxReader) readString() string {
+	b := r.take(4)
+	if b == nil {
+		return ""
+	}
+	n := int(r.order.Uint32(b))
+	s := r.take(n + (4-n%4)%4)
+	if s == nil {
+		return ""
+	}
+	return string(s[:n])
+}
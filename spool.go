@@ -0,0 +1,251 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// spoolRetryInterval is how often spooled batches are retried when no
+// live batch gets through to tell that the sink is back.
+const spoolRetryInterval = 30 * time.Second
+
+// spoolFile is a batch on disk. Its name is the time it was spooled, so
+// that names sort oldest first, and the number of entries in it.
+type spoolFile struct {
+	name  string
+	size  int64
+	count int
+}
+
+// diskSpool keeps the encoded batches a push sink could not send in a
+// directory, up to a size limit, and sends them again, oldest first, once
+// the sink is back. Batches are kept across restarts.
+type diskSpool struct {
+	name     string
+	dir      string
+	maxBytes int64
+	post     func(body []byte) error
+	sent     prometheus.Counter
+	dropped  prometheus.Counter
+
+	mu        sync.Mutex
+	files     []spoolFile
+	size      int64
+	replaying string
+	resume    chan struct{}
+}
+
+// openSpool returns the spool of the named sink under -spool.dir, or nil
+// if spooling is disabled. post sends an encoded batch, and sent and
+// dropped are the sink's counters of entries.
+func openSpool(name string, post func(body []byte) error, sent, dropped prometheus.Counter) (*diskSpool, error) {
+	if *spoolDir == "" {
+		return nil, nil
+	}
+	s := &diskSpool{
+		name:     name,
+		dir:      filepath.Join(*spoolDir, name),
+		maxBytes: *spoolMaxSize,
+		post:     post,
+		sent:     sent,
+		dropped:  dropped,
+		resume:   make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		f, ok := parseSpoolFile(info)
+		if !ok {
+			continue
+		}
+		s.files = append(s.files, f)
+		s.size += f.size
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	if len(s.files) > 0 {
+		log.Infof("%d %s batches spooled in %s, sending them again", len(s.files), name, s.dir)
+		s.Resume()
+	}
+
+	labels := prometheus.Labels{"sink": name}
+	for _, m := range []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "exporter_spool_bytes",
+			Help:        "Size of the batches spooled to disk because their sink was failing.",
+			ConstLabels: labels,
+		}, func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(s.size)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "exporter_spool_batches",
+			Help:        "Number of batches spooled to disk because their sink was failing.",
+			ConstLabels: labels,
+		}, func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(len(s.files))
+		}),
+	} {
+		if err := prometheus.Register(m); err != nil {
+			return nil, err
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+func parseSpoolFile(info os.FileInfo) (spoolFile, bool) {
+	parts := strings.Split(strings.TrimSuffix(info.Name(), ".batch"), "-")
+	if info.IsDir() || !strings.HasSuffix(info.Name(), ".batch") || len(parts) != 2 {
+		return spoolFile{}, false
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return spoolFile{}, false
+	}
+	return spoolFile{name: info.Name(), size: info.Size(), count: count}, true
+}
+
+// Save spools a batch of count entries that could not be sent, making room
+// by dropping the oldest batches. It returns false if the batch was not
+// spooled, because s is nil, the batch could not be encoded or it doesn't
+// fit, and the caller should count it as dropped.
+func (s *diskSpool) Save(body []byte, count int) bool {
+	if s == nil || body == nil || int64(len(body)) > s.maxBytes {
+		return false
+	}
+	f := spoolFile{
+		name:  fmt.Sprintf("%019d-%d.batch", time.Now().UnixNano(), count),
+		size:  int64(len(body)),
+		count: count,
+	}
+	// Write under another name and rename, so that a crash doesn't leave
+	// a partial batch to send
+	tmp := filepath.Join(s.dir, f.name+".tmp")
+	if err := ioutil.WriteFile(tmp, body, 0640); err != nil {
+		log.Errorf("could not spool %s batch: %v", s.name, err)
+		return false
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, f.name)); err != nil {
+		log.Errorf("could not spool %s batch: %v", s.name, err)
+		_ = os.Remove(tmp)
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.size+f.size > s.maxBytes {
+		// Leave the batch being sent again, it is on its way out
+		i := 0
+		if len(s.files) > 0 && s.files[0].name == s.replaying {
+			i = 1
+		}
+		if i >= len(s.files) {
+			break
+		}
+		old := s.files[i]
+		s.files = append(s.files[:i], s.files[i+1:]...)
+		s.size -= old.size
+		if err := os.Remove(filepath.Join(s.dir, old.name)); err != nil {
+			log.Warnf("could not remove spooled %s batch: %v", s.name, err)
+		}
+		s.dropped.Add(float64(old.count))
+	}
+	s.files = append(s.files, f)
+	s.size += f.size
+	return true
+}
+
+// Resume tells the spool that the sink is back, so that spooled batches
+// are sent right away. It does nothing if s is nil.
+func (s *diskSpool) Resume() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.resume <- struct{}{}:
+	default:
+	}
+}
+
+func (s *diskSpool) run() {
+	ticker := time.NewTicker(spoolRetryInterval)
+	for {
+		select {
+		case <-s.resume:
+		case <-ticker.C:
+		}
+		s.replay()
+	}
+}
+
+// replay sends spooled batches, oldest first, until one fails.
+func (s *diskSpool) replay() {
+	for {
+		s.mu.Lock()
+		if len(s.files) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		f := s.files[0]
+		s.replaying = f.name
+		s.mu.Unlock()
+
+		path := filepath.Join(s.dir, f.name)
+		body, err := ioutil.ReadFile(path)
+		if err == nil {
+			if err = s.post(body); err != nil {
+				log.Warnf("could not send spooled %s batch, retrying later: %v", s.name, err)
+				s.mu.Lock()
+				s.replaying = ""
+				s.mu.Unlock()
+				return
+			}
+			s.sent.Add(float64(f.count))
+		} else {
+			log.Errorf("could not read spooled %s batch: %v", s.name, err)
+			s.dropped.Add(float64(f.count))
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("could not remove spooled %s batch: %v", s.name, err)
+		}
+		s.mu.Lock()
+		s.files = s.files[1:]
+		s.size -= f.size
+		s.replaying = ""
+		s.mu.Unlock()
+	}
+}
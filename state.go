@@ -0,0 +1,191 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/atomicfile"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// stateGatherer adds the values restored from a state snapshot to the
+// values gathered from the live registry, so counters and histograms
+// continue where the previous exporter process left off.
+type stateGatherer struct {
+	gatherer prometheus.Gatherer
+	baseline map[string]*dto.MetricFamily
+}
+
+func (g *stateGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	if len(g.baseline) == 0 {
+		return mfs, err
+	}
+	seen := make(map[string]bool)
+	for _, mf := range mfs {
+		base, ok := g.baseline[mf.GetName()]
+		if !ok {
+			continue
+		}
+		// A family whose type changed can't be merged, and serving both
+		// would make it a duplicate
+		seen[mf.GetName()] = true
+		if base.GetType() == mf.GetType() {
+			mergeMetricFamily(mf, base)
+		}
+	}
+	// The gathered families are changed further down the chain, as when
+	// adding the instance label, so the baseline is only handed out in
+	// copies
+	for name, base := range g.baseline {
+		if !seen[name] {
+			mfs = append(mfs, proto.Clone(base).(*dto.MetricFamily))
+		}
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, err
+}
+
+// mergeMetricFamily adds the values of base into mf. Series that only exist
+// in base are appended to mf.
+func mergeMetricFamily(mf *dto.MetricFamily, base *dto.MetricFamily) {
+	live := make(map[string]*dto.Metric, len(mf.Metric))
+	for _, m := range mf.Metric {
+		live[labelSignature(m)] = m
+	}
+	for _, b := range base.Metric {
+		m, ok := live[labelSignature(b)]
+		if !ok {
+			mf.Metric = append(mf.Metric, proto.Clone(b).(*dto.Metric))
+			continue
+		}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			value := m.GetCounter().GetValue() + b.GetCounter().GetValue()
+			m.Counter.Value = &value
+		case dto.MetricType_HISTOGRAM:
+			mergeHistogram(m.GetHistogram(), b.GetHistogram())
+		}
+	}
+}
+
+func mergeHistogram(h *dto.Histogram, base *dto.Histogram) {
+	// The text format has a +Inf bucket, which the client library leaves
+	// out as it is the sample count
+	buckets := base.Bucket
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1].GetUpperBound(), 1) {
+		buckets = buckets[:n-1]
+	}
+	if len(h.Bucket) != len(buckets) {
+		log.Debugf("not restoring histogram with changed bucket layout")
+		return
+	}
+	for i := range h.Bucket {
+		if h.Bucket[i].GetUpperBound() != buckets[i].GetUpperBound() {
+			log.Debugf("not restoring histogram with changed bucket layout")
+			return
+		}
+	}
+	for i := range h.Bucket {
+		count := h.Bucket[i].GetCumulativeCount() + buckets[i].GetCumulativeCount()
+		h.Bucket[i].CumulativeCount = &count
+	}
+	count := h.GetSampleCount() + base.GetSampleCount()
+	sum := h.GetSampleSum() + base.GetSampleSum()
+	h.SampleCount = &count
+	h.SampleSum = &sum
+}
+
+func labelSignature(m *dto.Metric) string {
+	var b strings.Builder
+	for _, lp := range m.Label {
+		b.WriteString(lp.GetName())
+		b.WriteByte('=')
+		b.WriteString(lp.GetValue())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// loadState reads a snapshot written by saveState. Snapshots older than
+// maxAge are ignored, as restoring them would make rate() and increase()
+// attribute the whole gap to the first scrape after startup.
+func loadState(stateFile string, maxAge time.Duration) (baseline map[string]*dto.MetricFamily, err error) {
+	baseline = make(map[string]*dto.MetricFamily)
+	fi, err := os.Stat(stateFile)
+	if os.IsNotExist(err) {
+		log.Infof("no state file at %s, starting from scratch", stateFile)
+		return baseline, nil
+	} else if err != nil {
+		return
+	}
+	if age := time.Since(fi.ModTime()); maxAge > 0 && age > maxAge {
+		log.Warnf("ignoring state file %s, it is %v old", stateFile, age.Round(time.Second))
+		return
+	}
+	inFile, err := os.Open(stateFile)
+	if err != nil {
+		return
+	}
+	defer func() { _ = inFile.Close() }()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(inFile)
+	if err != nil {
+		return
+	}
+	for name, mf := range mfs {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER, dto.MetricType_HISTOGRAM:
+			baseline[name] = mf
+		}
+	}
+	log.Infof("restored %d metric families from %s", len(baseline), stateFile)
+	return
+}
+
+// saveState writes the exporter's own counters and histograms to
+// stateFile in the Prometheus text format.
+func saveState(gatherer prometheus.Gatherer, stateFile string) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	outFile, err := atomicfile.New(stateFile, 0644)
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), namespace+"_") {
+			continue
+		}
+		if mf.GetType() != dto.MetricType_COUNTER && mf.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		if _, err = expfmt.MetricFamilyToText(outFile, mf); err != nil {
+			_ = outFile.Abort()
+			return err
+		}
+	}
+	return outFile.Close()
+}
@@ -0,0 +1,106 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+func counterFamily(name string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{
+			Label:   []*dto.LabelPair{labelPair("host", "x")},
+			Counter: &dto.Counter{Value: proto.Float64(value)},
+		}},
+	}
+}
+
+func histogramFamily(name string, count uint64, bounds ...float64) *dto.MetricFamily {
+	h := &dto.Histogram{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(float64(count))}
+	for _, bound := range bounds {
+		h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(bound), CumulativeCount: proto.Uint64(count)})
+	}
+	return &dto.MetricFamily{
+		Name:   proto.String(name),
+		Type:   dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{Histogram: h}},
+	}
+}
+
+func TestStateGatherer(t *testing.T) {
+	g := &stateGatherer{
+		gatherer: gatherFunc(func() ([]*dto.MetricFamily, error) {
+			return []*dto.MetricFamily{
+				counterFamily("requests", 1),
+				histogramFamily("time", 1, 0.1, 1),
+				counterFamily("changed", 1),
+			}, nil
+		}),
+		baseline: map[string]*dto.MetricFamily{
+			"requests": counterFamily("requests", 2),
+			// As read back from the text format, with a +Inf bucket
+			"time":    histogramFamily("time", 2, 0.1, 1, math.Inf(1)),
+			"changed": histogramFamily("changed", 2, 1),
+			"gone":    counterFamily("gone", 3),
+		},
+	}
+	for round := 0; round < 2; round++ {
+		mfs, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]*dto.MetricFamily)
+		for _, mf := range mfs {
+			if got[mf.GetName()] != nil {
+				t.Fatalf("round %d: family %q is served twice", round, mf.GetName())
+			}
+			got[mf.GetName()] = mf
+		}
+		if v := got["requests"].Metric[0].GetCounter().GetValue(); v != 3 {
+			t.Errorf("round %d: requests = %g, want 3", round, v)
+		}
+		h := got["time"].Metric[0].GetHistogram()
+		if h.GetSampleCount() != 3 || h.Bucket[1].GetCumulativeCount() != 3 {
+			t.Errorf("round %d: histogram not restored: %v", round, h)
+		}
+		if got["changed"].GetType() != dto.MetricType_COUNTER {
+			t.Errorf("round %d: family with a changed type came from the baseline", round)
+		}
+		if v := got["gone"].Metric[0].GetCounter().GetValue(); v != 3 {
+			t.Errorf("round %d: gone = %g, want 3", round, v)
+		}
+		// Changes to what was gathered must not reach the baseline
+		addLabel(got["gone"].Metric[0], "instance", "a")
+	}
+	if n := len(g.baseline["gone"].Metric[0].Label); n != 1 {
+		t.Errorf("baseline series has %d labels, want 1", n)
+	}
+}
+
+type gatherFunc func() ([]*dto.MetricFamily, error)
+
+func (f gatherFunc) Gather() ([]*dto.MetricFamily, error) {
+	return f()
+}
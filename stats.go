@@ -0,0 +1,267 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// rateWindow is the longest window liveStats can compute rates over, 15
+// minutes. One extra bucket holds the current, incomplete second.
+const rateWindow = 900
+
+// defaultRateWindow is the window rates are computed over unless another
+// is asked for.
+const defaultRateWindow = 60
+
+// liveStatsMaxPaths is the number of host and path pairs liveStats keeps
+// totals for. When it is reached, the least requested tenth of them are
+// forgotten to make room for new ones.
+const liveStatsMaxPaths = 10000
+
+// rateReservoir is the number of request times kept per second to
+// estimate latency quantiles from.
+const rateReservoir = 100
+
+type hostPath struct {
+	Host string
+	Path string
+}
+
+type pathTotals struct {
+	Requests uint64
+	Errors   uint64
+	Time     float64
+}
+
+// rateBucket holds the counts for one second.
+type rateBucket struct {
+	second   int64
+	requests uint64
+	errors   uint64
+	hits     uint64
+	time     float64
+	times    []float64
+}
+
+// liveStats keeps simple in-process aggregates of the requests seen, for
+// consumers that want to query the exporter directly rather than
+// scraping it.
+type liveStats struct {
+	mu      sync.Mutex
+	paths   map[hostPath]*pathTotals
+	buckets [rateWindow + 1]rateBucket
+	total   uint64
+	now     func() time.Time
+}
+
+func newLiveStats() *liveStats {
+	return &liveStats{
+		paths: make(map[hostPath]*pathTotals),
+		now:   time.Now,
+	}
+}
+
+// Record adds one parsed log line to the aggregates.
+func (s *liveStats) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	status, _ := strconv.Atoi(labels.Value("status"))
+	isError := status >= 500
+	key := hostPath{labels.Value("host"), labels.Value("path")}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	totals, ok := s.paths[key]
+	if !ok {
+		if len(s.paths) >= liveStatsMaxPaths {
+			s.forget()
+		}
+		totals = &pathTotals{}
+		s.paths[key] = totals
+	}
+	totals.Requests++
+	b := s.bucket(s.now().Unix())
+	b.requests++
+	for _, m := range metrics {
+		if m.Name != "time" {
+			continue
+		}
+		totals.Time += m.Value
+		b.time += m.Value
+		if len(b.times) < rateReservoir {
+			b.times = append(b.times, m.Value)
+		} else if i := rand.Int63n(int64(b.requests)); i < rateReservoir {
+			b.times[i] = m.Value
+		}
+	}
+	if isError {
+		totals.Errors++
+		b.errors++
+	}
+	if labels.Value("cache") == "hit" {
+		b.hits++
+	}
+}
+
+// forget removes the totals of the least requested tenth of the paths,
+// so that paths with a single request each don't grow the map without
+// bound. Forgetting a batch at a time keeps the sorting cost down. Must be
+// called with s.mu held.
+func (s *liveStats) forget() {
+	keys := make([]hostPath, 0, len(s.paths))
+	for key := range s.paths {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.paths[keys[i]].Requests < s.paths[keys[j]].Requests })
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(s.paths, key)
+	}
+}
+
+// bucket returns the rate bucket for the given second, resetting it if it
+// was last used for an older second. Must be called with s.mu held.
+func (s *liveStats) bucket(second int64) *rateBucket {
+	b := &s.buckets[second%(rateWindow+1)]
+	if b.second != second {
+		*b = rateBucket{second: second, times: b.times[:0]}
+	}
+	return b
+}
+
+// TopPaths returns up to limit paths ordered by number of requests. If host
+// is not empty, only paths for that host are considered.
+func (s *liveStats) TopPaths(limit int, host string) ([]hostPath, []pathTotals) {
+	s.mu.Lock()
+	keys := make([]hostPath, 0, len(s.paths))
+	totals := make(map[hostPath]pathTotals, len(s.paths))
+	for key, t := range s.paths {
+		if host != "" && key.Host != host {
+			continue
+		}
+		keys = append(keys, key)
+		totals[key] = *t
+	}
+	s.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := totals[keys[i]].Requests, totals[keys[j]].Requests
+		if ri != rj {
+			return ri > rj
+		}
+		if keys[i].Host != keys[j].Host {
+			return keys[i].Host < keys[j].Host
+		}
+		return keys[i].Path < keys[j].Path
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	result := make([]pathTotals, len(keys))
+	for i, key := range keys {
+		result[i] = totals[key]
+	}
+	return keys, result
+}
+
+// Rates returns requests and errors per second and the cache hit ratio over
+// the last window seconds, not counting the current, incomplete second.
+func (s *liveStats) Rates(window int) (requests, errors, hitRatio float64, total uint64) {
+	if window <= 0 {
+		window = defaultRateWindow
+	} else if window > rateWindow {
+		window = rateWindow
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().Unix()
+	var reqs, errs, hits uint64
+	for second := now - int64(window); second < now; second++ {
+		b := &s.buckets[second%(rateWindow+1)]
+		if b.second != second {
+			continue
+		}
+		reqs += b.requests
+		errs += b.errors
+		hits += b.hits
+	}
+	requests = float64(reqs) / float64(window)
+	errors = float64(errs) / float64(window)
+	if reqs > 0 {
+		hitRatio = float64(hits) / float64(reqs)
+	}
+	return requests, errors, hitRatio, s.total
+}
+
+// Latency returns the q-quantile of the request time over the last window
+// seconds, not counting the current, incomplete second, estimated from a
+// sample of the requests in each second.
+func (s *liveStats) Latency(window int, q float64) float64 {
+	if window <= 0 {
+		window = defaultRateWindow
+	} else if window > rateWindow {
+		window = rateWindow
+	}
+	s.mu.Lock()
+	now := s.now().Unix()
+	var times []float64
+	for second := now - int64(window); second < now; second++ {
+		if b := &s.buckets[second%(rateWindow+1)]; b.second == second {
+			times = append(times, b.times...)
+		}
+	}
+	s.mu.Unlock()
+	sort.Float64s(times)
+	return quantile(times, q)
+}
+
+// secondRates is the aggregates of one second.
+type secondRates struct {
+	Time     int64   `json:"time"`
+	Requests uint64  `json:"requests"`
+	Errors   uint64  `json:"errors"`
+	Hits     uint64  `json:"hits"`
+	MeanTime float64 `json:"mean_time_seconds"`
+}
+
+// Seconds returns the aggregates of each of the last window seconds, not
+// counting the current, incomplete second, oldest first.
+func (s *liveStats) Seconds(window int) []secondRates {
+	if window <= 0 {
+		window = defaultRateWindow
+	} else if window > rateWindow {
+		window = rateWindow
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().Unix()
+	seconds := make([]secondRates, 0, window)
+	for second := now - int64(window); second < now; second++ {
+		r := secondRates{Time: second}
+		if b := &s.buckets[second%(rateWindow+1)]; b.second == second {
+			r.Requests, r.Errors, r.Hits = b.requests, b.errors, b.hits
+			if b.requests > 0 {
+				r.MeanTime = b.time / float64(b.requests)
+			}
+		}
+		seconds = append(seconds, r)
+	}
+	return seconds
+}
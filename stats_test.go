@@ -0,0 +1,84 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+func TestLiveStatsRates(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newLiveStats()
+	s.now = func() time.Time { return now }
+	for i := 0; i < 10; i++ {
+		status := "200"
+		if i < 2 {
+			status = "503"
+		}
+		cache := "miss"
+		if i%2 == 0 {
+			cache = "hit"
+		}
+		s.Record([]parser.Metric{{Name: "time", Value: float64(i)}}, request("x", "/a", status, cache))
+	}
+	s.Record(nil, request("y", "/b", "200", "hit"))
+
+	// The current second is not counted
+	if requests, _, _, total := s.Rates(10); requests != 0 || total != 11 {
+		t.Errorf("Rates counted the current second: %g requests, %d total", requests, total)
+	}
+	now = now.Add(time.Second)
+	requests, errors, hitRatio, _ := s.Rates(10)
+	if requests != 1.1 || errors != 0.2 || hitRatio != 6.0/11 {
+		t.Errorf("Rates(10) = %g, %g, %g", requests, errors, hitRatio)
+	}
+	if p := s.Latency(10, 0.5); p != 4 {
+		t.Errorf("median latency is %g, want 4", p)
+	}
+	keys, totals := s.TopPaths(1, "")
+	if len(keys) != 1 || keys[0] != (hostPath{"x", "/a"}) || totals[0].Requests != 10 || totals[0].Errors != 2 {
+		t.Errorf("TopPaths(1) = %v, %v", keys, totals)
+	}
+	if keys, _ := s.TopPaths(0, "y"); len(keys) != 1 || keys[0].Path != "/b" {
+		t.Errorf("TopPaths for host y = %v", keys)
+	}
+	// Buckets older than the window are left out
+	now = now.Add(rateWindow * time.Second)
+	if requests, _, _, _ := s.Rates(rateWindow); requests != 0 {
+		t.Errorf("expired buckets counted: %g requests", requests)
+	}
+}
+
+func TestLiveStatsForget(t *testing.T) {
+	s := newLiveStats()
+	s.Record(nil, request("x", "/popular", "200", "hit"))
+	s.Record(nil, request("x", "/popular", "200", "hit"))
+	for i := 0; len(s.paths) < liveStatsMaxPaths; i++ {
+		s.Record(nil, request("x", fmt.Sprintf("/once/%d", i), "200", "hit"))
+	}
+	s.Record(nil, request("x", "/new", "200", "hit"))
+	if n := len(s.paths); n > liveStatsMaxPaths-liveStatsMaxPaths/10+1 {
+		t.Errorf("%d paths kept after forgetting", n)
+	}
+	for _, path := range []string{"/popular", "/new"} {
+		if s.paths[hostPath{"x", path}] == nil {
+			t.Errorf("%s was forgotten", path)
+		}
+	}
+}
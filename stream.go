@@ -0,0 +1,70 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+)
+
+// streamFormat has the varnishncsa fields the delivery label is derived
+// from, along with the handling and deliverTimeFormat. A choice logged
+// from VCL takes precedence over the one guessed from the timestamps,
+// which are the time spent fetching and the time spent delivering. It has
+// to be logged in the
+// client transaction, for instance by passing it on in a header:
+//
+//	sub vcl_backend_response {
+//		set beresp.http.X-Stream = beresp.do_stream;
+//	}
+//	sub vcl_deliver {
+//		std.log("stream: " + resp.http.X-Stream);
+//		unset resp.http.X-Stream;
+//	}
+const streamFormat = `_stream="%{VSL:VCL_Log:stream}x"` +
+	` _fetch_time="%{VSL:Timestamp:Fetch[3]}x"`
+
+// deliveryMode tells how a response was delivered: "streamed" while it was
+// being fetched, "buffered" after it was fetched in full, "cache" from
+// cache, or "other" for synthetic and piped responses. For a streamed
+// response, %D includes the rest of the backend fetch, so its request
+// time means something else than for the others.
+func deliveryMode(extra map[string]string) string {
+	switch extra["_handling"] {
+	case "hit":
+		return "cache"
+	case "miss", "pass", "hitpass", "hitmiss":
+	default:
+		return "other"
+	}
+	if stream, err := strconv.ParseBool(extra["_stream"]); err == nil {
+		if stream {
+			return "streamed"
+		}
+		return "buffered"
+	}
+	// A buffered response is delivered from memory once the backend has
+	// sent all of it, so delivering it takes less time than fetching it
+	// unless the client is slow. A streamed one is delivered as the body
+	// arrives, after only the headers were fetched.
+	fetch, err := strconv.ParseFloat(extra["_fetch_time"], 64)
+	if err != nil {
+		return "buffered"
+	}
+	deliver, err := strconv.ParseFloat(extra["_deliver_time"], 64)
+	if err != nil || deliver <= fetch {
+		return "buffered"
+	}
+	return "streamed"
+}
@@ -0,0 +1,38 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestDeliveryMode(t *testing.T) {
+	tests := []struct {
+		extra map[string]string
+		want  string
+	}{
+		{map[string]string{"_handling": "hit"}, "cache"},
+		{map[string]string{"_handling": "synth"}, "other"},
+		{map[string]string{}, "other"},
+		{map[string]string{"_handling": "miss", "_stream": "true"}, "streamed"},
+		{map[string]string{"_handling": "pass", "_stream": "0"}, "buffered"},
+		{map[string]string{"_handling": "miss", "_fetch_time": "0.5", "_deliver_time": "0.1"}, "buffered"},
+		{map[string]string{"_handling": "miss", "_fetch_time": "0.1", "_deliver_time": "0.5"}, "streamed"},
+		{map[string]string{"_handling": "hitmiss", "_fetch_time": "-"}, "buffered"},
+	}
+	for _, test := range tests {
+		if got := deliveryMode(test.extra); got != test.want {
+			t.Errorf("deliveryMode(%v) = %q, want %q", test.extra, got, test.want)
+		}
+	}
+}
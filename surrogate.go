@@ -0,0 +1,147 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// The varnishncsa fields with the surrogate keys of the response, as set
+// by Fastly-style Surrogate-Key headers or for the xkey vmod.
+const surrogateKeyFormat = `_surrogate_key="%{Surrogate-Key}o" _xkey="%{xkey}o"`
+
+// surrogateKeyTrackFactor is how many more keys than are exported are
+// counted, so that keys on their way up can enter the top.
+const surrogateKeyTrackFactor = 10
+
+var surrogateKeyDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "surrogate_key_requests_total"),
+	"Number of requests for responses tagged with each of the most requested surrogate keys, by cache hit or miss.",
+	[]string{"key", "cache"}, nil,
+)
+
+type surrogateKeyCount struct {
+	hits, misses uint64
+}
+
+func (c *surrogateKeyCount) total() uint64 {
+	return c.hits + c.misses
+}
+
+// surrogateKeySink counts requests by surrogate key, so that the traffic
+// of invalidation groups can be observed. Keys can have unbounded
+// cardinality, so only the top most requested keys are exported, and a
+// bounded number of keys is counted: when that is reached, the least
+// requested key is evicted to make room for a new one, which takes over
+// its count, as in the Space-Saving algorithm. The counts of keys near
+// the bottom are therefore overestimates.
+type surrogateKeySink struct {
+	top int
+
+	mu     sync.Mutex
+	counts map[string]*surrogateKeyCount
+}
+
+func newSurrogateKeySink(top int) (*surrogateKeySink, error) {
+	s := &surrogateKeySink{
+		top:    top,
+		counts: make(map[string]*surrogateKeyCount, top*surrogateKeyTrackFactor),
+	}
+	if err := prometheus.Register(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *surrogateKeySink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	var keys []string
+	for _, name := range []string{"_surrogate_key", "_xkey"} {
+		if v := labels.Extra[name]; v != "-" {
+			keys = append(keys, strings.Fields(v)...)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	hit := labels.Value("cache") == "hit"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		c := s.counts[key]
+		if c == nil {
+			c = s.evict()
+			s.counts[key] = c
+		}
+		if hit {
+			c.hits++
+		} else {
+			c.misses++
+		}
+	}
+}
+
+// evict returns the count for a new key, taking over the count of the
+// least requested key if the table is full.
+func (s *surrogateKeySink) evict() *surrogateKeyCount {
+	if len(s.counts) < s.top*surrogateKeyTrackFactor {
+		return &surrogateKeyCount{}
+	}
+	var minKey string
+	var min *surrogateKeyCount
+	for key, c := range s.counts {
+		if min == nil || c.total() < min.total() {
+			minKey, min = key, c
+		}
+	}
+	delete(s.counts, minKey)
+	return min
+}
+
+// Describe implements prometheus.Collector.
+func (s *surrogateKeySink) Describe(ch chan<- *prometheus.Desc) {
+	ch <- surrogateKeyDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *surrogateKeySink) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.counts))
+	for key := range s.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := s.counts[keys[i]].total(), s.counts[keys[j]].total()
+		return ti > tj || ti == tj && keys[i] < keys[j]
+	})
+	if len(keys) > s.top {
+		keys = keys[:s.top]
+	}
+	counts := make([]surrogateKeyCount, len(keys))
+	for i, key := range keys {
+		counts[i] = *s.counts[key]
+	}
+	s.mu.Unlock()
+	for i, key := range keys {
+		ch <- prometheus.MustNewConstMetric(surrogateKeyDesc, prometheus.CounterValue, float64(counts[i].hits), key, "hit")
+		ch <- prometheus.MustNewConstMetric(surrogateKeyDesc, prometheus.CounterValue, float64(counts[i].misses), key, "miss")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// handlingFormat logs how Varnish handled the request: hit, miss, pass,
+// pipe or synth, among others.
+const handlingFormat = `_handling="%{Varnish:handling}x"`
+
+// synthFormat logs the reason phrase, which for synthetic responses is the
+// one given to synth() in VCL, or the built-in one for guru meditations.
+const synthFormat = `_reason="%{VSL:RespReason}x"`
+
+// synthSink counts synthetic responses separately, and tells 5xx errors
+// Varnish generated itself apart from those returned by a backend.
+type synthSink struct {
+	synth  *prometheus.CounterVec
+	errors *prometheus.CounterVec
+}
+
+func newSynthSink() (*synthSink, error) {
+	s := &synthSink{
+		synth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "synth_responses_total",
+			Help:      "Number of synthetic responses generated by Varnish, by status and reason.",
+		}, []string{"host", "status", "reason"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Number of 5xx responses, by whether Varnish or the backend generated them.",
+		}, []string{"host", "status", "origin"}),
+	}
+	for _, c := range []prometheus.Collector{s.synth, s.errors} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *synthSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	host, status := labels.Value("host"), labels.Value("status")
+	synth := labels.Extra["_handling"] == "synth"
+	if synth {
+		s.synth.WithLabelValues(host, status, labels.Extra["_reason"]).Inc()
+	}
+	if code, _ := strconv.Atoi(status); code >= 500 {
+		origin := "backend"
+		if synth {
+			origin = "varnish"
+		}
+		s.errors.WithLabelValues(host, status, origin).Inc()
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/collector"
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// tenant holds the request metrics of one tenant in a registry of its own.
+type tenant struct {
+	name      string
+	patterns  []*regexp.Regexp
+	registry  *prometheus.Registry
+	collector *collector.Collector
+}
+
+// tenantSink copies the request metrics of each tenant's hosts into the
+// tenant's registry, so each tenant can be given a scrape endpoint that
+// only exposes their own traffic.
+type tenantSink struct {
+	tenants []*tenant
+	byName  map[string]*tenant
+	namer   *metricNamer
+}
+
+func newTenantSink(cfg *config, namer *metricNamer) *tenantSink {
+	s := &tenantSink{
+		byName: make(map[string]*tenant),
+		namer:  namer,
+	}
+	names := make([]string, 0, len(cfg.Tenants))
+	for name := range cfg.Tenants {
+		names = append(names, name)
+	}
+	// Hosts matching several tenants go to the first one by name
+	sort.Strings(names)
+	for _, name := range names {
+		registry := prometheus.NewRegistry()
+		t := &tenant{
+			name:      name,
+			registry:  registry,
+			collector: collector.New(namespace, registry, cfg.MetricHelp),
+		}
+		for _, host := range cfg.Tenants[name].Hosts {
+			t.patterns = append(t.patterns, mappings.HostPattern(host))
+		}
+		t.collector.SetBucketRules(cfg.bucketRules(namer))
+		s.tenants = append(s.tenants, t)
+		s.byName[name] = t
+	}
+	return s
+}
+
+// Record implements sink.
+func (s *tenantSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	t := s.tenantFor(labels.Value("host"))
+	if t == nil {
+		return
+	}
+	for _, m := range metrics {
+		for _, name := range s.namer.Names(m.Name) {
+			t.collector.Observe(name, labels, m.Value)
+		}
+	}
+}
+
+// Declare implements schemaSink.
+func (s *tenantSink) Declare(name string, labelNames []string) {
+	for _, t := range s.tenants {
+		t.collector.Declare(name, labelNames)
+	}
+}
+
+func (s *tenantSink) tenantFor(host string) *tenant {
+	for _, t := range s.tenants {
+		for _, pattern := range t.patterns {
+			if pattern.MatchString(host) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// Handler serves <prefix><tenant>, exposing the metrics of that tenant.
+func (s *tenantSink) Handler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := s.byName[strings.TrimPrefix(r.URL.Path, prefix)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		metricsHandler(t.registry).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+#!/bin/sh
+# End-to-end test: runs the exporter with testdata/replay standing in for
+# varnishncsa, feeding it testdata/varnishncsa.log, and checks that every
+# line of testdata/e2e.expected is in the /metrics output.
+set -e
+cd "$(dirname "$0")/.."
+
+tmp=$(mktemp -d)
+port=${E2E_PORT:-19151}
+trap 'kill $pid 2>/dev/null; rm -rf "$tmp"' EXIT
+
+go build -o "$tmp/varnish-request-exporter" .
+go build -o "$tmp/varnishncsa" ./testdata/replay
+
+PATH="$tmp:$PATH" REPLAY_FILE=testdata/varnishncsa.log \
+	"$tmp/varnish-request-exporter" \
+	--http.port=":$port" \
+	--varnish.path-mappings=testdata/e2e.map \
+	--varnish.force \
+	> "$tmp/exporter.log" 2>&1 &
+pid=$!
+
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	if curl -sf "http://localhost:$port/metrics" > "$tmp/metrics"; then
+		grep -q '^varnish_request_exporter_log_messages 6$' "$tmp/metrics" && break
+	fi
+	sleep 0.5
+done
+
+failed=0
+while IFS= read -r line; do
+	if ! grep -qxF "$line" "$tmp/metrics"; then
+		echo "missing: $line"
+		failed=1
+	fi
+done < testdata/e2e.expected
+if [ $failed -ne 0 ]; then
+	echo "--- exporter log"
+	cat "$tmp/exporter.log"
+	exit 1
+fi
+echo "e2e: ok"
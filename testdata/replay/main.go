@@ -0,0 +1,64 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command replay stands in for varnishncsa in end-to-end tests. It prints
+// the file named by $REPLAY_FILE and then waits, like varnishncsa does when
+// there is no more traffic, until it is killed or the exporter exits.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "-V":
+			// Read by the exporter's version detection
+			fmt.Println("varnishncsa (varnish-6.0.7 revision 525d371e3ea0e0c38edd7baf0f80dc226560f26e)")
+			return
+		case "-d":
+			// The exporter's format check; accept any format
+			return
+		}
+	}
+
+	inFile, err := os.Open(os.Getenv("REPLAY_FILE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := io.Copy(os.Stdout, inFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	parent := os.Getppid()
+	for {
+		select {
+		case <-sigChan:
+			return
+		case <-time.After(100 * time.Millisecond):
+			if os.Getppid() != parent {
+				return
+			}
+		}
+	}
+}
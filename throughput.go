@@ -0,0 +1,85 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// deliverTimeFormat logs the time from when the response was ready until
+// it was delivered, which is the time it took to send it unless it was
+// streamed while being fetched.
+const deliverTimeFormat = `_deliver_time="%{VSL:Timestamp:Resp[3]}x"`
+
+// throughputFormat logs the bytes sent to the client, headers included.
+const throughputFormat = `_resp_bytes="%{VSL:ReqAcct[6]}x"`
+
+// throughputMinBytes is the size below which responses don't count
+// towards the throughput. Smaller ones fit in the socket buffers, so
+// sending them takes no time whatever the link.
+const throughputMinBytes = 128 << 10
+
+// throughputSink estimates the bandwidth of the links to clients from
+// how long it took to deliver responses, and counts the time worker
+// threads spent delivering. Clients on slow links hold a thread for the
+// whole time.
+type throughputSink struct {
+	throughput *prometheus.HistogramVec
+	delivery   *prometheus.CounterVec
+}
+
+func newThroughputSink() (*throughputSink, error) {
+	s := &throughputSink{
+		throughput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "client_throughput_bytes_per_second",
+			Help:      "Rate at which cache hits of 128 KiB or more were sent to clients, in bytes per second.",
+			Buckets:   prometheus.ExponentialBuckets(64<<10, 4, 8),
+		}, []string{"host"}),
+		delivery: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "delivery_seconds_total",
+			Help:      "Time spent delivering responses to clients, in seconds.",
+		}, []string{"host"}),
+	}
+	for _, c := range []prometheus.Collector{s.throughput, s.delivery} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *throughputSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	deliver, err := strconv.ParseFloat(labels.Extra["_deliver_time"], 64)
+	if err != nil || deliver < 0 {
+		return
+	}
+	host := labels.Value("host")
+	s.delivery.WithLabelValues(host).Add(deliver)
+	// Misses and passes are usually streamed, so their delivery time
+	// includes fetching from the backend
+	if labels.Extra["_handling"] != "hit" || deliver == 0 {
+		return
+	}
+	if bytes, err := strconv.ParseFloat(labels.Extra["_resp_bytes"], 64); err == nil && bytes >= throughputMinBytes {
+		s.throughput.WithLabelValues(host).Observe(bytes / deliver)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// The varnishncsa fields needed to build spans. The Timestamp records hold
+// the absolute time for Start, and the time elapsed since Start for the
+// others.
+const tracingFormat = `_traceparent="%{traceparent}i"` +
+	` _ts_start="%{VSL:Timestamp:Start[1]}x"` +
+	` _ts_req="%{VSL:Timestamp:Req[2]}x"` +
+	` _ts_fetch="%{VSL:Timestamp:Fetch[2]}x"` +
+	` _ts_resp="%{VSL:Timestamp:Resp[2]}x"`
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	statusCodeError = 2
+
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+)
+
+// The span types below are the OTLP/HTTP JSON encoding of the
+// OpenTelemetry trace data model.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) otlpAttribute {
+	s := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// tracer builds OpenTelemetry spans for sampled requests and sends them in
+// batches to an OTLP/HTTP endpoint.
+type tracer struct {
+	endpoint    string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+	spans       chan []otlpSpan
+	sent        prometheus.Counter
+	dropped     prometheus.Counter
+	spool       *diskSpool
+}
+
+func newTracer(endpoint, serviceName string, sampleRatio float64) (*tracer, error) {
+	t := &tracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		sampleRatio: sampleRatio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan []otlpSpan, tracingBatchSize),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_trace_spans_sent",
+			Help:      "Number of trace spans sent to the OTLP endpoint.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_trace_spans_dropped",
+			Help:      "Number of trace spans dropped because the OTLP endpoint was slow or failing.",
+		}),
+	}
+	if err := prometheus.Register(t.sent); err != nil {
+		return nil, err
+	}
+	if err := prometheus.Register(t.dropped); err != nil {
+		return nil, err
+	}
+	var err error
+	if t.spool, err = openSpool("tracing", t.post, t.sent, t.dropped); err != nil {
+		return nil, err
+	}
+	watchQueue("tracing", func() (int, int) { return len(t.spans), cap(t.spans) })
+	go t.run()
+	return t, nil
+}
+
+// Record emits spans for the request if it is sampled. Requests with a
+// sampled W3C traceparent header are always traced, as part of the
+// caller's trace.
+func (t *tracer) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	traceID, parentID, sampled := parseTraceparent(labels.Extra["_traceparent"])
+	if !sampled && rand.Float64() >= t.sampleRatio {
+		return
+	}
+	start, err := strconv.ParseFloat(labels.Extra["_ts_start"], 64)
+	if err != nil {
+		return
+	}
+	resp, err := strconv.ParseFloat(labels.Extra["_ts_resp"], 64)
+	if err != nil {
+		return
+	}
+	if traceID == "" {
+		traceID = randomID(16)
+	}
+	// Lets the request time histogram link to the trace with an exemplar
+	if labels.Extra == nil {
+		labels.Extra = make(map[string]string)
+	}
+	labels.Extra["_trace_id"] = traceID
+	at := func(elapsed float64) string {
+		return strconv.FormatInt(int64((start+elapsed)*1e9), 10)
+	}
+
+	status, _ := strconv.Atoi(labels.Value("status"))
+	root := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            randomID(8),
+		ParentSpanID:      parentID,
+		Name:              fmt.Sprintf("%s %s", labels.Value("method"), labels.Value("path")),
+		Kind:              spanKindServer,
+		StartTimeUnixNano: at(0),
+		EndTimeUnixNano:   at(resp),
+		Attributes: []otlpAttribute{
+			stringAttribute("http.method", labels.Value("method")),
+			stringAttribute("http.target", labels.Value("path")),
+			stringAttribute("http.host", labels.Value("host")),
+			intAttribute("http.status_code", status),
+			stringAttribute("varnish.cache", labels.Value("cache")),
+		},
+	}
+	if status >= 500 {
+		root.Status.Code = statusCodeError
+	}
+	spans := []otlpSpan{root}
+
+	deliverFrom := 0.0
+	if req, err := strconv.ParseFloat(labels.Extra["_ts_req"], 64); err == nil {
+		deliverFrom = req
+	}
+	if fetch, err := strconv.ParseFloat(labels.Extra["_ts_fetch"], 64); err == nil {
+		spans = append(spans, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            randomID(8),
+			ParentSpanID:      root.SpanID,
+			Name:              "backend fetch",
+			Kind:              spanKindClient,
+			StartTimeUnixNano: at(deliverFrom),
+			EndTimeUnixNano:   at(fetch),
+		})
+		deliverFrom = fetch
+	}
+	spans = append(spans, otlpSpan{
+		TraceID:           traceID,
+		SpanID:            randomID(8),
+		ParentSpanID:      root.SpanID,
+		Name:              "deliver",
+		StartTimeUnixNano: at(deliverFrom),
+		EndTimeUnixNano:   at(resp),
+	})
+
+	select {
+	case t.spans <- spans:
+	default:
+		t.dropped.Add(float64(len(spans)))
+	}
+}
+
+func (t *tracer) run() {
+	batch := make([]otlpSpan, 0, tracingBatchSize)
+	ticker := time.NewTicker(tracingFlushInterval)
+	for {
+		select {
+		case spans := <-t.spans:
+			batch = append(batch, spans...)
+			if len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		body, err := t.encode(batch)
+		if err == nil {
+			err = t.post(body)
+		}
+		if err != nil {
+			log.Errorf("could not send trace spans: %v", err)
+			if !t.spool.Save(body, len(batch)) {
+				t.dropped.Add(float64(len(batch)))
+			}
+		} else {
+			t.sent.Add(float64(len(batch)))
+			t.spool.Resume()
+		}
+		batch = batch[:0]
+	}
+}
+
+// encode makes an export request of a batch of spans.
+func (t *tracer) encode(spans []otlpSpan) ([]byte, error) {
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpAttribute{stringAttribute("service.name", t.serviceName)}
+	ss := otlpScopeSpans{Spans: spans}
+	ss.Scope.Name = "varnish_request_exporter"
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return json.Marshal(otlpTracesRequest{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+func (t *tracer) post(body []byte) error {
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// parseTraceparent parses a W3C Trace Context traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(header string) (traceID, parentID string, sampled bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return "", "", false
+	}
+	return parts[1], parts[2], flags&1 == 1
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,100 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// The varnishncsa fields used to tell why a response was not cached. A
+// reason logged from VCL with
+//
+//	std.log("uncacheable: ttl_zero");
+//
+// takes precedence over the ones guessed from the response headers.
+// Cache-Control and cookie values may contain double quotes, as in
+// no-cache="set-cookie", so the headers are logged in backquotes.
+const uncacheableFormat = "_set_cookie=`%{VSL:RespHeader:Set-Cookie[1]}x`" +
+	" _cache_control=`%{VSL:RespHeader:Cache-Control}x`" +
+	` _uncacheable="%{VSL:VCL_Log:uncacheable}x"`
+
+// uncacheableSink counts responses that were not served from cache, by
+// the most likely reason they were not cacheable.
+type uncacheableSink struct {
+	reasons *prometheus.CounterVec
+}
+
+func newUncacheableSink() (*uncacheableSink, error) {
+	s := &uncacheableSink{
+		reasons: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "uncacheable_total",
+			Help:      "Number of responses not served from cache, by the reason they were uncacheable.",
+		}, []string{"host", "reason"}),
+	}
+	if err := prometheus.Register(s.reasons); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *uncacheableSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	if reason := uncacheableReason(labels.Extra); reason != "" {
+		s.reasons.WithLabelValues(labels.Value("host"), reason).Inc()
+	}
+}
+
+// uncacheableReason returns why a response was not cached, or "" if it was
+// served from cache or looks cacheable.
+func uncacheableReason(extra map[string]string) string {
+	present := func(name string) bool {
+		v := extra[name]
+		return v != "" && v != "-"
+	}
+	handling := extra["_handling"]
+	switch handling {
+	case "hit", "synth", "pipe", "":
+		return ""
+	}
+	if present("_uncacheable") {
+		return extra["_uncacheable"]
+	}
+	if present("_set_cookie") {
+		return "set_cookie"
+	}
+	if present("_cache_control") {
+		cc := strings.ToLower(extra["_cache_control"])
+		switch {
+		case strings.Contains(cc, "no-store"):
+			return "no_store"
+		case strings.Contains(cc, "private"):
+			return "private"
+		case strings.Contains(cc, "no-cache"), strings.Contains(cc, "max-age=0"), strings.Contains(cc, "s-maxage=0"):
+			return "ttl_zero"
+		}
+	}
+	switch handling {
+	case "hitpass":
+		return "hit_for_pass"
+	case "pass":
+		return "pass"
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+func TestUncacheableFormat(t *testing.T) {
+	tests := []struct {
+		setCookie, cacheControl, handling, want string
+	}{
+		{"-", `private, no-cache="set-cookie"`, "miss", "private"},
+		{`session="a b"; Path=/`, "-", "pass", "set_cookie"},
+		{"-", `no-store, no-cache="Set-Cookie, X-Token"`, "miss", "no_store"},
+		{"-", "max-age=0", "miss", "ttl_zero"},
+		{"-", "public, max-age=60", "hitpass", "hit_for_pass"},
+		{"-", `no-cache="set-cookie"`, "hit", ""},
+	}
+	p := &parser.Parser{}
+	for _, test := range tests {
+		// The line varnishncsa logs for the format
+		line := strings.NewReplacer(
+			"%{VSL:RespHeader:Set-Cookie[1]}x", test.setCookie,
+			"%{VSL:RespHeader:Cache-Control}x", test.cacheControl,
+			"%{VSL:VCL_Log:uncacheable}x", "-",
+		).Replace(`status=200 _handling="` + test.handling + `" ` + uncacheableFormat)
+		_, labels, err := p.Parse(line)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", line, err)
+			continue
+		}
+		if got := labels.Extra["_cache_control"]; got != test.cacheControl {
+			t.Errorf("Cache-Control parsed as %q, want %q", got, test.cacheControl)
+		}
+		if got := uncacheableReason(labels.Extra); got != test.want {
+			t.Errorf("uncacheableReason for %q = %q, want %q", line, got, test.want)
+		}
+	}
+}
@@ -16,43 +16,211 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
-	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/facebookgo/pidfile"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/input"
+	"github.com/stigsb/varnishncsa_exporter/pkg/mappings"
 )
 
 const (
 	namespace = "varnish_request"
 )
+
 var (
 	listenAddress = flag.String("http.port", ":9151", "Host/port for HTTP server")
 	metricsPath   = flag.String("http.metricsurl", "/metrics", "Prometheus metrics path")
-	httpHost      = flag.String("varnish.host", "", "Virtual host to look for in Varnish logs (defaults to all hosts)")
-	mappingsFile  = flag.String("varnish.path-mappings", "", "Name of file with path mappings")
+	maxRespBytes  = flag.Int64("web.max-response-bytes", 0, "Leave the biggest metric families out of scrapes that would exceed this many bytes uncompressed (0 for no limit)")
+	featuresToken = flag.String("web.features-token-file", "", "File with a bearer token that allows turning features on and off at /-/features (empty to disable)")
+	enableReload  = flag.Bool("web.enable-lifecycle", false, "Allow reloading the mappings and config file with a POST to /-/reload")
+	ratesAPI      = flag.Bool("web.rates", false, "Serve the request rates of the last 15 minutes as JSON at /api/v1/rates")
+	maxScrapes    = flag.Int("web.max-concurrent-scrapes", 3, "Number of scrapes of the metrics endpoints to serve at once; more are rejected (0 for no limit)")
+	openMetrics   = flag.Bool("http.openmetrics", false, "Use the OpenMetrics format, with exemplars, for scrapers that ask for it")
+	instanceLabel = flag.Bool("metrics.instance-label", false, "Add a varnish_instance label with the host name to all series even if -varnish.instance is not set")
+	mappingsFile  = flag.String("varnish.path-mappings", "", "Name of file with path mappings, or of a directory of *.map files")
+	hashKeyFile   = flag.String("mappings.hash-key-file", "", "File with the secret key that hash rules in the path mappings hash with")
+	maxEvalTime   = flag.Duration("mappings.max-eval-time", 0, "Log path mapping rules that take longer than this to evaluate on a path, at most once a minute per rule (0 to disable)")
+	configFile    = flag.String("config.file", "", "YAML file with settings that aren't available as flags")
+	hostMapFile   = flag.String("varnish.host-mappings", "", "Name of file with host name mappings")
+	unmatchedSize = flag.Int("varnish.unmatched-paths", 100, "Number of paths that matched no mapping rule to sample for /debug/unmatched-paths (0 to disable)")
+	normalizerCmd = flag.String("varnish.normalizer", "", "Command to run as a co-process that normalizes labels of each request")
+	coProcessWait = flag.Duration("varnish.coprocess-timeout", time.Second, "Time to wait for -varnish.normalizer or -varnish.plugin to answer for a request before restarting it and leaving the request unchanged")
+	pluginCmd     = flag.String("varnish.plugin", "", "Command to run as a co-process that changes or enriches each request, given as a JSON request event")
 	instance      = flag.String("varnish.instance", "", "Name of Varnish instance")
+	runAsUser     = flag.String("varnish.run-as-user", "", "Run varnishncsa as this user, or user:group, instead of the exporter's own")
+	vslTimeout    = flag.String("varnish.vsl-timeout", "", "Seconds varnishncsa waits for the Varnish instance to appear, or \"off\" (varnishncsa -t)")
+	vslLimit      = flag.Int("varnish.vsl-limit", 0, "Number of incomplete transactions varnishncsa keeps before forcing out the oldest (varnishncsa -L, 0 for its default)")
+	vslEndTimeout = flag.Duration("varnish.vsl-end-timeout", 0, "Time after which varnishncsa gives up waiting for the end of a transaction (varnishncsa -T, 0 for its default)")
 	beFirstByte   = flag.Bool("varnish.firstbyte", false, "Also export metrics for backend time to first byte")
 	userQuery     = flag.String("varnish.query", "", "VSL query override (defaults to one that is generated")
 	sizes         = flag.Bool("varnish.sizes", false, "Also export metrics for response size")
+	queueTime     = flag.Bool("varnish.queue-time", false, "Also export metrics for the time from accepting a request until processing it starts")
+	detectVersion = flag.Bool("varnish.detect-version", true, "Detect the Varnish version and leave out log format fields it doesn't support")
+	checkFormat   = flag.Bool("varnish.check-format", true, "Check that varnishncsa accepts the log format before starting, and drop optional fields it doesn't support")
+	inputFile     = flag.String("input.file", "", "Read varnishncsa output from this file instead of running varnishncsa")
+	inputSynth    = flag.String("input.synthetic", "", "Read generated traffic from the request mix in this YAML file, or default for a built-in one, instead of running varnishncsa")
+	synthRate     = flag.Float64("input.synthetic-rate", 100, "Requests per second to generate with -input.synthetic")
+	inputJournal  = flag.String("input.journal-unit", "", "Read varnishncsa output from the journal of this systemd unit, with journalctl, instead of running varnishncsa")
+	inputVSL      = flag.String("input.vsl-file", "", "Read a binary VSL file written by varnishlog -w, with varnishncsa -r, instead of running varnishncsa on the live log")
+	inputFollow   = flag.Bool("input.follow", false, "Keep reading -input.file as it grows")
+	maxLineSize   = flag.Int("input.max-line-size", 1<<20, "Maximum length in bytes of a log line, longer ones are skipped and counted in varnish_request_exporter_long_lines_total")
+	inputOnError  = flag.String("input.on-error", "restart", "What to do when reading log lines fails: reopen -input.file or restart journalctl and read on, or exit (other inputs always exit)")
+	replaySpeed   = flag.Float64("input.replay-speed", 0, "Read -input.file at this many lines per second (0 for as fast as possible)")
+	pushGateway   = flag.String("push.gateway", "", "Push metrics to this Pushgateway URL and exit after reading -input.file")
+	pushJob       = flag.String("push.job", "varnish_request_exporter", "Job name to use when pushing to the Pushgateway")
+	grpcAddress   = flag.String("grpc.port", "", "Host/port for the gRPC API server (disabled if empty)")
+	traceEndpoint = flag.String("tracing.otlp-endpoint", "", "OTLP/HTTP URL to send request spans to, e.g. http://localhost:4318/v1/traces")
+	traceService  = flag.String("tracing.service-name", "varnish", "Service name to report in request spans")
+	traceRatio    = flag.Float64("tracing.sample-ratio", 0.01, "Fraction of requests without a sampled traceparent header to trace")
+	lokiURL       = flag.String("loki.url", "", "Loki push API URL to send normalized access logs to, e.g. http://localhost:3100/loki/api/v1/push")
+	lokiLabels    = flag.String("loki.labels", "job=varnish", "Comma-separated name=value labels to add to all Loki streams")
+	chURL         = flag.String("clickhouse.url", "", "ClickHouse HTTP interface URL to insert request rows into, e.g. http://localhost:8123/")
+	chTable       = flag.String("clickhouse.table", "varnish_requests", "ClickHouse table to insert request rows into")
+	chBatchSize   = flag.Int("clickhouse.batch-size", 10000, "Maximum number of rows per ClickHouse insert")
+	spoolDir      = flag.String("spool.dir", "", "Directory to keep batches in that Loki, ClickHouse or the OTLP endpoint could not take, to send them again later (empty to drop them)")
+	spoolMaxSize  = flag.Int64("spool.max-size", 100<<20, "Bytes of batches to keep in -spool.dir for each sink, dropping the oldest beyond that")
+	errorDetail   = flag.Bool("metrics.errors-detail", false, "Record 5xx and 429 responses with exact paths and without sampling, and other responses by the first path segment only")
+	flushInterval = flag.Duration("metrics.flush-interval", 0, "Batch observations per series and apply them at this interval (0 to apply them right away)")
+	sampleDivisor = flag.Int("input.sample-divisor", 1, "Only record every n-th log line")
+	sampleAdapt   = flag.Bool("input.adaptive-sampling", false, "Sample more aggressively while the exporter is overloaded")
+	sampleMaxCPU  = flag.Float64("input.max-cpu", 0.9, "CPU usage, in cores, above which adaptive sampling considers the exporter overloaded")
+	anomalyURL    = flag.String("anomaly.webhook-url", "", "URL to POST JSON alerts to when a host's error rate or p99 is anomalous")
+	anomalyErrors = flag.Float64("anomaly.error-rate", 0.05, "Alert when the smoothed 5xx rate of a host exceeds this fraction (0 to disable)")
+	anomalyP99    = flag.Duration("anomaly.p99", 2*time.Second, "Alert when the smoothed p99 request time of a host exceeds this (0 to disable)")
+	burstFactor   = flag.Float64("burst.factor", 0, "Export varnish_request_burst_factor for paths whose request rate over 10 seconds is at least this many times their trailing average (0 to disable)")
+	burstTrailing = flag.Duration("burst.trailing", 10*time.Minute, "Time the trailing average request rate of -burst.factor is taken over")
+	heatmapWindow = flag.Duration("heatmap.window", 0, "Serve a request time heatmap of this long a window at /heatmap, as JSON for Grafana (0 to disable)")
+	heartbeatURL  = flag.String("heartbeat.url", "", "URL to GET periodically while log lines are flowing, for a dead man's switch such as healthchecks.io")
+	heartbeatTick = flag.Duration("heartbeat.interval", time.Minute, "How often to ping -heartbeat.url")
+	anomalyEvery  = flag.Duration("anomaly.interval", 10*time.Second, "How often to update the smoothed values and check thresholds")
+	snmpAgentX    = flag.String("snmp.agentx", "", "AgentX master agent socket to serve request aggregates to SNMP through, as a Unix socket path or tcp:host:port (disabled if empty)")
+	snmpBaseOID   = flag.String("snmp.base-oid", "1.3.6.1.4.1.8072.9999.9999.1", "OID to register the request aggregates under")
+	zabbixServer  = flag.String("zabbix.server", "", "Zabbix server or proxy to push request aggregates to with the sender protocol, as host[:port] (disabled if empty)")
+	zabbixHost    = flag.String("zabbix.host", "", "Name of the Zabbix host with the trapper items (defaults to the hostname)")
+	zabbixKeys    = flag.String("zabbix.keys", "", "File mapping Zabbix item keys to request aggregates")
+	zabbixEvery   = flag.Duration("zabbix.interval", time.Minute, "How often to push to -zabbix.server")
+	enterpriseVSL = flag.Bool("varnish.enterprise", false, "Export Varnish Enterprise MSE store hits and ykey purges")
+	h2Metrics     = flag.Bool("varnish.h2", false, "Export HTTP/2 streams per connection and stream resets")
+	sessionStats  = flag.Bool("varnish.sessions", false, "Also run varnishlog to export client connection durations and close reasons")
+	sessionReqs   = flag.Bool("varnish.session-requests", false, "With -varnish.sessions, also export the number of requests on each client connection")
+	uncacheStats  = flag.Bool("varnish.uncacheable", false, "Count responses not served from cache by the reason they were uncacheable")
+	synthStats    = flag.Bool("varnish.synth", false, "Count synthetic responses by reason, and 5xx errors by whether Varnish or the backend generated them")
+	contentType   = flag.Bool("varnish.content-type", false, "Add a content_type label with the family of the response Content-Type: html, json, image, video, font or other")
+	contentClass  = flag.Bool("varnish.content-class", false, "Add a content_class label telling static content from dynamic")
+	streamStats   = flag.Bool("varnish.streaming", false, "Add a delivery label telling responses streamed from the backend from buffered and cached ones")
+	deliveryStats = flag.Bool("varnish.throughput", false, "Export the rate at which large cache hits were sent to clients, and the time spent delivering responses, by host")
+	waitingList   = flag.Bool("varnish.waitinglist", false, "Count requests coalesced on the waiting list of a busy object, how long they waited, and hit-for-pass and hit-for-miss requests")
+	freshStats    = flag.Bool("varnish.freshness", false, "Export the age of cache hits, and their age as a fraction of their Cache-Control max-age, by host")
+	redirectStats = flag.Bool("varnish.redirects", false, "Count 301, 302, 307 and 308 redirects by whether they point to the same host or another one")
+	rateLimits    = flag.Bool("varnish.rate-limits", false, "Count 429 Too Many Requests responses, and export the Retry-After times of all responses by status")
+	condStats     = flag.Bool("varnish.conditional", false, "Count conditional requests and 304 Not Modified responses")
+	rawPathTopK   = flag.Int("varnish.raw-paths", 0, "Count requests for the n most requested paths as they were before path mappings, to check the mappings with (0 to disable)")
+	surrogateTopK = flag.Int("varnish.surrogate-keys", 0, "Count hits and misses for the n most requested Surrogate-Key or xkey response header keys (0 to disable)")
+	restartDelay  = flag.Duration("varnish.restart-delay", 0, "Restart varnishncsa this long after it exits, keeping the metrics, instead of exiting (0 to exit)")
+	outlierTime   = flag.Duration("outliers.threshold", 0, "Dump the full VSL transaction of requests taking longer than this with varnishlog (0 to disable)")
+	outlierDir    = flag.String("outliers.dir", "/var/tmp/varnish_request_exporter", "Directory to save the dumps of slow requests in")
+	outlierRate   = flag.Int("outliers.max-per-minute", 6, "Maximum number of slow requests to dump per minute")
+	outlierFiles  = flag.Int("outliers.max-files", 100, "Number of dumps of slow requests to keep (0 to keep all)")
+	geoCountryDB  = flag.String("geo.country-db", "", "MaxMind DB file, such as GeoLite2-Country.mmdb, to count requests by client country with")
+	geoASNDB      = flag.String("geo.asn-db", "", "MaxMind DB file, such as GeoLite2-ASN.mmdb, to count requests by client autonomous system with")
+	geoIPHeader   = flag.String("geo.client-ip-header", "", "Request header with the client IP, such as X-Forwarded-For, instead of the PROXY protocol or connection source address")
+	geoTopASNs    = flag.Int("geo.top-asns", 50, "Number of autonomous systems with the most requests to export")
+	forceStart    = flag.Bool("varnish.force", false, "Start even if another exporter is attached to the same Varnish instance")
+	excludePurge  = flag.Bool("varnish.exclude-purge", false, "Leave out PURGE and BAN requests")
+	backendStats  = flag.Bool("varnish.backend", false, "Also export metrics for backend requests, with a side label telling them from client requests")
+	excludeNoHost = flag.Bool("varnish.exclude-no-host", false, "Leave out requests without a Host header, other than counting them")
+
+	httpHosts     listFlag
+	durationName  = durationFieldFlag("D")
+	metricsCompat listFlag
+	excludeStatus statusListFlag
+	onlyMethods   listFlag
+	extraArgs     argsFlag
+	pluginLabels  listFlag
+	logFileName   = flag.String("log.file", "", "Write the log to this file instead of stderr")
+	logMaxSize    = flag.Int64("log.max-size", 100<<20, "Rotate -log.file when it grows beyond this many bytes (0 to only reopen it on SIGUSR1)")
+	parseErrLimit = flag.Int("log.parse-error-limit", 10, "Log each parse failure until there are more than this many in a minute, then a summary each minute (0 to log each one)")
+	logMaxFiles   = flag.Int("log.max-files", 5, "Number of rotated log files to keep")
+	gcPercent     = flag.Int("runtime.gogc", 0, "Garbage collection target percentage, as GOGC (0 to leave it as is)")
+	ballastSize   = flag.Int64("runtime.ballast", 0, "Bytes of heap ballast to allocate, making garbage collections less frequent while the heap is small")
+	memoryLimit   = flag.Int64("runtime.memory-limit", 0, "Expire the least recently used series when resident memory gets close to this many bytes (0 to disable)")
+	stateFile     = flag.String("state.file", "", "File to save metrics to on shutdown and restore them from on startup")
+	stateMaxAge   = flag.Duration("state.max-age", 15*time.Minute, "Ignore state files older than this")
 )
 
-type pathMapping struct {
-	Pattern     *regexp.Regexp
-	Replacement string
+// command is a subcommand of the exporter binary. Global flags are parsed
+// before the command name, command specific flags after it.
+type command struct {
+	Name  string
+	Usage string
+	Run   func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "Run varnishncsa and export request metrics (default)", runServe},
+	{"aggregate", "Serve the metrics of several exporters as one", runAggregate},
+	{"analyze", "Print a per-path report for captured log files", runAnalyze},
+	{"check", "Check a running exporter, as a Nagios or Icinga plugin", runCheck},
+	{"check-config", "Validate the configuration and print the varnishncsa command line", runCheckConfig},
+	{"devserver", "Serve metrics for generated traffic, for trying out mappings and dashboards", runDevServer},
+	{"generate-dashboards", "Write a Grafana dashboard and Prometheus alerting rules for this configuration", runGenerateDashboards},
+	{"test-mappings", "Print how paths are normalized by the path mappings", runTestMappings},
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command] [command flags]\n\nCommands:\n", os.Args[0])
+		for _, c := range commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-19s %s\n", c.Name, c.Usage)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.Name == name {
+			os.Exit(c.Run(args))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// runServe implements the "serve" command, which is the exporter itself.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	if *logFileName != "" {
+		if _, err := openLogFile(*logFileName, *logMaxSize, *logMaxFiles); err != nil {
+			log.Fatalf("-log.file: %v", err)
+		}
+	}
+	setupRuntime(*gcPercent, *ballastSize)
+
 	// Listen to signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
@@ -64,85 +232,544 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Set up 'varnishncsa' pipe
-	cmdName := "varnishncsa"
-	vslQuery := buildVslQuery()
-	varnishFormat := buildVarnishNCSAFormat()
-	cmdArgs := buildVarnishNCSAArgs(vslQuery, varnishFormat)
-	log.Infof("Running command: %v %v\n", cmdName, cmdArgs)
-	cmd := exec.Command(cmdName, cmdArgs...)
-	cmdReader, err := cmd.StdoutPipe()
+	var logs io.Reader
+	var child *varnishChild
+	var files *fileInput
+	// format is the varnishncsa format, if the exporter chose it
+	var format string
+	if countSet(*inputFile, *inputVSL, *inputJournal, *inputSynth) > 1 {
+		log.Fatal("only one of -input.file, -input.vsl-file, -input.journal-unit and -input.synthetic can be used")
+	}
+	if *maxLineSize <= 0 {
+		log.Fatal("-input.max-line-size must be positive")
+	}
+	if *inputOnError != "restart" && *inputOnError != "exit" {
+		log.Fatal("-input.on-error must be restart or exit")
+	}
+	if *chBatchSize < 1 {
+		log.Fatal("-clickhouse.batch-size must be at least 1")
+	}
+	if *inputFile != "" {
+		// Read previously captured varnishncsa output
+		log.Infof("Reading from file: %s", *inputFile)
+		if files, logs, err = openFileInput(*inputFile); err != nil {
+			log.Fatal(err)
+		}
+	} else if *inputVSL != "" {
+		// Have varnishncsa read a binary VSL dump, as written by varnishlog -w
+		if *inputFollow {
+			log.Fatal("-input.follow can't be used with -input.vsl-file")
+		}
+		log.Infof("Reading from VSL file: %s", *inputVSL)
+		if format, err = varnishNCSAFormat(false); err != nil {
+			log.Fatal(err)
+		}
+		if logs, err = openVSLFile(*inputVSL, format); err != nil {
+			log.Fatal(err)
+		}
+		if *replaySpeed > 0 {
+			logs = input.NewPacedReader(logs, *replaySpeed)
+		}
+	} else if *inputSynth != "" {
+		// Make up traffic, for trying things out without a Varnish
+		if *synthRate <= 0 {
+			log.Fatal("-input.synthetic-rate must be positive")
+		}
+		mix, err := loadGeneratorMix(*inputSynth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Generating %g requests per second from the %s request mix", *synthRate, *inputSynth)
+		logs = generateTraffic(mix, *synthRate)
+	} else if *inputJournal != "" {
+		// Read the output of varnishncsa running as a service of its own
+		if *inputFollow || *replaySpeed > 0 {
+			log.Fatal("-input.follow and -input.replay-speed can't be used with -input.journal-unit")
+		}
+		if logs, err = openJournal(*inputJournal); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		var cred *syscall.Credential
+		if *runAsUser != "" {
+			if cred, err = credentialsFor(*runAsUser); err != nil {
+				log.Fatalf("-varnish.run-as-user: %v", err)
+			}
+		}
+		workdir, err := varnishWorkdir()
+		if err == nil {
+			// Fail early and clearly if varnishncsa won't be able to read the log
+			if err := checkVSMAccess(workdir, cred); os.IsNotExist(err) {
+				log.Warnf("could not check access to the Varnish shared memory log: %v", err)
+			} else if err != nil {
+				log.Fatal(err)
+			}
+			// Make sure we are the only exporter reading from this instance
+			err = lockInstance(workdir)
+		}
+		if err != nil {
+			if *forceStart {
+				log.Warnf("ignoring instance lock: %v", err)
+			} else if os.IsPermission(err) || os.IsNotExist(err) {
+				log.Warnf("could not lock Varnish instance: %v", err)
+			} else {
+				log.Fatal(err)
+			}
+		}
+
+		// Set up 'varnishncsa' pipe
+		cmdName := "varnishncsa"
+		if format, err = varnishNCSAFormat(*checkFormat); err != nil {
+			log.Fatal(err)
+		}
+		cmdArgs := buildVarnishNCSAArgs(buildVslQuery(), format)
+		log.Infof("Running command: %v %v\n", cmdName, cmdArgs)
+		child, logs, err = newVarnishChild(cmdName, cmdArgs, cred, *restartDelay)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	mapper, err := loadPathMappings()
 	if err != nil {
 		log.Fatal(err)
 	}
-	scanner := bufio.NewScanner(cmdReader)
+	mapper.MaxEvalTime = *maxEvalTime
+	if err = prometheus.Register(mapper); err != nil {
+		log.Fatal(err)
+	}
+	if *unmatchedSize > 0 {
+		mapper.Unmatched = mappings.NewSampler(*unmatchedSize)
+		http.Handle("/debug/unmatched-paths", mapper.Unmatched)
+	}
 
-	pathMappings, err := parseMappings(*mappingsFile)
+	hosts, err := mappings.LoadHosts(*hostMapFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Setup metrics
-	varnishMessages := prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "exporter_log_messages",
-		Help:      "Current total log messages received.",
-	})
-	err = prometheus.Register(varnishMessages)
+	namer, err := newMetricNamer(metricsCompat)
 	if err != nil {
 		log.Fatal(err)
 	}
-	varnishParseFailures := prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: namespace,
-		Name:      "exporter_log_parse_failure",
-		Help:      "Number of errors while parsing log messages.",
-	})
-	err = prometheus.Register(varnishParseFailures)
+	processor, err := newLogProcessor(mapper, hosts, *flushInterval, namer)
 	if err != nil {
 		log.Fatal(err)
 	}
-	var msgs int64
-
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = processor.SetConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if mapper.Unmatched != nil {
+		mapper.Unmatched.Redact = processor.redactPath
+	}
+	processor.SetErrorDetail(*errorDetail)
+	processor.SetExcludeNoHost(*excludeNoHost)
+	processor.SetDeliveryMode(*streamStats)
+	processor.SetRawPaths(*rawPathTopK > 0)
+	// varnishncsa is restarted by its supervisor when it exits, which is
+	// what ends its output, so only files and journalctl are reopened
+	if *inputOnError == "restart" {
+		if files != nil {
+			processor.SetReopen(files.Reopen)
+		} else if *inputJournal != "" {
+			processor.SetReopen(func() (io.Reader, error) { return openJournal(*inputJournal) })
+		}
+	}
+	processor.SetBucketRules(cfg.bucketRules(namer))
+	if *contentClass {
+		processor.SetClassifier(newContentClassifier(cfg.ContentClass))
+	}
+	reloader, err := newReloader(mapper, hosts, processor, cfg, *enableReload)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	go func() {
-		for scanner.Scan() {
-			varnishMessages.Inc()
-			content := scanner.Text()
-			msgs++
-			metrics, labels, err := parseMessage(content, pathMappings)
-			if err != nil {
-				log.Error(err)
-				continue
+		for range hupChan {
+			reloader.Reload()
+		}
+	}()
+	if len(cfg.SLOs) > 0 {
+		slos, err := newSLOSink(cfg.SLOs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(slos)
+	}
+	if len(cfg.Apdex) > 0 {
+		apdex, err := newApdexSink(cfg.Apdex)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(apdex)
+	}
+	if len(cfg.Rollups) > 0 {
+		processor.AddSink(newRollupSink(cfg, namer))
+	}
+	var tenants *tenantSink
+	if len(cfg.Tenants) > 0 {
+		tenants = newTenantSink(cfg, namer)
+		processor.AddSink(tenants)
+	}
+
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *stateFile != "" {
+		baseline, err := loadState(*stateFile, *stateMaxAge)
+		if err != nil {
+			log.Errorf("could not restore state from %s: %v", *stateFile, err)
+		}
+		gatherer = &stateGatherer{gatherer: gatherer, baseline: baseline}
+	}
+	// The state file is saved without the instance label, served metrics get it
+	served := gatherer
+	if value, err := instanceLabelValue(); err != nil {
+		log.Fatal(err)
+	} else if value != "" {
+		served = &instanceGatherer{gatherer: gatherer, value: value}
+	}
+	if len(cfg.Labels) > 0 || cfg.Shard.Modulus > 0 {
+		served = &federationGatherer{gatherer: served, labels: cfg.Labels, shard: cfg.Shard}
+	}
+
+	if *pushGateway != "" {
+		// Batch mode: aggregate the whole file, push the result and exit
+		if (*inputFile == "" && *inputVSL == "") || *inputFollow {
+			log.Fatal("-push.gateway requires -input.file without -input.follow, or -input.vsl-file")
+		}
+		if err = processor.ProcessLines(logs); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Messages received: %d", processor.Messages())
+		if err = push.New(*pushGateway, *pushJob).Gatherer(served).Push(); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Pushed metrics to %s", *pushGateway)
+		return 0
+	}
+
+	if *coProcessWait <= 0 {
+		log.Fatal("-varnish.coprocess-timeout must be positive")
+	}
+	if *normalizerCmd != "" {
+		normalizer, err := newExternalNormalizer(*normalizerCmd, *coProcessWait)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.SetNormalizer(normalizer)
+	}
+	if *pluginCmd != "" {
+		plugin, err := newEventPlugin(*pluginCmd, pluginLabels, *coProcessWait)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.SetPlugin(plugin)
+	} else if len(pluginLabels) > 0 {
+		log.Fatal("-varnish.plugin-labels requires -varnish.plugin")
+	}
+	var features *featureSwitch
+	if *featuresToken != "" {
+		if child == nil {
+			log.Fatal("-web.features-token-file requires running varnishncsa")
+		}
+		if features, err = newFeatureSwitch(child, *featuresToken); err != nil {
+			log.Fatal(err)
+		}
+		// Make room in the label sets for labels that features may add
+		format = allFeaturesFormat()
+	}
+	if format != "" {
+		processor.SetSchema(format)
+	}
+	if *parseErrLimit > 0 {
+		processor.SetParseErrorThrottle(newLogThrottle("parse failures", *parseErrLimit, time.Minute))
+	}
+	if child != nil && *restartDelay > 0 {
+		replays, err := newReplayFilter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.SetReplayFilter(replays)
+		child.OnRestart = replays.Restarted
+	}
+	if *memoryLimit > 0 {
+		tracker, err := newSeriesTracker()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.SetSeriesTracker(tracker)
+		go watchMemory(*memoryLimit, tracker)
+	}
+
+	if *sampleDivisor > 1 || *sampleAdapt {
+		sampler, err := newSampler(*sampleDivisor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.SetSampler(sampler)
+		if *sampleAdapt {
+			go sampler.adapt(processor.QueueLength, *sampleMaxCPU, time.Second)
+		}
+	}
+
+	if *traceEndpoint != "" {
+		tracer, err := newTracer(*traceEndpoint, *traceService, *traceRatio)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(tracer)
+	}
+
+	if *lokiURL != "" {
+		loki, err := newLokiSink(*lokiURL, *lokiLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(loki)
+	}
+
+	if *chURL != "" {
+		clickhouse, err := newClickhouseSink(*chURL, *chTable, *chBatchSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(clickhouse)
+	}
+
+	if *enterpriseVSL {
+		enterprise, err := newEnterpriseSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(enterprise)
+	}
+
+	if *h2Metrics {
+		h2, err := newH2Sink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(h2)
+	}
+
+	if *uncacheStats {
+		uncacheable, err := newUncacheableSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(uncacheable)
+	}
+
+	if *synthStats {
+		synth, err := newSynthSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(synth)
+	}
+
+	if *waitingList {
+		waitinglist, err := newWaitinglistSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(waitinglist)
+	}
+
+	if *deliveryStats {
+		throughput, err := newThroughputSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(throughput)
+	}
+
+	if *freshStats {
+		freshness, err := newFreshnessSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(freshness)
+	}
+
+	if *redirectStats {
+		redirects, err := newRedirectSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(redirects)
+	}
+
+	if *rateLimits {
+		rateLimit, err := newRateLimitSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(rateLimit)
+	}
+
+	if *condStats {
+		conditional, err := newConditionalSink()
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(conditional)
+	}
+
+	if *rawPathTopK > 0 {
+		rawPaths, err := newRawPathSink(*rawPathTopK)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(rawPaths)
+	}
+
+	if *surrogateTopK > 0 {
+		surrogateKeys, err := newSurrogateKeySink(*surrogateTopK)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(surrogateKeys)
+	}
+
+	if *geoCountryDB != "" || *geoASNDB != "" {
+		geo, err := newGeoSink(*geoCountryDB, *geoASNDB, *geoTopASNs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(geo)
+	}
+
+	if *sessionStats && child != nil {
+		sessions, err := newSessionCollector(*sessionReqs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := sessions.Run(); err != nil {
+				log.Errorf("session varnishlog: %v", err)
 			}
-			for _, metric := range metrics {
-				var collector prometheus.Collector
-				//collector, err = prometheus.RegisterOrGet(prometheus.NewHistogramVec(prometheus.HistogramOpts{
-				collector = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-					Namespace: namespace,
-					Name:      metric.Name,
-					Help:      fmt.Sprintf("Varnish request log value for %s", metric.Name),
-				}, labels.Names)
-				err := prometheus.Register(collector)
-				if err != nil {
-					if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-						collector = are.ExistingCollector.(*prometheus.HistogramVec)
-					} else {
-						log.Error(err)
-						continue
-					}
-				}
-				collector.(*prometheus.HistogramVec).WithLabelValues(labels.Values...).Observe(metric.Value)
+		}()
+	}
+
+	if *outlierTime > 0 {
+		if child == nil {
+			log.Warnf("-outliers.threshold needs a running Varnish, ignoring it")
+		} else {
+			outliers, err := newOutlierCapture(*outlierTime, *outlierDir, *outlierRate, *outlierFiles)
+			if err != nil {
+				log.Fatal(err)
 			}
+			processor.AddSink(outliers)
+		}
+	}
+
+	if *anomalyURL != "" {
+		processor.AddSink(newAnomalyDetector(*anomalyURL, *anomalyErrors, *anomalyP99, *anomalyEvery))
+	}
+
+	if *burstFactor > 0 {
+		bursts, err := newBurstDetector(*burstFactor, *burstTrailing)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.AddSink(bursts)
+	}
+
+	if *zabbixServer != "" {
+		zabbix, err := newZabbixSender(*zabbixServer, *zabbixHost, *zabbixKeys, *zabbixEvery)
+		if err != nil {
+			log.Fatalf("-zabbix.keys: %v", err)
+		}
+		processor.AddSink(zabbix)
+	}
+
+	if *heatmapWindow > 0 {
+		heatmap := newHeatmapSink(*heatmapWindow)
+		processor.AddSink(heatmap)
+		http.Handle("/heatmap", heatmap)
+	}
+
+	if *heartbeatURL != "" {
+		go heartbeat(*heartbeatURL, *heartbeatTick, processor.Messages)
+	}
+
+	// The live aggregates cost memory and time for every request, so they
+	// are only kept for something that uses them
+	var stats *liveStats
+	if *ratesAPI || *grpcAddress != "" || *snmpAgentX != "" {
+		stats = newLiveStats()
+		processor.AddSink(stats)
+	}
+	if *ratesAPI {
+		http.Handle("/api/v1/rates", ratesHandler(stats))
+	}
+	if *grpcAddress != "" {
+		startGRPCServer(*grpcAddress, stats, mapper)
+	}
+	if *snmpAgentX != "" {
+		subagent, err := newSNMPSubagent(*snmpAgentX, *snmpBaseOID, stats)
+		if err != nil {
+			log.Fatalf("-snmp.base-oid: %v", err)
+		}
+		go subagent.Run()
+	}
+
+	publishVars(processor, mapper, hosts, child)
+	go func() {
+		if err := processor.ProcessLines(logs); err != nil {
+			// Serving the metrics as they were when reading stopped
+			// would hide that nothing is counted anymore
+			log.Errorf("error reading log lines, exiting: %v", err)
+			log.Infof("Messages received: %d", processor.Messages())
+			writeState(gatherer)
+			os.Exit(1)
+		}
+		if child == nil && *inputFile != "" {
+			log.Infof("Finished reading %s", *inputFile)
+		} else if child == nil && *inputVSL != "" {
+			log.Infof("Finished reading %s", *inputVSL)
 		}
 	}()
 
 	// Setup HTTP server
-	http.Handle(*metricsPath, promhttp.Handler())
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, metricsHandler(served),
+	))
+	http.Handle(strings.TrimSuffix(*metricsPath, "/")+".json", scrapeHandler(jsonMetricsHandler(served)))
+	shardPrefix := strings.TrimSuffix(*metricsPath, "/") + "/shard/"
+	http.Handle(shardPrefix, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, shardHandler(shardPrefix, served),
+	))
+	if tenants != nil {
+		tenantPrefix := strings.TrimSuffix(*metricsPath, "/") + "/tenant/"
+		http.Handle(tenantPrefix, tenants.Handler(tenantPrefix))
+	}
+	http.Handle("/examples", examplesHandler(namer, *backendStats))
+	http.Handle("/-/reload", reloader)
+	if features != nil {
+		http.Handle("/-/features", features)
+	}
+	ratesLink := ""
+	if *ratesAPI {
+		ratesLink = "<p><a href='/api/v1/rates'>Recent rates</a></p>"
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(`<html>
              <head><title>Varnish Request Exporter</title></head>
              <body>
              <h1>Varnish Request Exporter</h1>
              <p><a href='` + *metricsPath + `'>Metrics</a></p>
+             <p><a href='` + strings.TrimSuffix(*metricsPath, "/") + `.json'>Metrics as JSON</a></p>
+             ` + ratesLink + `
+             <p><a href='/examples'>Example queries</a></p>
+             <p><a href='/-/reload'>Last reload</a></p>
+             <p><a href='/debug/vars'>Internal state</a></p>
              </body>
              </html>`))
 	})
@@ -152,81 +779,360 @@ func main() {
 		log.Fatal(http.ListenAndServe(*listenAddress, nil))
 	}()
 
-	go func() {
-		err = cmd.Start()
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = cmd.Wait()
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Infof("varnishncsa command exited")
-		log.Infof("Messages received: %d", msgs)
-		os.Exit(0)
-	}()
+	if child != nil {
+		go func() {
+			if err := child.Run(); err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("varnishncsa command exited")
+			processor.Flush()
+			log.Infof("Messages received: %d", processor.Messages())
+			writeState(gatherer)
+			os.Exit(0)
+		}()
+	}
 
 	s := <-sigChan
 	log.Infof("Received %v, terminating", s)
-	log.Infof("Messages received: %d", msgs)
+	processor.Flush()
+	log.Infof("Messages received: %d", processor.Messages())
+	writeState(gatherer)
 
-	os.Exit(0)
+	return 0
 }
 
-func parseMappings(mappingsFile string) (mappings []pathMapping, err error) {
-	mappings = make([]pathMapping, 0)
-	if mappingsFile == "" {
-		return
+// runCheckConfig implements the "check-config" command.
+func runCheckConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	ok := true
+	if cfg, err := loadConfig(*configFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		ok = false
+	} else if _, err := newPathRedactor(cfg.Redact); err != nil {
+		fmt.Fprintf(os.Stderr, "config file: %v\n", err)
+		ok = false
+	} else if *configFile != "" {
+		fmt.Printf("config file: %s loaded\n", *configFile)
 	}
-	inFile, err := os.Open(mappingsFile)
+	mapper, err := loadPathMappings()
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "path mappings: %v\n", err)
+		ok = false
+	} else if *mappingsFile != "" {
+		fmt.Printf("path mappings: %d rules loaded from %s\n", len(mapper.Rules), *mappingsFile)
+	}
+	hosts, err := mappings.LoadHosts(*hostMapFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "host mappings: %v\n", err)
+		ok = false
+	} else if *hostMapFile != "" {
+		fmt.Printf("host mappings: %d rules loaded from %s\n", len(hosts.Rules), *hostMapFile)
+	}
+	if _, err := newMetricNamer(metricsCompat); err != nil {
+		fmt.Fprintf(os.Stderr, "-metrics.compat: %v\n", err)
+		ok = false
+	}
+	if *runAsUser != "" {
+		if _, err := credentialsFor(*runAsUser); err != nil {
+			fmt.Fprintf(os.Stderr, "-varnish.run-as-user: %v\n", err)
+			ok = false
+		}
+	}
+	if *pushGateway != "" && ((*inputFile == "" && *inputVSL == "") || *inputFollow) {
+		fmt.Fprintf(os.Stderr, "-push.gateway requires -input.file without -input.follow, or -input.vsl-file\n")
+		ok = false
+	}
+	if countSet(*inputFile, *inputVSL, *inputJournal, *inputSynth) > 1 {
+		fmt.Fprintf(os.Stderr, "only one of -input.file, -input.vsl-file, -input.journal-unit and -input.synthetic can be used\n")
+		ok = false
+	}
+	if *inputFile != "" {
+		fmt.Printf("input: %s\n", *inputFile)
+	} else if *inputSynth != "" {
+		if _, err := loadGeneratorMix(*inputSynth); err != nil {
+			fmt.Fprintf(os.Stderr, "-input.synthetic: %v\n", err)
+			ok = false
+		} else {
+			fmt.Printf("input: %g requests per second from the %s request mix\n", *synthRate, *inputSynth)
+		}
+	} else if *inputJournal != "" {
+		fmt.Printf("command: journalctl %s\n", strings.Join(quoteArgs(buildJournalArgs(*inputJournal)), " "))
+		fmt.Printf("format: %s\n", buildVarnishNCSAFormat())
+	} else if *inputVSL != "" {
+		fmt.Printf("command: varnishncsa %s\n", strings.Join(quoteArgs(buildVSLFileArgs(*inputVSL, buildVslQuery(), buildVarnishNCSAFormat())), " "))
+	} else {
+		fmt.Printf("command: varnishncsa %s\n", strings.Join(quoteArgs(buildVarnishNCSAArgs(buildVslQuery(), buildVarnishNCSAFormat())), " "))
+	}
+	if !ok {
+		return 1
+	}
+	fmt.Println("configuration OK")
+	return 0
+}
+
+func printMapping(mapper *mappings.PathMapper, path string) {
+	mapped, drop := mapper.Map(path)
+	if drop {
+		mapped = "(dropped)"
+	}
+	fmt.Printf("%s\t%s\n", path, mapped)
+}
+
+// runTestMappings implements the "test-mappings" command. Paths are taken
+// from the command line, or read from stdin one per line.
+func runTestMappings(args []string) int {
+	fs := flag.NewFlagSet("test-mappings", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	mapper, err := loadPathMappings()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	defer func() { _ = inFile.Close() }()
-	scanner := bufio.NewScanner(inFile)
-	scanner.Split(bufio.ScanLines)
-	commentRegexp := regexp.MustCompile("(#.*|^\\s+|\\s+$)")
-	splitRegexp := regexp.MustCompile("\\s+")
-	lineNo := 0
+	if fs.NArg() > 0 {
+		for _, path := range fs.Args() {
+			printMapping(mapper, path)
+		}
+		return 0
+	}
+	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
-		lineNo++
-		line := commentRegexp.ReplaceAllString(scanner.Text(), "")
-		if line == "" {
-			continue
+		printMapping(mapper, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// countSet returns the number of values that are not empty.
+func countSet(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
 		}
-		parts := splitRegexp.Split(line, 2)
-		switch len(parts) {
-		case 1:
-			log.Debugf("mapping strip: %s", parts[0])
-			mappings = append(mappings, pathMapping{regexp.MustCompile(parts[0]), ""})
-		case 2:
-			log.Debugf("mapping replace: %s => %s", parts[0], parts[1])
-			mappings = append(mappings, pathMapping{regexp.MustCompile(parts[0]), parts[1]})
+	}
+	return n
+}
+
+func quoteArgs(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " \"'") {
+			arg = "'" + strings.Replace(arg, "'", "'\\''", -1) + "'"
 		}
+		quoted[i] = arg
 	}
-	return
+	return quoted
+}
+
+func handlerOpts() promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{EnableOpenMetrics: *openMetrics}
+}
+
+func writeState(gatherer prometheus.Gatherer) {
+	if *stateFile == "" {
+		return
+	}
+	if err := saveState(gatherer, *stateFile); err != nil {
+		log.Errorf("could not save state to %s: %v", *stateFile, err)
+		return
+	}
+	log.Infof("Saved state to %s", *stateFile)
+}
+
+func init() {
+	flag.Var(&metricsCompat, "metrics.compat", "Metric naming schemes to export: old, new, or old,new while migrating dashboards (defaults to old)")
+	flag.Var(&durationName, "varnish.duration-field", "Field to take request times from: D (%D), T (%T), resp (Timestamp:Resp) or process (Timestamp:Process)")
+	flag.Var(&httpHosts, "varnish.host", "Virtual host to look for in Varnish logs; may be repeated or comma-separated (defaults to all hosts)")
+	flag.Var(&excludeStatus, "varnish.exclude-status", "Comma-separated response status codes to leave out, e.g. 401,404")
+	flag.Var(&onlyMethods, "varnish.only-methods", "Comma-separated request methods to look for, e.g. GET,POST (defaults to all methods)")
+	flag.Var(&extraArgs, "varnish.extra-args", "Extra arguments to pass to varnishncsa as they are; may be repeated")
+	flag.Var(&pluginLabels, "varnish.plugin-labels", "Comma-separated labels that -varnish.plugin adds to every request")
 }
 
+// buildVslQuery combines -varnish.query with the VSL filters generated from
+// the other -varnish.* flags. All of them must match.
 func buildVslQuery() string {
-	query := *userQuery
-	if *httpHost != "" {
-		if query != "" {
-			query += " and "
+	var clauses []string
+	if *userQuery != "" {
+		clauses = append(clauses, "("+*userQuery+")")
+	}
+	if len(httpHosts) == 1 {
+		clauses = append(clauses, sideClause("ReqHeader:host eq \""+httpHosts[0]+"\""))
+	} else if len(httpHosts) > 1 {
+		hosts := make([]string, len(httpHosts))
+		for i, host := range httpHosts {
+			hosts[i] = sideClause("ReqHeader:host eq \"" + host + "\"")
+		}
+		clauses = append(clauses, "("+strings.Join(hosts, " or ")+")")
+	}
+	if len(onlyMethods) > 0 {
+		methods := make([]string, len(onlyMethods))
+		for i, method := range onlyMethods {
+			methods[i] = sideClause("ReqMethod eq \"" + strings.ToUpper(method) + "\"")
+		}
+		clauses = append(clauses, "("+strings.Join(methods, " or ")+")")
+	}
+	if *excludePurge {
+		clauses = append(clauses, sideClause("ReqMethod ne \"PURGE\""), sideClause("ReqMethod ne \"BAN\""))
+	}
+	for _, status := range excludeStatus.listFlag {
+		clauses = append(clauses, sideClause("RespStatus != "+status))
+	}
+	if len(clauses) == 1 && *userQuery != "" {
+		return *userQuery
+	}
+	return strings.Join(clauses, " and ")
+}
+
+// sideClause returns the VSL query clause for a client transaction record,
+// such as ReqMethod, or with -varnish.backend, the clause for either that
+// or the matching backend transaction record, such as BereqMethod. Each
+// transaction only has the records of its own side.
+func sideClause(clause string) string {
+	if !*backendStats {
+		return clause
+	}
+	backend := "Be" + strings.ToLower(clause[:1]) + clause[1:]
+	return "(" + clause + " or " + backend + ")"
+}
+
+// varnishNCSAFormat returns the varnishncsa format, leaving out the
+// fields the installed Varnish doesn't support, and if check is set, any
+// optional fields varnishncsa rejects.
+func varnishNCSAFormat(check bool) (string, error) {
+	formatFields := buildVarnishNCSAFields()
+	if *detectVersion {
+		version, revision, err := detectVarnishVersion()
+		if err != nil {
+			log.Warnf("could not detect Varnish version: %v", err)
+		} else {
+			log.Infof("Detected Varnish %s", version)
+			formatFields = filterFormatFields(formatFields, version)
+			if err := registerVarnishInfo(version, revision); err != nil {
+				return "", err
+			}
+		}
+	}
+	if !check {
+		return joinFormatFields(formatFields), nil
+	}
+	return checkVarnishNCSAFormat(formatFields)
+}
+
+// loadPathMappings loads -varnish.path-mappings, with the key of its hash
+// rules from -mappings.hash-key-file.
+func loadPathMappings() (*mappings.PathMapper, error) {
+	mapper, err := mappings.LoadPaths(*mappingsFile)
+	if err != nil {
+		return nil, err
+	}
+	if *hashKeyFile == "" {
+		if mapper.HasHashRules() {
+			return nil, errors.New("hash rules need a key, set -mappings.hash-key-file")
 		}
-		query += "ReqHeader:host eq \"" + *httpHost + "\""
+		return mapper, nil
+	}
+	key, err := ioutil.ReadFile(*hashKeyFile)
+	if err != nil {
+		return nil, err
 	}
-	return query
+	if key = bytes.TrimSpace(key); len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", *hashKeyFile)
+	}
+	mapper.HashKey = key
+	return mapper, nil
 }
 
 func buildVarnishNCSAFormat() string {
-	format := "method=\"%m\" status=%s path=\"%U\" cache=\"%{Varnish:hitmiss}x\" host=\"%{host}i\" time:%D"
+	return joinFormatFields(buildVarnishNCSAFields())
+}
+
+func buildVarnishNCSAFields() []formatField {
+	fields := []formatField{
+		{"method=\"%m\" status=%s path=\"%U\"", false, varnishVersion{}},
+		{"cache=\"%{Varnish:hitmiss}x\"", true, varnishVersion{4, 0, 0}},
+		{"host=\"%{host}i\"", false, varnishVersion{}},
+		{"time:" + durationName.Field().Spec, false, durationName.Field().MinVersion},
+	}
+	if *backendStats {
+		fields = append(fields, formatField{sideFormat, false, varnishVersion{4, 1, 0}})
+	}
+	if *contentType {
+		fields = append(fields, formatField{contentTypeFormat, true, varnishVersion{}})
+	}
+	if *contentClass {
+		fields = append(fields, formatField{contentClassFormat, true, varnishVersion{}})
+	}
 	if *beFirstByte {
-		format += " time_firstbyte:%{Varnish:time_firstbyte}x"
+		fields = append(fields, formatField{"time_firstbyte:%{Varnish:time_firstbyte}x", true, varnishVersion{4, 0, 0}})
 	}
 	if *sizes {
-		format += " respsize:%b"
+		fields = append(fields, formatField{"respsize:%b", true, varnishVersion{}})
+	}
+	if *queueTime {
+		fields = append(fields, formatField{"queue_seconds:%{VSL:Timestamp:Req[2]}x", true, varnishVersion{6, 0, 0}})
 	}
-	return format
+	if *traceEndpoint != "" {
+		// VSL record prefixes were added to varnishncsa in Varnish 6.0
+		fields = append(fields, formatField{tracingFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *enterpriseVSL {
+		fields = append(fields, formatField{enterpriseFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *uncacheStats || *synthStats || *waitingList || *streamStats || *deliveryStats {
+		fields = append(fields, formatField{handlingFormat, true, varnishVersion{4, 0, 0}})
+	}
+	if *uncacheStats {
+		fields = append(fields, formatField{uncacheableFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *synthStats {
+		fields = append(fields, formatField{synthFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *streamStats {
+		fields = append(fields, formatField{streamFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *streamStats || *deliveryStats {
+		fields = append(fields, formatField{deliverTimeFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *deliveryStats {
+		fields = append(fields, formatField{throughputFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *waitingList {
+		fields = append(fields, formatField{waitinglistFormat, true, varnishVersion{6, 0, 0}})
+	}
+	if *condStats {
+		fields = append(fields, formatField{conditionalFormat, true, varnishVersion{}})
+	}
+	if *rateLimits {
+		fields = append(fields, formatField{rateLimitFormat, true, varnishVersion{}})
+	}
+	if *redirectStats {
+		fields = append(fields, formatField{redirectFormat, true, varnishVersion{}})
+	}
+	if *freshStats {
+		fields = append(fields, formatField{freshnessFormat, true, varnishVersion{}})
+	}
+	if *geoCountryDB != "" || *geoASNDB != "" {
+		fields = append(fields, formatField{geoFormat(*geoIPHeader), true, varnishVersion{}})
+	}
+	if *surrogateTopK > 0 {
+		fields = append(fields, formatField{surrogateKeyFormat, true, varnishVersion{}})
+	}
+	if *restartDelay > 0 || *outlierTime > 0 {
+		fields = append(fields, formatField{vxidFormat, true, varnishVersion{4, 1, 0}})
+	}
+	if *h2Metrics {
+		fields = append(fields,
+			formatField{h2Format, true, varnishVersion{6, 0, 0}},
+			formatField{h2ResetFormat, true, varnishVersion{7, 2, 0}})
+	}
+	return fields
 }
 
 func buildVarnishNCSAArgs(vslQuery string, format string) []string {
@@ -238,5 +1144,17 @@ func buildVarnishNCSAArgs(vslQuery string, format string) []string {
 	if *instance != "" {
 		args = append(args, "-n", *instance)
 	}
-	return args
+	if *vslTimeout != "" {
+		args = append(args, "-t", *vslTimeout)
+	}
+	if *vslLimit > 0 {
+		args = append(args, "-L", strconv.Itoa(*vslLimit))
+	}
+	if *vslEndTimeout > 0 {
+		args = append(args, "-T", strconv.FormatFloat(vslEndTimeout.Seconds(), 'f', -1, 64))
+	}
+	if *backendStats {
+		args = append(args, "-b", "-c")
+	}
+	return append(args, extraArgs...)
 }
@@ -0,0 +1,323 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// formatCheckTimeout limits how long a single varnishncsa test run may take.
+const formatCheckTimeout = 10 * time.Second
+
+// formatField is a group of key/value pairs in the varnishncsa format.
+// Optional fields are dropped if the installed varnishncsa does not
+// support their format specifiers.
+type formatField struct {
+	Spec     string
+	Optional bool
+	// MinVersion is the first Varnish version that supports the field.
+	MinVersion varnishVersion
+}
+
+func joinFormatFields(fields []formatField) string {
+	specs := make([]string, len(fields))
+	for i, f := range fields {
+		specs[i] = f.Spec
+	}
+	return strings.Join(specs, " ")
+}
+
+// checkVarnishNCSAFormat runs varnishncsa once in dump mode to see if it
+// accepts the format, rather than having the long-running varnishncsa die
+// with a confusing error. If it doesn't, each optional field is tried on
+// its own and left out if it is not supported, since format specifiers
+// differ between Varnish versions.
+func checkVarnishNCSAFormat(fields []formatField) (string, error) {
+	format := joinFormatFields(fields)
+	err := testVarnishNCSAFormat(format)
+	if err == nil {
+		return format, nil
+	}
+	if _, ok := err.(*exec.Error); ok {
+		// varnishncsa is not installed or not in PATH, let the real run fail
+		log.Warnf("could not check varnishncsa format: %v", err)
+		return format, nil
+	}
+	if _, ok := err.(varnishUnavailableError); ok {
+		// Varnish isn't up yet, and the real run waits for it
+		log.Warnf("could not check varnishncsa format, using it unchecked: %v", err)
+		return format, nil
+	}
+	log.Warnf("varnishncsa rejected the log format: %v", err)
+
+	var required, accepted []formatField
+	for _, f := range fields {
+		if !f.Optional {
+			required = append(required, f)
+		}
+	}
+	if err := testVarnishNCSAFormat(joinFormatFields(required)); err != nil {
+		if _, ok := err.(varnishUnavailableError); ok {
+			log.Warnf("could not check varnishncsa format, using it unchecked: %v", err)
+			return format, nil
+		}
+		return "", fmt.Errorf("varnishncsa rejected the required log format fields: %v", err)
+	}
+	for _, f := range fields {
+		if !f.Optional {
+			accepted = append(accepted, f)
+			continue
+		}
+		err := testVarnishNCSAFormat(joinFormatFields(append(required, f)))
+		if _, ok := err.(varnishUnavailableError); ok {
+			log.Warnf("could not check varnishncsa support for %s, keeping it: %v", f.Spec, err)
+		} else if err != nil {
+			log.Warnf("varnishncsa does not support %s, leaving it out: %v", f.Spec, err)
+			continue
+		}
+		accepted = append(accepted, f)
+	}
+	return joinFormatFields(accepted), nil
+}
+
+// varnishUnavailableError is returned by testVarnishNCSAFormat when
+// varnishncsa could not attach to the Varnish shared memory log, which
+// says nothing about the format.
+type varnishUnavailableError string
+
+func (e varnishUnavailableError) Error() string {
+	return string(e)
+}
+
+// vsmErrors are parts of the messages varnishncsa exits with when varnishd
+// isn't running, or hasn't set up its shared memory log yet.
+var vsmErrors = []string{
+	"VSM",
+	"shared memory",
+	"_.vsm",
+	"Could not get hold of varnishd",
+	"is it running",
+}
+
+// isVSMError tells whether a varnishncsa error message is about attaching
+// to the shared memory log rather than about its arguments.
+func isVSMError(msg string) bool {
+	for _, e := range vsmErrors {
+		if strings.Contains(msg, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFormatCheckArgs returns the arguments for checking a format: the
+// connection flags and extra arguments the real varnishncsa gets, but in
+// dump mode, for at most one already logged transaction.
+func buildFormatCheckArgs(format string) []string {
+	args := []string{"-d", "-k", "1", "-F", format}
+	if *instance != "" {
+		args = append(args, "-n", *instance)
+	}
+	if *vslTimeout != "" {
+		args = append(args, "-t", *vslTimeout)
+	}
+	return append(args, extraArgs...)
+}
+
+// testVarnishNCSAFormat runs varnishncsa with the given format on at most
+// one already logged transaction. It returns a varnishUnavailableError if
+// varnishncsa could not get to the log.
+func testVarnishNCSAFormat(format string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), formatCheckTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "varnishncsa", buildFormatCheckArgs(format)...)
+	cmd.Stderr = &stderr
+	if *runAsUser != "" {
+		cred, err := credentialsFor(*runAsUser)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		// It got as far as reading the log, so the format was accepted
+		return nil
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		msg := strings.TrimSpace(stderr.String())
+		if isVSMError(msg) {
+			return varnishUnavailableError(msg)
+		}
+		if msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+	}
+	return err
+}
+
+// varnishVersion is a Varnish Cache release version.
+type varnishVersion struct {
+	Major, Minor, Patch int
+}
+
+func (v varnishVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less reports whether v is an older release than w.
+func (v varnishVersion) Less(w varnishVersion) bool {
+	if v.Major != w.Major {
+		return v.Major < w.Major
+	}
+	if v.Minor != w.Minor {
+		return v.Minor < w.Minor
+	}
+	return v.Patch < w.Patch
+}
+
+var versionRegexp = regexp.MustCompile(`\(varnish-(?:plus-)?(\d+)\.(\d+)\.(\d+)\S*(?: revision (\w+))?\)`)
+
+// parseVarnishVersion parses the output of varnishd -V or varnishncsa -V,
+// such as "varnishd (varnish-6.0.7 revision 525d371e3ea0e0c38edd7baf0f80dc226560f26e)".
+func parseVarnishVersion(output string) (version varnishVersion, revision string, err error) {
+	m := versionRegexp.FindStringSubmatch(output)
+	if m == nil {
+		return version, "", fmt.Errorf("no version found in %q", strings.TrimSpace(output))
+	}
+	version.Major, _ = strconv.Atoi(m[1])
+	version.Minor, _ = strconv.Atoi(m[2])
+	version.Patch, _ = strconv.Atoi(m[3])
+	return version, m[4], nil
+}
+
+var (
+	versionOnce     sync.Once
+	detectedVersion varnishVersion
+	detectedRev     string
+	versionErr      error
+)
+
+// detectVarnishVersion asks varnishd, or failing that varnishncsa, for its
+// version and revision. Varnish is only asked once; later calls, as when
+// the format is rebuilt, return the same result.
+func detectVarnishVersion() (varnishVersion, string, error) {
+	versionOnce.Do(func() {
+		for _, name := range []string{"varnishd", "varnishncsa"} {
+			output, err := exec.Command(name, "-V").CombinedOutput()
+			if err != nil {
+				versionErr = err
+				continue
+			}
+			if detectedVersion, detectedRev, versionErr = parseVarnishVersion(string(output)); versionErr == nil {
+				return
+			}
+		}
+	})
+	return detectedVersion, detectedRev, versionErr
+}
+
+// registerVarnishInfo exports the Varnish version as an info metric. It
+// may be called more than once with the same version.
+func registerVarnishInfo(version varnishVersion, revision string) error {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "exporter_varnish_info",
+		Help:        "Version of Varnish the exporter is reading logs from.",
+		ConstLabels: prometheus.Labels{"version": version.String(), "revision": revision},
+	})
+	info.Set(1)
+	if err := prometheus.Register(info); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterFormatFields drops the optional fields that the given Varnish
+// version does not support.
+func filterFormatFields(fields []formatField, version varnishVersion) []formatField {
+	result := make([]formatField, 0, len(fields))
+	for _, f := range fields {
+		if f.Optional && version.Less(f.MinVersion) {
+			log.Warnf("Varnish %s does not support %s (needs %s), leaving it out", version, f.Spec, f.MinVersion)
+			continue
+		} else if version.Less(f.MinVersion) {
+			log.Warnf("Varnish %s does not support %s (needs %s)", version, f.Spec, f.MinVersion)
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// durationField is a varnishncsa field that can feed the request time
+// histogram, and the number of its units per second.
+type durationField struct {
+	Spec       string
+	PerSecond  float64
+	MinVersion varnishVersion
+}
+
+var durationFields = map[string]durationField{
+	// Time taken to serve the request, in microseconds
+	"D": {"%D", 1e6, varnishVersion{}},
+	// Time taken to serve the request, in whole seconds
+	"T": {"%T", 1, varnishVersion{}},
+	// Time from the start of the request until the response was delivered
+	"resp": {"%{VSL:Timestamp:Resp[2]}x", 1, varnishVersion{6, 0, 0}},
+	// Time from the start of the request until processing finished and
+	// delivery began
+	"process": {"%{VSL:Timestamp:Process[2]}x", 1, varnishVersion{6, 0, 0}},
+}
+
+// durationFieldFlag is a flag.Value naming one of durationFields.
+type durationFieldFlag string
+
+func (f *durationFieldFlag) String() string {
+	return string(*f)
+}
+
+func (f *durationFieldFlag) Set(value string) error {
+	if _, ok := durationFields[value]; !ok {
+		names := make([]string, 0, len(durationFields))
+		for name := range durationFields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("must be one of %s", strings.Join(names, ", "))
+	}
+	*f = durationFieldFlag(value)
+	return nil
+}
+
+// Field returns the selected durationField.
+func (f *durationFieldFlag) Field() durationField {
+	return durationFields[string(*f)]
+}
@@ -0,0 +1,101 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseVarnishVersion(t *testing.T) {
+	tests := []struct {
+		output   string
+		version  varnishVersion
+		revision string
+		err      bool
+	}{
+		{
+			output:   "varnishd (varnish-6.0.7 revision 525d371e3ea0e0c38edd7baf0f80dc226560f26e)\nCopyright (c) 2006 Verdens Gang AS\n",
+			version:  varnishVersion{6, 0, 7},
+			revision: "525d371e3ea0e0c38edd7baf0f80dc226560f26e",
+		},
+		{output: "varnishncsa (varnish-plus-6.0.6r8 revision abc)", version: varnishVersion{6, 0, 6}, revision: "abc"},
+		{output: "varnishncsa (varnish-4.1.11)", version: varnishVersion{4, 1, 11}},
+		{output: "varnishd: command not found", err: true},
+	}
+	for _, test := range tests {
+		version, revision, err := parseVarnishVersion(test.output)
+		if version != test.version || revision != test.revision || test.err != (err != nil) {
+			t.Errorf("parseVarnishVersion(%q) = %v, %q, %v", test.output, version, revision, err)
+		}
+	}
+}
+
+func TestIsVSMError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"VSM: Could not get hold of varnishd, is it running?", true},
+		{"Cannot open /var/lib/varnish/host/_.vsm: No such file or directory", true},
+		{"Could not open shared memory", true},
+		{"Unknown format specifier at: %{Varnish:foo}x", false},
+		{"Missing tag in %{Foo}x", false},
+	}
+	for _, test := range tests {
+		if got := isVSMError(test.msg); got != test.want {
+			t.Errorf("isVSMError(%q) = %v, want %v", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestBuildFormatCheckArgs(t *testing.T) {
+	defer func(i, timeout string, extra argsFlag) {
+		*instance, *vslTimeout, extraArgs = i, timeout, extra
+	}(*instance, *vslTimeout, extraArgs)
+	*instance, *vslTimeout, extraArgs = "edge", "5", argsFlag{"-L", "5000"}
+	want := []string{"-d", "-k", "1", "-F", "%m", "-n", "edge", "-t", "5", "-L", "5000"}
+	if got := buildFormatCheckArgs("%m"); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildFormatCheckArgs = %q, want %q", got, want)
+	}
+}
+
+// TestCheckFormatWithoutVarnish checks that the format is used unchecked,
+// rather than rejected, when varnishncsa can't attach to Varnish.
+func TestCheckFormatWithoutVarnish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "varnishncsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\necho 'VSM: Could not get hold of varnishd, is it running?' >&2\nexit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "varnishncsa"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	fields := []formatField{{Spec: `path="%U"`}, {Spec: `cache="%{Varnish:hitmiss}x"`, Optional: true}}
+	format, err := checkVarnishNCSAFormat(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := joinFormatFields(fields); format != want {
+		t.Errorf("format = %q, want %q", format, want)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/prometheus/common/log"
+)
+
+// buildVSLFileArgs returns the varnishncsa arguments for reading a binary
+// VSL file instead of the shared memory log of a running Varnish.
+func buildVSLFileArgs(file string, vslQuery string, format string) []string {
+	args := []string{"-r", file, "-F", format}
+	if vslQuery != "" {
+		args = append(args, "-q", vslQuery)
+	}
+	if *backendStats {
+		args = append(args, "-b", "-c")
+	}
+	return append(args, extraArgs...)
+}
+
+// openVSLFile runs varnishncsa over a binary VSL file, as written by
+// varnishlog -w, and returns its output in the given format. Reading
+// fails with an error if varnishncsa does.
+func openVSLFile(file string, format string) (io.Reader, error) {
+	args := buildVSLFileArgs(file, buildVslQuery(), format)
+	log.Infof("Running command: varnishncsa %v", args)
+	cmd := exec.Command("varnishncsa", args...)
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		forwardStderr(stderr, "varnishncsa")
+		close(done)
+	}()
+	go func() {
+		// Wait closes stderr, so it must all be read first
+		<-done
+		if err := cmd.Wait(); err != nil {
+			_ = w.CloseWithError(fmt.Errorf("varnishncsa -r %s: %v", file, err))
+			return
+		}
+		_ = w.Close()
+	}()
+	return r, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// vsmDirs are the directories below the Varnish working directory that
+// hold the shared memory segments varnishncsa reads, in Varnish 5.2 and
+// later.
+var vsmDirs = []string{"_.vsm_mgt", "_.vsm_child"}
+
+// checkVSMAccess verifies that varnishncsa, running with cred or, if cred
+// is nil, as the exporter itself, can read the shared memory log in the
+// Varnish working directory dir. The error explains how to fix it, which
+// varnishncsa's own error does not.
+func checkVSMAccess(dir string, cred *syscall.Credential) error {
+	uid, gids := uint32(os.Getuid()), []uint32{uint32(os.Getgid())}
+	if cred != nil {
+		uid, gids = cred.Uid, append([]uint32{cred.Gid}, cred.Groups...)
+	} else if groups, err := os.Getgroups(); err == nil {
+		for _, g := range groups {
+			gids = append(gids, uint32(g))
+		}
+	}
+	if uid == 0 {
+		return nil
+	}
+	for _, path := range append([]string{dir}, joinAll(dir, vsmDirs)...) {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) && path != dir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if canReadDir(fi.Mode(), st, uid, gids) {
+			continue
+		}
+		userName, groupName := lookupUserName(uid), lookupGroupName(st.Gid)
+		fix := fmt.Sprintf("add it to the group with \"usermod -a -G %s %s\" and restart the exporter", groupName, userName)
+		if cred == nil {
+			fix += ", or use -varnish.run-as-user to run varnishncsa as a user in the group"
+		}
+		return fmt.Errorf("user %s cannot read the Varnish shared memory log in %s (owner %s, group %s, mode %v); %s",
+			userName, path, lookupUserName(st.Uid), groupName, fi.Mode().Perm(), fix)
+	}
+	return nil
+}
+
+// canReadDir tells whether uid, with the groups gids, may list and enter
+// a directory with the given mode and ownership.
+func canReadDir(mode os.FileMode, st *syscall.Stat_t, uid uint32, gids []uint32) bool {
+	const readExec = 05
+	perm := uint32(mode.Perm())
+	if st.Uid == uid {
+		return perm>>6&readExec == readExec
+	}
+	for _, gid := range gids {
+		if st.Gid == gid {
+			return perm>>3&readExec == readExec
+		}
+	}
+	return perm&readExec == readExec
+}
+
+func joinAll(dir string, names []string) []string {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+	}
+	return paths
+}
+
+func lookupUserName(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+func lookupGroupName(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
+}
@@ -0,0 +1,77 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// waitinglistFormat logs the time a request spent on the waiting list of
+// a busy object, which Varnish only logs for requests that had to wait.
+const waitinglistFormat = `_waitinglist="%{VSL:Timestamp:Waitinglist[3]}x"`
+
+// waitinglistSink makes request coalescing visible: requests that waited
+// for an object another request was fetching, how long they waited, and
+// requests that hit a hit-for-pass or hit-for-miss object and so went to
+// the backend on their own.
+type waitinglistSink struct {
+	coalesced *prometheus.CounterVec
+	wait      *prometheus.HistogramVec
+	uncached  *prometheus.CounterVec
+}
+
+func newWaitinglistSink() (*waitinglistSink, error) {
+	s := &waitinglistSink{
+		coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "coalesced_requests_total",
+			Help:      "Number of requests that waited on the waiting list for an object another request was fetching.",
+		}, []string{"host"}),
+		wait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "waitinglist_seconds",
+			Help:      "Time requests spent on the waiting list of a busy object.",
+		}, []string{"host"}),
+		uncached: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hit_for_pass_requests_total",
+			Help:      "Number of requests that found a hit-for-pass or hit-for-miss object, and so were not coalesced.",
+		}, []string{"host", "handling"}),
+	}
+	for _, c := range []prometheus.Collector{s.coalesced, s.wait, s.uncached} {
+		if err := prometheus.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Record implements sink.
+func (s *waitinglistSink) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	host := labels.Value("host")
+	// varnishncsa logs "-" for requests that didn't wait
+	if wait, err := strconv.ParseFloat(labels.Extra["_waitinglist"], 64); err == nil {
+		s.coalesced.WithLabelValues(host).Inc()
+		s.wait.WithLabelValues(host).Observe(wait)
+	}
+	switch handling := labels.Extra["_handling"]; handling {
+	case "hitpass", "hitmiss":
+		s.uncached.WithLabelValues(host, handling).Inc()
+	}
+}
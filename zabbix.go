@@ -0,0 +1,320 @@
+// Copyright 2016-2020 Markus Lindenberg, Stig Bakken
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/stigsb/varnishncsa_exporter/pkg/parser"
+)
+
+// zabbixAggregates are the values a Zabbix key can be mapped to, computed
+// over the requests of one interval.
+var zabbixAggregates = map[string]bool{
+	"requests":   true,
+	"errors":     true,
+	"error_rate": true,
+	"mean":       true,
+	"p50":        true,
+	"p90":        true,
+	"p99":        true,
+}
+
+// zabbixKey maps a Zabbix item key to an aggregate, over the requests for
+// one host, or all requests if host is empty.
+type zabbixKey struct {
+	Key       string
+	Aggregate string
+	Host      string
+}
+
+// loadZabbixKeys reads a key-mapping file. Each line has a Zabbix item
+// key, an aggregate, and optionally the host to aggregate requests for.
+func loadZabbixKeys(keysFile string) ([]zabbixKey, error) {
+	inFile, err := os.Open(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = inFile.Close() }()
+	var keys []zabbixKey
+	scanner := bufio.NewScanner(inFile)
+	commentRegexp := regexp.MustCompile("(#.*|^\\s+|\\s+$)")
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := commentRegexp.ReplaceAllString(scanner.Text(), "")
+		if line == "" {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected a key, an aggregate and optionally a host", keysFile, lineNo)
+		}
+		if !zabbixAggregates[parts[1]] {
+			return nil, fmt.Errorf("%s:%d: unknown aggregate %q", keysFile, lineNo, parts[1])
+		}
+		key := zabbixKey{Key: parts[0], Aggregate: parts[1]}
+		if len(parts) == 3 {
+			key.Host = parts[2]
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// zabbixWindow collects one interval's worth of requests.
+type zabbixWindow struct {
+	requests int
+	errors   int
+	sum      float64
+	times    []float64
+}
+
+// zabbixSender pushes request aggregates to a Zabbix server or proxy with
+// the sender protocol, as trapper items of a Zabbix host.
+type zabbixSender struct {
+	server string
+	host   string
+	keys   []zabbixKey
+
+	mu      sync.Mutex
+	windows map[string]*zabbixWindow
+
+	sent   prometheus.Counter
+	failed prometheus.Counter
+}
+
+func newZabbixSender(server, host, keysFile string, interval time.Duration) (*zabbixSender, error) {
+	keys, err := loadZabbixKeys(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "10051")
+	}
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	z := &zabbixSender{
+		server:  server,
+		host:    host,
+		keys:    keys,
+		windows: make(map[string]*zabbixWindow),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_zabbix_values_sent",
+			Help:      "Number of values the Zabbix server processed.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_zabbix_values_failed",
+			Help:      "Number of values that could not be sent or that the Zabbix server did not process.",
+		}),
+	}
+	for _, m := range []prometheus.Collector{z.sent, z.failed} {
+		if err := prometheus.Register(m); err != nil {
+			return nil, err
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			z.send()
+		}
+	}()
+	return z, nil
+}
+
+// Record implements sink.
+func (z *zabbixSender) Record(metrics []parser.Metric, labels *parser.Labelset) {
+	status, _ := strconv.Atoi(labels.Value("status"))
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for n, host := range []string{"", labels.Value("host")} {
+		if n > 0 && host == "" {
+			break
+		}
+		w, ok := z.windows[host]
+		if !ok {
+			w = &zabbixWindow{}
+			z.windows[host] = w
+		}
+		w.requests++
+		if status >= 500 {
+			w.errors++
+		}
+		for _, m := range metrics {
+			if m.Name != "time" {
+				continue
+			}
+			w.sum += m.Value
+			// Reservoir sampling, as for anomaly detection
+			if len(w.times) < anomalyReservoir {
+				w.times = append(w.times, m.Value)
+			} else if i := rand.Intn(w.requests); i < anomalyReservoir {
+				w.times[i] = m.Value
+			}
+		}
+	}
+}
+
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+type zabbixRequest struct {
+	Request string        `json:"request"`
+	Data    []zabbixValue `json:"data"`
+	Clock   int64         `json:"clock"`
+}
+
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// zabbixInfoRegexp picks the counts out of the info the server responds
+// with, such as "processed: 2; failed: 1; total: 3; seconds spent: 0.0001".
+var zabbixInfoRegexp = regexp.MustCompile(`processed: (\d+); failed: (\d+)`)
+
+func (z *zabbixSender) send() {
+	now := time.Now().Unix()
+	z.mu.Lock()
+	windows := z.windows
+	z.windows = make(map[string]*zabbixWindow)
+	z.mu.Unlock()
+
+	req := zabbixRequest{Request: "sender data", Clock: now}
+	for _, key := range z.keys {
+		w := windows[key.Host]
+		if w == nil {
+			w = &zabbixWindow{}
+		}
+		req.Data = append(req.Data, zabbixValue{
+			Host:  z.host,
+			Key:   key.Key,
+			Value: strconv.FormatFloat(w.aggregate(key.Aggregate), 'g', -1, 64),
+			Clock: now,
+		})
+	}
+	if len(req.Data) == 0 {
+		return
+	}
+	resp, err := z.post(&req)
+	if err != nil {
+		z.failed.Add(float64(len(req.Data)))
+		log.Errorf("could not send values to Zabbix server %s: %v", z.server, err)
+		return
+	}
+	if resp.Response != "success" {
+		z.failed.Add(float64(len(req.Data)))
+		log.Errorf("Zabbix server %s responded %q: %s", z.server, resp.Response, resp.Info)
+		return
+	}
+	if m := zabbixInfoRegexp.FindStringSubmatch(resp.Info); m != nil {
+		processed, _ := strconv.Atoi(m[1])
+		failed, _ := strconv.Atoi(m[2])
+		z.sent.Add(float64(processed))
+		z.failed.Add(float64(failed))
+		if failed > 0 {
+			log.Warnf("Zabbix server %s did not process %d values, check that host %q has trapper items for all keys", z.server, failed, z.host)
+		}
+	}
+}
+
+func (w *zabbixWindow) aggregate(name string) float64 {
+	switch name {
+	case "requests":
+		return float64(w.requests)
+	case "errors":
+		return float64(w.errors)
+	case "error_rate":
+		if w.requests == 0 {
+			return 0
+		}
+		return float64(w.errors) / float64(w.requests)
+	case "mean":
+		if w.requests == 0 {
+			return 0
+		}
+		return w.sum / float64(w.requests)
+	}
+	sort.Float64s(w.times)
+	q, _ := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+	return quantile(w.times, q/100)
+}
+
+// post sends the request framed as the sender protocol wants it: a
+// "ZBXD\x01" header and the little-endian length of the JSON data.
+func (z *zabbixSender) post(req *zabbixRequest) (*zabbixResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", z.server, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	packet := make([]byte, 13, 13+len(body))
+	copy(packet, "ZBXD\x01")
+	binary.LittleEndian.PutUint64(packet[5:], uint64(len(body)))
+	if _, err := conn.Write(append(packet, body...)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "ZBXD" {
+		return nil, fmt.Errorf("unexpected response header %q", header[:5])
+	}
+	size := binary.LittleEndian.Uint64(header[5:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("response too large (%d bytes)", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	var resp zabbixResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}